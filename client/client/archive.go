@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	pb "tages/client/proto"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ArchiveFormat is the format of DownloadArchive.
+type ArchiveFormat int
+
+const (
+	Zip ArchiveFormat = iota
+	TarGz
+)
+
+func (f ArchiveFormat) String() string {
+	if f == TarGz {
+		return "tar.gz"
+	}
+	return "zip"
+}
+
+// ParseArchiveFormat accepts "zip" and "tar.gz" (or "tgz").
+func ParseArchiveFormat(s string) (ArchiveFormat, error) {
+	switch s {
+	case "zip":
+		return Zip, nil
+	case "tar.gz", "tgz":
+		return TarGz, nil
+	}
+	return 0, fmt.Errorf("unknown archive format %q", s)
+}
+
+// ArchiveRequest selects the images of an archive: the listed names, or
+// else every image whose name starts with Prefix.
+type ArchiveRequest struct {
+	Names  []string
+	Prefix string
+	Format ArchiveFormat
+}
+
+// DownloadArchive streams the selected images into w as a single archive
+// built by the server, and returns its size. Entries are named after the
+// images and keep their modification time. An archive cannot be resumed,
+// so failed calls are only retried before any data arrived.
+func (c *Client) DownloadArchive(ctx context.Context, req ArchiveRequest, w io.Writer) (int64, error) {
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	ctx, span := tracer.Start(ctx, "DownloadArchive", trace.WithAttributes(
+		attribute.Int("archive.names", len(req.Names)), attribute.String("archive.prefix", req.Prefix)))
+	defer span.End()
+
+	what := "archive of " + req.Prefix + "*"
+	if len(req.Names) > 0 {
+		what = fmt.Sprintf("archive of %d images", len(req.Names))
+	}
+	cw := &countingWriter{w: w}
+	progress := newTracker(c.opts.progress, what, Downloading, -1)
+	err = c.retry(ctx, func() (bool, error) {
+		err := c.downloadArchive(ctx, req, cw, progress)
+		return cw.n == 0, err
+	})
+	progress.finish(err)
+	if err != nil {
+		span.RecordError(err)
+		return cw.n, fmt.Errorf("cannot download %s: %w", what, err)
+	}
+	return cw.n, nil
+}
+
+func (c *Client) downloadArchive(ctx context.Context, req ArchiveRequest, w io.Writer, progress *tracker) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wd := c.newWatchdog(cancel)
+	defer func() { err = wd.stop(err) }()
+
+	format := pb.DownloadArchiveRequest_ZIP
+	if req.Format == TarGz {
+		format = pb.DownloadArchiveRequest_TAR_GZ
+	}
+	stream, err := c.svc.DownloadArchive(ctx, &pb.DownloadArchiveRequest{Names: req.Names, Prefix: req.Prefix, Format: format})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(res.GetData()); err != nil {
+			return fmt.Errorf("cannot write archive data: %w", err)
+		}
+		progress.add(len(res.GetData()))
+		wd.add(len(res.GetData()))
+	}
+}
@@ -0,0 +1,19 @@
+package client
+
+import "context"
+
+// tokenCredentials attaches a bearer token to every call.
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+// RequireTransportSecurity lets the token travel over plaintext connections
+// only when Dial was not asked for TLS, e.g. in local setups.
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	pb "tages/client/proto"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+)
+
+// BackupInfo describes a backup kept by the server in its backup.dir.
+type BackupInfo struct {
+	Name    string
+	Images  int
+	Bytes   int64
+	Created time.Time
+}
+
+func backupFromProto(p *pb.BackupInfo) *BackupInfo {
+	return &BackupInfo{Name: p.GetName(), Images: int(p.GetImages()), Bytes: p.GetBytes(), Created: time.Unix(0, p.GetCreated())}
+}
+
+// Backup makes the server write a point-in-time copy of all images, with a
+// manifest of their digests, to its backup directory under name, or under
+// the current time if name is empty. It needs an admin token. The call
+// lasts as long as the copy, so it has no call timeout.
+func (c *Client) Backup(ctx context.Context, name string) (*BackupInfo, error) {
+	res, err := c.svc.Backup(ctx, &pb.BackupRequest{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("cannot back up: %w", err)
+	}
+	return backupFromProto(res), nil
+}
+
+// RestoreBackup makes a server without images restore the backup called
+// name, checking the digest of every image. It needs an admin token.
+func (c *Client) RestoreBackup(ctx context.Context, name string) (*BackupInfo, error) {
+	res, err := c.svc.RestoreBackup(ctx, &pb.BackupRequest{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("cannot restore backup %s: %w", name, err)
+	}
+	return backupFromProto(res), nil
+}
+
+// KeyRotation counts the images a key rotation went through.
+type KeyRotation struct {
+	// Rewrapped images had their data key wrapped with the new primary key.
+	Rewrapped int
+	// Encrypted images were stored in plain before.
+	Encrypted int
+	Unchanged int
+}
+
+// RotateKeys makes the server reload its encryption key file and move all
+// images to the first key in it, after which older keys can be removed
+// from the file. It needs an admin token and has no call timeout.
+func (c *Client) RotateKeys(ctx context.Context) (*KeyRotation, error) {
+	res, err := c.svc.RotateKeys(ctx, &empty.Empty{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot rotate keys: %w", err)
+	}
+	return &KeyRotation{Rewrapped: int(res.GetRewrapped()), Encrypted: int(res.GetEncrypted()), Unchanged: int(res.GetUnchanged())}, nil
+}
@@ -0,0 +1,177 @@
+// Package client is a Go client for the image service. A Client is safe for
+// concurrent use; every transfer keeps its own state and the number of
+// simultaneous transfers is bounded by WithConcurrency.
+package client
+
+import (
+	"context"
+	"fmt"
+	pb "tages/client/proto"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+)
+
+// ImageInfo describes a stored image.
+type ImageInfo struct {
+	Name     string
+	Created  string
+	Modified string
+	// Size is set by the server; it is ignored on upload.
+	Size int64
+	// ModTime is kept by the server when given on upload. It is zero if
+	// the server does not report it.
+	ModTime time.Time
+	// SHA256 is the hex digest of the content, set by the server.
+	SHA256 string
+}
+
+func infoFromProto(p *pb.ImageInfo) ImageInfo {
+	info := ImageInfo{
+		Name:     p.GetName(),
+		Created:  p.GetCreated(),
+		Modified: p.GetModified(),
+		Size:     p.GetSize(),
+		SHA256:   p.GetSha256(),
+	}
+	if p.GetMtime() > 0 {
+		info.ModTime = time.Unix(0, p.GetMtime())
+	}
+	return info
+}
+
+func (i ImageInfo) toProto() *pb.ImageInfo {
+	p := &pb.ImageInfo{
+		Name:     i.Name,
+		Created:  i.Created,
+		Modified: i.Modified,
+	}
+	if !i.ModTime.IsZero() {
+		p.Mtime = i.ModTime.UnixNano()
+	}
+	return p
+}
+
+type Client struct {
+	svc  pb.ImageUploadServiceClient
+	conn *grpc.ClientConn // set when the Client owns the connection
+	opts options
+	sem  chan struct{}
+}
+
+// New returns a Client using an existing connection, which the caller keeps
+// ownership of.
+func New(conn grpc.ClientConnInterface, opts ...Option) *Client {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Client{
+		svc:  pb.NewImageUploadServiceClient(conn),
+		opts: o,
+		sem:  make(chan struct{}, o.concurrency),
+	}
+}
+
+// Dial connects to the server at addr. The connection is unencrypted unless
+// WithTLSConfig is given. Idempotent unary calls are retried by gRPC
+// following the retry policy. Calls are traced with OpenTelemetry and carry a
+// request ID the server logs.
+func Dial(addr string, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), requestIDUnaryInterceptor),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(), requestIDStreamInterceptor),
+		grpc.WithDefaultServiceConfig(serviceConfig(o.retry)),
+	}
+	if o.tls != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(o.tls)))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if o.token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(tokenCredentials{token: o.token, secure: o.tls != nil}))
+	}
+	dialOpts = append(dialOpts, o.dialOptions...)
+	conn, err := grpc.Dial(addr, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", addr, err)
+	}
+	c := New(conn, opts...)
+	c.conn = conn
+	return c, nil
+}
+
+// Close closes the connection if it was opened by Dial.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// acquire waits for a free transfer slot.
+func (c *Client) acquire(ctx context.Context) (func(), error) {
+	select {
+	case c.sem <- struct{}{}:
+		return func() { <-c.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// List returns all stored images.
+func (c *Client) List(ctx context.Context) ([]ImageInfo, error) {
+	return c.ListPrefix(ctx, "")
+}
+
+// Stat returns the info of the image called name.
+func (c *Client) Stat(ctx context.Context, name string) (*ImageInfo, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	var res *pb.ImageInfo
+	err := c.retryUnary(ctx, func() error {
+		var err error
+		res, err = c.svc.StatImage(ctx, &wrappers.StringValue{Value: name})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat %s: %w", name, err)
+	}
+	info := infoFromProto(res)
+	return &info, nil
+}
+
+// Delete removes the image called name from the server.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	// sent is set once an attempt reached the server and its answer was
+	// lost, so that it may have deleted the image
+	sent := false
+	err := c.retry(ctx, func() (bool, error) {
+		var p peer.Peer
+		_, err := c.svc.DeleteImage(ctx, &wrappers.StringValue{Value: name}, grpc.Peer(&p))
+		code := Code(err)
+		if sent && code == codes.NotFound {
+			return false, nil
+		}
+		if (code == codes.Unavailable || code == codes.DeadlineExceeded) && p.Addr != nil {
+			sent = true
+		}
+		return true, err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot delete %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	pb "tages/client/proto"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// Filter selects files by glob patterns in path.Match syntax, matched
+// against the slash-separated relative path and each of its trailing parts:
+// "*.jpg" matches "2020/b.jpg" and "raw/*" matches "2020/raw/c.cr2". A file
+// is selected if it matches one of Include (or Include is empty) and none of
+// Exclude.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+// Match reports whether the relative path name is selected.
+func (f Filter) Match(name string) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, name) {
+		return false
+	}
+	return !matchAny(f.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		i := strings.Index(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Validate reports malformed patterns.
+func (f Filter) Validate() error {
+	for _, p := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// FileResult is the outcome of one file of a directory transfer.
+type FileResult struct {
+	// Name is the image name on the server.
+	Name string
+	// Path is the local file.
+	Path string
+	Size int64
+	Err  error
+}
+
+// ListPrefix returns the stored images whose name starts with prefix.
+// Images uploaded from a directory are named after their relative path, so
+// "holidays/" lists the directory uploaded as "holidays".
+func (c *Client) ListPrefix(ctx context.Context, prefix string) ([]ImageInfo, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	var res *pb.ImageList
+	err := c.retryUnary(ctx, func() error {
+		var err error
+		res, err = c.svc.ListImages(ctx, &wrappers.StringValue{Value: prefix})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %w", err)
+	}
+	images := make([]ImageInfo, 0, len(res.GetImages()))
+	for _, img := range res.GetImages() {
+		images = append(images, infoFromProto(img))
+	}
+	return images, nil
+}
+
+// UploadDir uploads the files below dir selected by filter, concurrently.
+// Each image is named prefix + "/" + its path relative to dir, or just the
+// relative path if prefix is empty. Hidden files and directories are
+// skipped, since the server does not accept names starting with a dot.
+//
+// The results are in the order of the directory walk; the error is only set
+// if dir could not be walked.
+func (c *Client) UploadDir(ctx context.Context, dir, prefix string, filter Filter) ([]FileResult, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	var results []FileResult
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !filter.Match(rel) {
+			return nil
+		}
+		results = append(results, FileResult{Name: path.Join(prefix, rel), Path: p, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory: %w", err)
+	}
+
+	c.Each(len(results), func(i int) {
+		r := &results[i]
+		res, err := c.UploadFileAs(ctx, r.Path, r.Name)
+		if err != nil {
+			r.Err = err
+			return
+		}
+		r.Size = res.Size
+	})
+	return results, nil
+}
+
+// DownloadPrefix downloads the images whose name starts with prefix and
+// that are selected by filter into dir, concurrently. The part of prefix up
+// to its last slash is removed from the local paths, so "holidays/"
+// downloads the content of that directory and "holidays" the directory
+// itself.
+func (c *Client) DownloadPrefix(ctx context.Context, prefix, dir string, filter Filter) ([]FileResult, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	images, err := c.ListPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	strip := prefix[:strings.LastIndex(prefix, "/")+1]
+
+	var results []FileResult
+	for _, img := range images {
+		rel := strings.TrimPrefix(img.Name, strip)
+		if !filter.Match(rel) {
+			continue
+		}
+		r := FileResult{Name: img.Name, Size: img.Size}
+		if local, err := localPath(dir, rel); err != nil {
+			r.Err = err
+		} else {
+			r.Path = local
+		}
+		results = append(results, r)
+	}
+
+	c.Each(len(results), func(i int) {
+		r := &results[i]
+		if r.Err != nil {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+			r.Err = fmt.Errorf("cannot create directory: %w", err)
+			return
+		}
+		info, err := c.DownloadFile(ctx, r.Name, r.Path)
+		if err != nil {
+			r.Err = err
+			return
+		}
+		r.Size = info.Size
+	})
+	return results, nil
+}
+
+// localPath joins a slash-separated image name to dir, refusing names that
+// would end up outside of it.
+func localPath(dir, rel string) (string, error) {
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", errors.New("unsafe image name " + rel)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
+
+// Each calls fn(i) for every i in [0, n) on as many goroutines as the
+// client runs transfers at once, and returns once all calls have finished.
+func (c *Client) Each(n int, fn func(i int)) {
+	workers := c.opts.concurrency
+	if workers > n {
+		workers = n
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Download streams the image called name into w and returns its info,
+// decrypting it if the Client has WithEncryption. Failed calls are retried
+// following the retry policy, resuming after the bytes already received.
+// The download fails with codes.FailedPrecondition if the image changes in
+// between.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) (*ImageInfo, error) {
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, span := tracer.Start(ctx, "Download", trace.WithAttributes(attribute.String("image.name", name)))
+	defer span.End()
+
+	// the opener keeps the partial segment of an interrupted attempt, so
+	// resuming counts the encrypted bytes received
+	var op *opener
+	cw := &countingWriter{w: w}
+	if c.opts.encryption != nil {
+		op = c.opts.encryption.open(w)
+		cw.w = op
+	}
+	progress := newTracker(c.opts.progress, name, Downloading, -1)
+	var info *ImageInfo
+	err = c.retry(ctx, func() (bool, error) {
+		got, err := c.download(ctx, name, cw, info, progress)
+		if got != nil {
+			info = got
+		}
+		return true, err
+	})
+	if err == nil && op != nil {
+		if err = op.Close(); err == nil {
+			info.Size = openedSize(info.Size)
+		}
+	}
+	progress.finish(err)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("cannot download %s: %w", name, err)
+	}
+	return info, nil
+}
+
+// resumeOffsetKey asks the server to start a download at the given offset.
+const resumeOffsetKey = "x-resume-offset"
+
+// download writes the image to w starting at w.n, the number of bytes
+// written by earlier attempts; seen is the info they received. The returned
+// info is set as soon as the server sent it, even if the download fails.
+func (c *Client) download(ctx context.Context, name string, w *countingWriter, seen *ImageInfo, progress *tracker) (_ *ImageInfo, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wd := c.newWatchdog(cancel)
+	defer func() { err = wd.stop(err) }()
+
+	offset := w.n
+	if offset > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, resumeOffsetKey, strconv.FormatInt(offset, 10))
+	}
+	stream, err := c.svc.DownloadImage(ctx, &wrappers.StringValue{Value: name})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	info := infoFromProto(res.GetInfo())
+	if seen != nil && (info.Size != seen.Size || info.Modified != seen.Modified) {
+		return nil, status.Errorf(codes.FailedPrecondition, "image %s changed while downloading", name)
+	}
+	progress.setTotal(info.Size)
+	wd.expect(info.Size - offset)
+
+	// servers that do not know about resuming send the whole image again
+	skip := offset
+	if hdr, err := stream.Header(); err == nil {
+		if v := hdr.Get(resumeOffsetKey); len(v) > 0 && v[0] == strconv.FormatInt(offset, 10) {
+			skip = 0
+		}
+	}
+
+	spans := newChunkSpans(ctx, "Download.chunks")
+	defer spans.end()
+	for {
+		recvStart := time.Now()
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &info, err
+		}
+		chunk := res.GetChunkdata()
+		if skip > 0 {
+			n := int64(len(chunk))
+			if n > skip {
+				n = skip
+			}
+			chunk = chunk[n:]
+			skip -= n
+		}
+
+		writeStart := time.Now()
+		if _, err := w.Write(chunk); err != nil {
+			// decryption failures already say what went wrong
+			if _, ok := status.FromError(err); ok {
+				return &info, err
+			}
+			return &info, fmt.Errorf("cannot write image data: %w", err)
+		}
+		spans.add(len(chunk), time.Since(writeStart), writeStart.Sub(recvStart))
+		progress.add(len(chunk))
+		wd.add(len(chunk))
+	}
+	return &info, nil
+}
+
+// DownloadFile downloads the image called name to path. The file only
+// appears under path once the download is complete, with the modification
+// time reported by the server.
+func (c *Client) DownloadFile(ctx context.Context, name, path string) (*ImageInfo, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	info, err := c.Download(ctx, name, tmp)
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("cannot write file: %w", cerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.ModTime.IsZero() {
+		os.Chtimes(tmp.Name(), time.Now(), info.ModTime)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("cannot write file: %w", err)
+	}
+	return info, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// End-to-end encrypted images are stored as a header followed by the
+// content sealed with AES-256-GCM in segments of e2eSegment bytes:
+//
+//	"TAGESE2E" | version | kdf | kdf parameters (4) | salt (16) | file nonce (32) | key check (16)
+//
+// The master key is derived from the passphrase or key file with the kdf,
+// its parameters and the salt of the header: scrypt with log2 N, r and p in
+// the first three parameter bytes for a passphrase, an HMAC for a key file,
+// which is random enough already. The key of the file is an HMAC of its
+// nonce under the master key, so every file has its own. The key check
+// tells a wrong key from damaged data. Each segment's nonce is its index
+// plus a flag marking the last one, and the header is authenticated with
+// every segment, so nothing can be reordered, cut off or swapped unnoticed.
+const (
+	e2eMagic     = "TAGESE2E"
+	e2eVersion   = 1
+	e2eHeaderLen = len(e2eMagic) + 1 + 1 + 4 + 16 + 32 + 16
+	e2eSegment   = 64 << 10
+	e2eOverhead  = 16
+	kdfKeyFile   = 0
+	// kdf 1 is reserved: the first version of this mode derived passphrase
+	// keys with PBKDF2 under it; such files are rejected as unsupported
+	kdfScrypt     = 2
+	minKeyFileLen = 32
+)
+
+// scryptParams are the scrypt parameters of new files: N = 2^15, r = 8,
+// p = 1, which takes 32 MiB and about 0.1s.
+var scryptParams = []byte{15, 8, 1, 0}
+
+// Encryption holds the secret used by WithEncryption.
+type Encryption struct {
+	secret []byte
+	kdf    byte
+	params []byte
+	// salt is used for the master key of new files, so that it is derived
+	// only once per Encryption
+	salt []byte
+
+	mu      sync.Mutex
+	masters map[string][]byte
+}
+
+// EncryptWithPassphrase derives the keys from passphrase, stretched with
+// scrypt.
+func EncryptWithPassphrase(passphrase string) (*Encryption, error) {
+	if passphrase == "" {
+		return nil, errors.New("the passphrase is empty")
+	}
+	return newEncryption([]byte(passphrase), kdfScrypt, scryptParams), nil
+}
+
+// EncryptWithKeyFile derives the keys from the content of the file at path,
+// which must hold at least 32 random bytes, e.g. from
+// "head -c 32 /dev/urandom".
+func EncryptWithKeyFile(path string) (*Encryption, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %w", err)
+	}
+	if len(secret) < minKeyFileLen {
+		return nil, fmt.Errorf("key file %s must hold at least %d bytes", path, minKeyFileLen)
+	}
+	return newEncryption(secret, kdfKeyFile, []byte{0, 0, 0, 0}), nil
+}
+
+func newEncryption(secret []byte, kdf byte, params []byte) *Encryption {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return &Encryption{secret: secret, kdf: kdf, params: params, salt: salt, masters: make(map[string][]byte)}
+}
+
+// master returns the master key for the kdf, parameters and salt of a
+// header.
+func (e *Encryption) master(kdf byte, params, salt []byte) ([]byte, error) {
+	switch {
+	case kdf != kdfKeyFile && kdf != kdfScrypt:
+		return nil, status.Errorf(codes.FailedPrecondition, "unsupported key derivation %d", kdf)
+	case kdf != e.kdf && kdf == kdfScrypt:
+		return nil, status.Error(codes.FailedPrecondition, "image was encrypted with a passphrase, not a key file")
+	case kdf != e.kdf:
+		return nil, status.Error(codes.FailedPrecondition, "image was encrypted with a key file, not a passphrase")
+	}
+	id := fmt.Sprintf("%d/%x/%x", kdf, params, salt)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if m, ok := e.masters[id]; ok {
+		return m, nil
+	}
+	var m []byte
+	if kdf == kdfScrypt {
+		// bounded so that a header cannot ask for more than 1 GiB
+		logN, r, p := params[0], int(params[1]), int(params[2])
+		if logN < 10 || logN > 20 || r < 1 || r > 8 || p < 1 || p > 4 {
+			return nil, status.Errorf(codes.DataLoss, "invalid encryption header: scrypt parameters N=2^%d, r=%d, p=%d", logN, r, p)
+		}
+		var err error
+		if m, err = scrypt.Key(e.secret, salt, 1<<logN, r, p, 32); err != nil {
+			return nil, err
+		}
+	} else {
+		m = hmacSum(e.secret, []byte("tages e2e master key"), salt)
+	}
+	e.masters[id] = m
+	return m, nil
+}
+
+func hmacSum(key []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// fileCipher returns the cipher of the file described by a complete header.
+func (e *Encryption) fileCipher(h []byte) (cipher.AEAD, error) {
+	if h[len(e2eMagic)] != e2eVersion {
+		return nil, status.Errorf(codes.FailedPrecondition, "unsupported encryption version %d", h[len(e2eMagic)])
+	}
+	p := h[len(e2eMagic)+1:]
+	master, err := e.master(p[0], p[1:5], p[5:21])
+	if err != nil {
+		return nil, err
+	}
+	key := hmacSum(master, []byte("tages e2e file key"), p[21:53])
+	if !hmac.Equal(hmacSum(key, []byte("tages e2e key check"))[:16], p[53:69]) {
+		return nil, status.Error(codes.PermissionDenied, "cannot decrypt image: wrong passphrase or key file")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader returns the header of a new file.
+func (e *Encryption) newHeader() ([]byte, error) {
+	h := make([]byte, 0, e2eHeaderLen)
+	h = append(h, e2eMagic...)
+	h = append(h, e2eVersion, e.kdf)
+	h = append(h, e.params...)
+	h = append(h, e.salt...)
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	h = append(h, nonce...)
+	master, err := e.master(e.kdf, e.params, e.salt)
+	if err != nil {
+		return nil, err
+	}
+	key := hmacSum(master, []byte("tages e2e file key"), nonce)
+	return append(h, hmacSum(key, []byte("tages e2e key check"))[:16]...), nil
+}
+
+func e2eNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	if last {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// sealedSize returns the size of n bytes once encrypted.
+func sealedSize(n int64) int64 {
+	segments := (n + e2eSegment - 1) / e2eSegment
+	if segments == 0 {
+		segments = 1
+	}
+	return int64(e2eHeaderLen) + n + segments*e2eOverhead
+}
+
+// openedSize returns the size of the content of an encrypted image of n
+// bytes.
+func openedSize(n int64) int64 {
+	body := n - int64(e2eHeaderLen)
+	if body < e2eOverhead {
+		return 0
+	}
+	return body - (body+e2eSegment+e2eOverhead-1)/(e2eSegment+e2eOverhead)*e2eOverhead
+}
+
+// sealer encrypts what it reads from r. It reads one byte past a segment
+// before sealing it, to know whether it is the last one.
+type sealer struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	aad   []byte
+	plain []byte
+	out   []byte
+	next  int64
+	done  bool
+}
+
+// seal returns a reader of r encrypted under a new file key.
+func (e *Encryption) seal(r io.Reader) (io.Reader, error) {
+	h, err := e.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.fileCipher(h)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{r: r, aead: aead, aad: h, plain: make([]byte, 0, e2eSegment+1), out: h}, nil
+}
+
+func (s *sealer) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+func (s *sealer) fill() error {
+	n, err := io.ReadFull(s.r, s.plain[len(s.plain):cap(s.plain)])
+	s.plain = s.plain[:len(s.plain)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if len(s.plain) <= e2eSegment {
+		s.done = true
+		s.out = s.aead.Seal(nil, e2eNonce(s.next, true), s.plain, s.aad)
+		return nil
+	}
+	s.out = s.aead.Seal(nil, e2eNonce(s.next, false), s.plain[:e2eSegment], s.aad)
+	s.next++
+	s.plain = append(s.plain[:0], s.plain[e2eSegment])
+	return nil
+}
+
+// opener decrypts what is written to it into w. A segment is only opened
+// once more data follows it, or by Close for the last one. It keeps its
+// state across the attempts of a download, which resume where the previous
+// one stopped.
+type opener struct {
+	e      *Encryption
+	w      io.Writer
+	header []byte
+	aead   cipher.AEAD
+	buf    []byte
+	next   int64
+}
+
+func (e *Encryption) open(w io.Writer) *opener {
+	return &opener{e: e, w: w}
+}
+
+var errNotEncrypted = status.Error(codes.FailedPrecondition, "image is not end-to-end encrypted")
+
+func (o *opener) Write(p []byte) (int, error) {
+	n := len(p)
+	if o.aead == nil {
+		k := e2eHeaderLen - len(o.header)
+		if k > len(p) {
+			k = len(p)
+		}
+		o.header = append(o.header, p[:k]...)
+		p = p[k:]
+		m := len(o.header)
+		if m > len(e2eMagic) {
+			m = len(e2eMagic)
+		}
+		if !bytes.Equal(o.header[:m], []byte(e2eMagic[:m])) {
+			return 0, errNotEncrypted
+		}
+		if len(o.header) < e2eHeaderLen {
+			return n, nil
+		}
+		aead, err := o.e.fileCipher(o.header)
+		if err != nil {
+			return 0, err
+		}
+		o.aead = aead
+	}
+	o.buf = append(o.buf, p...)
+	for len(o.buf) > e2eSegment+e2eOverhead {
+		if err := o.openSegment(o.buf[:e2eSegment+e2eOverhead], false); err != nil {
+			return 0, err
+		}
+		o.buf = o.buf[:copy(o.buf, o.buf[e2eSegment+e2eOverhead:])]
+	}
+	return n, nil
+}
+
+func (o *opener) openSegment(sealed []byte, last bool) error {
+	plain, err := o.aead.Open(nil, e2eNonce(o.next, last), sealed, o.header)
+	if err != nil {
+		return status.Error(codes.DataLoss, "cannot decrypt image: the data is damaged or was tampered with")
+	}
+	o.next++
+	_, err = o.w.Write(plain)
+	return err
+}
+
+// Close opens the last segment.
+func (o *opener) Close() error {
+	if o.aead == nil {
+		if len(o.header) < len(e2eMagic) {
+			return errNotEncrypted
+		}
+		return status.Error(codes.DataLoss, "cannot decrypt image: the encryption header is cut off")
+	}
+	return o.openSegment(o.buf, true)
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func keyFile(t *testing.T, content string) *Encryption {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := EncryptWithKeyFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func passphrase(t *testing.T, p string) *Encryption {
+	t.Helper()
+	e, err := EncryptWithPassphrase(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestScryptVectors(t *testing.T) {
+	// RFC 7914, section 12, first 32 bytes; the others need parameters
+	// outside the bounds accepted from headers
+	e := newEncryption([]byte("pleaseletmein"), kdfScrypt, scryptParams)
+	m, err := e.master(kdfScrypt, []byte{14, 8, 1, 0}, []byte("SodiumChloride"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(m), "7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	for _, params := range [][]byte{{4, 1, 1, 0}, {21, 8, 1, 0}, {15, 0, 1, 0}, {15, 9, 1, 0}, {15, 8, 0, 0}, {15, 8, 5, 0}} {
+		_, err := e.master(kdfScrypt, params, []byte("salt"))
+		wantCode(t, err, codes.DataLoss, "scrypt parameters")
+	}
+	_, err = e.master(1, nil, []byte("salt"))
+	wantCode(t, err, codes.FailedPrecondition, "unsupported key derivation")
+}
+
+func TestKeyFileVector(t *testing.T) {
+	e := newEncryption([]byte("0123456789abcdef0123456789abcdef"), kdfKeyFile, []byte{0, 0, 0, 0})
+	m, err := e.master(kdfKeyFile, []byte{0, 0, 0, 0}, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HMAC-SHA256(key file, "tages e2e master key" | salt)
+	if got, want := hex.EncodeToString(m), "fb654e01df6568b8325aca0bc8055ef9578d57703ede58e838cf8f5596532cc2"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	for name, enc := range map[string]*Encryption{
+		"key file":   keyFile(t, strings.Repeat("k", 32)),
+		"passphrase": passphrase(t, "correct horse battery staple"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, fs := newTestClient(t, WithEncryption(enc))
+			for _, n := range []int{0, 1, e2eSegment - 1, e2eSegment, 2*e2eSegment + 5} {
+				data := sample(n)
+				res, err := c.Upload(context.Background(), bytes.NewReader(data), ImageInfo{Name: "a.img"})
+				if err != nil || res.Size != int64(n) {
+					t.Fatalf("%d bytes: got %v, %v", n, res, err)
+				}
+				stored, _ := fs.get("a.img")
+				if int64(len(stored.data)) != sealedSize(int64(n)) || !bytes.HasPrefix(stored.data, []byte(e2eMagic)) {
+					t.Fatalf("%d bytes: the server got %d bytes", n, len(stored.data))
+				}
+				if n > 16 && bytes.Contains(stored.data, data[:16]) {
+					t.Fatalf("%d bytes: the server got the content", n)
+				}
+				var buf bytes.Buffer
+				info, err := c.Download(context.Background(), "a.img", &buf)
+				if err != nil || !bytes.Equal(buf.Bytes(), data) || info.Size != int64(n) {
+					t.Fatalf("%d bytes: got %d bytes, %v, %v", n, buf.Len(), info, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	c, fs := newTestClient(t, WithEncryption(passphrase(t, "right")))
+	if _, err := c.Upload(context.Background(), bytes.NewReader([]byte("secret")), ImageInfo{Name: "a.img"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := fs.get("a.img")
+	fs.put("plain.img", []byte("not encrypted at all, but long enough for a header"), time.Now())
+
+	for _, tc := range []struct {
+		enc  *Encryption
+		name string
+		code codes.Code
+		msg  string
+	}{
+		{passphrase(t, "wrong"), "a.img", codes.PermissionDenied, "wrong passphrase or key file"},
+		{keyFile(t, strings.Repeat("k", 32)), "a.img", codes.FailedPrecondition, "with a passphrase"},
+		{passphrase(t, "right"), "plain.img", codes.FailedPrecondition, "not end-to-end encrypted"},
+	} {
+		_, err := fs.client(WithEncryption(tc.enc)).Download(context.Background(), tc.name, ioutil.Discard)
+		wantCode(t, err, tc.code, tc.msg)
+	}
+	if got, _ := fs.get("a.img"); !bytes.Equal(got.data, stored.data) {
+		t.Fatal("the image was changed")
+	}
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	c, fs := newTestClient(t, WithEncryption(keyFile(t, strings.Repeat("k", 32))))
+	data := sample(2*e2eSegment + 5)
+	if _, err := c.Upload(context.Background(), bytes.NewReader(data), ImageInfo{Name: "a.img"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := fs.get("a.img")
+	for _, tc := range []struct {
+		size int
+		msg  string
+	}{
+		{len(e2eMagic) + 3, "header is cut off"},
+		{e2eHeaderLen, "damaged"},
+		{e2eHeaderLen + 100, "damaged"},
+		// at a segment boundary, which must not pass for the end
+		{e2eHeaderLen + e2eSegment + e2eOverhead, "damaged"},
+		{len(stored.data) - 1, "damaged"},
+	} {
+		fs.put("cut.img", stored.data[:tc.size], stored.mtime)
+		var buf bytes.Buffer
+		_, err := c.Download(context.Background(), "cut.img", &buf)
+		wantCode(t, err, codes.DataLoss, tc.msg)
+	}
+
+	// a flipped bit in the header or the data
+	for _, at := range []int{len(e2eMagic) + 10, e2eHeaderLen + 10} {
+		tampered := append([]byte(nil), stored.data...)
+		tampered[at] ^= 1
+		fs.put("tampered.img", tampered, stored.mtime)
+		_, err := c.Download(context.Background(), "tampered.img", ioutil.Discard)
+		if code := Code(err); code != codes.DataLoss && code != codes.PermissionDenied {
+			t.Fatalf("flipped byte %d: got %v", at, err)
+		}
+	}
+}
+
+func TestEncryptedResumedDownload(t *testing.T) {
+	c, fs := newTestClient(t, WithEncryption(keyFile(t, strings.Repeat("k", 32))))
+	data := sample(3*e2eSegment + 5)
+	if _, err := c.Upload(context.Background(), bytes.NewReader(data), ImageInfo{Name: "a.img"}); err != nil {
+		t.Fatal(err)
+	}
+	// cut within the header, within a segment and right after one
+	cuts := []int{30, e2eSegment, e2eSegment + e2eOverhead - 30 + e2eHeaderLen}
+	fs.cuts = cuts
+	var buf bytes.Buffer
+	info, err := c.Download(context.Background(), "a.img", &buf)
+	if err != nil || !bytes.Equal(buf.Bytes(), data) || info.Size != int64(len(data)) {
+		t.Fatalf("got %d bytes, %v, %v", buf.Len(), info, err)
+	}
+	// the offsets count the encrypted bytes
+	want := []int64{0, 30, 30 + e2eSegment, 30 + e2eSegment + int64(cuts[2])}
+	if len(fs.offsets) != len(want) {
+		t.Fatalf("resumed at %v, want %v", fs.offsets, want)
+	}
+	for i := range want {
+		if fs.offsets[i] != want[i] {
+			t.Fatalf("resumed at %v, want %v", fs.offsets, want)
+		}
+	}
+}
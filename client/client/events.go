@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	pb "tages/client/proto"
+	"time"
+)
+
+// EventType is the kind of change reported by Watch.
+type EventType string
+
+const (
+	ImageCreated EventType = "created"
+	ImageUpdated EventType = "updated"
+	ImageDeleted EventType = "deleted"
+)
+
+// ImageEvent is a change to the stored images.
+type ImageEvent struct {
+	Type EventType
+	// Image only has its Name set for ImageDeleted.
+	Image ImageInfo
+	Time  time.Time
+	// ResumeToken can be passed to Watch to continue after this event.
+	ResumeToken string
+}
+
+var eventTypes = map[pb.ImageEvent_Type]EventType{
+	pb.ImageEvent_CREATED: ImageCreated,
+	pb.ImageEvent_UPDATED: ImageUpdated,
+	pb.ImageEvent_DELETED: ImageDeleted,
+}
+
+// resumeTokenKey is the header giving the position of a watch when it
+// starts.
+const resumeTokenKey = "x-resume-token"
+
+// Watch calls fn for every change to the images whose name starts with
+// prefix, until ctx is cancelled or fn returns an error, which Watch then
+// returns. An empty token starts with the changes made from now on; the
+// ResumeToken of an event continues right after it.
+//
+// When the connection is lost, Watch reconnects with the backoff of the
+// retry policy, for as long as it takes once the first call got through,
+// and replays the changes missed meanwhile. If the server no longer has
+// them, e.g. because it was restarted, Watch fails with codes.OutOfRange:
+// list the images again and start a new watch.
+func (c *Client) Watch(ctx context.Context, prefix, token string, fn func(ImageEvent) error) error {
+	p := c.opts.retry
+	failures, established := 0, false
+	for {
+		progressed, err := c.watch(ctx, prefix, &token, fn)
+		if fe, ok := err.(fnError); ok {
+			return fe.err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if progressed {
+			established, failures = true, 0
+		}
+		failures++
+		// once connected, keep reconnecting: the server may be restarting
+		if !established && failures >= p.MaxAttempts || !p.retryable(Code(err)) {
+			return fmt.Errorf("cannot watch images: %w", err)
+		}
+		select {
+		case <-time.After(p.backoff(failures)):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// fnError wraps errors returned by the callback of Watch, which end it.
+type fnError struct{ err error }
+
+func (e fnError) Error() string { return e.err.Error() }
+
+// watch runs one WatchImages call, updating token as events arrive. It
+// reports whether the call got through to the server, so that Watch resets
+// its retry count.
+func (c *Client) watch(ctx context.Context, prefix string, token *string, fn func(ImageEvent) error) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.svc.WatchImages(ctx, &pb.WatchImagesRequest{Prefix: prefix, ResumeToken: *token})
+	if err != nil {
+		return false, err
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return false, err
+	}
+	if t := header.Get(resumeTokenKey); len(t) > 0 && *token == "" {
+		*token = t[0]
+	}
+	// the header is only sent once the server accepted the token
+	progressed := len(header.Get(resumeTokenKey)) > 0
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return progressed, err
+		}
+		progressed = true
+		ev := ImageEvent{
+			Type:        eventTypes[res.GetType()],
+			Image:       infoFromProto(res.GetInfo()),
+			Time:        time.Unix(0, res.GetTime()),
+			ResumeToken: res.GetResumeToken(),
+		}
+		*token = ev.ResumeToken
+		if err := fn(ev); err != nil {
+			return progressed, fnError{err}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWatchReconnects(t *testing.T) {
+	c, fs := newTestClient(t)
+	fs.watchNames = []string{"a", "b", "c", "d", "e"}
+	enough := errors.New("enough")
+	var got []string
+	err := c.Watch(context.Background(), "", "", func(ev ImageEvent) error {
+		got = append(got, ev.Image.Name)
+		if len(got) == len(fs.watchNames) {
+			return enough
+		}
+		return nil
+	})
+	if err != enough {
+		t.Fatalf("got %v", err)
+	}
+	if !reflect.DeepEqual(got, fs.watchNames) {
+		t.Fatalf("got events %v", got)
+	}
+	// every reconnect resumes after the last event received
+	if want := []string{"", "2", "4"}; !reflect.DeepEqual(fs.watchTokens, want) {
+		t.Fatalf("resumed with %q, want %q", fs.watchTokens, want)
+	}
+}
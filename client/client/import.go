@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	pb "tages/client/proto"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ImportArchive sends a tar, tar.gz or zip archive read from r to the
+// server, which stores its regular files as images named prefix + their
+// path in the archive. It returns one result per entry, with Path set to
+// the entry and Err to its failure; the error is only set if the import as
+// a whole failed. Since r cannot be rewound, the call is not retried.
+func (c *Client) ImportArchive(ctx context.Context, r io.Reader, prefix string) ([]FileResult, error) {
+	if c.opts.encryption != nil {
+		return nil, errors.New("cannot import archive: the server would store the images without end-to-end encryption")
+	}
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, span := tracer.Start(ctx, "ImportArchive", trace.WithAttributes(attribute.String("archive.prefix", prefix)))
+	defer span.End()
+
+	progress := newTracker(c.opts.progress, "import of "+prefix+"*", Uploading, -1)
+	res, err := c.importArchive(ctx, r, prefix, progress)
+	progress.finish(err)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("cannot import archive: %w", err)
+	}
+	results := make([]FileResult, 0, len(res.GetEntries()))
+	for _, e := range res.GetEntries() {
+		fr := FileResult{Name: e.GetName(), Path: e.GetEntry(), Size: e.GetSize()}
+		if e.GetCode() != 0 {
+			fr.Err = status.Error(codes.Code(e.GetCode()), e.GetError())
+			if e.GetEntry() != "" {
+				fr.Err = fmt.Errorf("cannot import %s: %w", e.GetEntry(), fr.Err)
+			}
+		}
+		results = append(results, fr)
+	}
+	return results, nil
+}
+
+func (c *Client) importArchive(ctx context.Context, r io.Reader, prefix string, progress *tracker) (_ *pb.ImportArchiveResponse, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wd := c.newWatchdog(cancel)
+	defer func() { err = wd.stop(err) }()
+
+	stream, err := c.svc.ImportArchive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&pb.ImportArchiveRequest{
+		Data: &pb.ImportArchiveRequest_Options{Options: &pb.ImportArchiveOptions{Prefix: prefix}},
+	})
+	buffer := make([]byte, c.opts.chunkSize)
+	for err == nil {
+		n, rerr := io.ReadFull(r, buffer)
+		if n > 0 {
+			err = stream.Send(&pb.ImportArchiveRequest{
+				Data: &pb.ImportArchiveRequest_Chunkdata{Chunkdata: buffer[:n]},
+			})
+			progress.add(n)
+			wd.add(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return nil, fmt.Errorf("cannot read archive: %w", rerr)
+		}
+	}
+	// the server may answer before the end of the data, e.g. after the
+	// end-of-archive marker of a tar file
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+type options struct {
+	chunkSize   int
+	retry       RetryPolicy
+	concurrency int
+	dialOptions []grpc.DialOption
+	tls         *tls.Config
+	token       string
+	progress    ProgressFunc
+	encryption  *Encryption
+
+	callTimeout  time.Duration
+	stallTimeout time.Duration
+	minRate      int64
+}
+
+func defaultOptions() options {
+	return options{
+		chunkSize:   32 << 10,
+		retry:       DefaultRetryPolicy,
+		concurrency: 4,
+
+		callTimeout:  10 * time.Second,
+		stallTimeout: 30 * time.Second,
+	}
+}
+
+type Option func(*options)
+
+// WithChunkSize sets the size of the chunks sent by Upload. It must stay
+// below the server's maximum message size.
+func WithChunkSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.chunkSize = n
+		}
+	}
+}
+
+// WithRetries sets how many times a failed call is retried, keeping the
+// rest of the retry policy.
+func WithRetries(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.retry.MaxAttempts = n + 1
+		}
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy. Uploads are retried from the
+// start when their reader can be rewound; downloads resume where they were
+// cut off.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *options) {
+		if p.MaxAttempts < 1 {
+			p.MaxAttempts = 1
+		}
+		o.retry = p
+	}
+}
+
+// WithConcurrency bounds the number of transfers running at the same time on
+// one Client.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.concurrency = n
+		}
+	}
+}
+
+// WithTLSConfig makes Dial connect over TLS using cfg.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+// WithToken sends token as a bearer token with every call made through a
+// connection opened by Dial.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// WithDialOptions adds gRPC dial options used by Dial, e.g. transport
+// credentials.
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(o *options) {
+		o.dialOptions = append(o.dialOptions, opts...)
+	}
+}
+
+// WithProgress makes every upload and download report its progress to fn.
+// Reports are sent at most every 100ms per transfer, plus a final one when
+// the transfer ends.
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithEncryption encrypts images on the client before they are uploaded and
+// decrypts them after download, so the server only stores ciphertext and
+// the encryption header. Downloading an image that is not encrypted fails
+// with codes.FailedPrecondition, and one encrypted with another secret with
+// codes.PermissionDenied. Upload and Download report the size of the
+// content; List and Stat report the size and digest of the stored data.
+// DownloadArchive and share links opened through the REST gateway carry the
+// encrypted data, and ImportArchive fails, since the server would store the
+// images in plain.
+func WithEncryption(e *Encryption) Option {
+	return func(o *options) {
+		o.encryption = e
+	}
+}
+
+// WithCallTimeout bounds calls other than transfers, such as List, when the
+// context has no deadline of its own. 0 disables it. Default 10s.
+func WithCallTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d >= 0 {
+			o.callTimeout = d
+		}
+	}
+}
+
+// WithStallTimeout cancels a transfer attempt with codes.DeadlineExceeded
+// when no data moved for d, however large the image. 0 disables it.
+// Default 30s.
+func WithStallTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d >= 0 {
+			o.stallTimeout = d
+		}
+	}
+}
+
+// WithMinThroughput gives every transfer attempt of known size a deadline
+// of stall timeout + size / bytesPerSec. 0, the default, disables it.
+func WithMinThroughput(bytesPerSec int64) Option {
+	return func(o *options) {
+		if bytesPerSec >= 0 {
+			o.minRate = bytesPerSec
+		}
+	}
+}
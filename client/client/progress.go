@@ -0,0 +1,147 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// Direction tells uploads and downloads apart in progress reports.
+type Direction int
+
+const (
+	Uploading Direction = iota
+	Downloading
+)
+
+func (d Direction) String() string {
+	if d == Downloading {
+		return "download"
+	}
+	return "upload"
+}
+
+// Progress is a snapshot of one running transfer.
+type Progress struct {
+	Name      string
+	Direction Direction
+	// Bytes transferred so far. It goes back to zero when an upload is
+	// retried from the start.
+	Bytes int64
+	// Total is the size of the image, or -1 if it is not known.
+	Total int64
+	// Rate is the average throughput in bytes per second.
+	Rate float64
+	// ETA is the estimated time left, or 0 if it cannot be estimated.
+	ETA time.Duration
+	// Done is set on the last report of a transfer, with Err telling
+	// whether it succeeded.
+	Done bool
+	Err  error
+}
+
+// ProgressFunc receives progress reports. It is called from the goroutine
+// running the transfer, so it must be quick and safe for concurrent use when
+// several transfers run at once.
+type ProgressFunc func(Progress)
+
+// ProgressChannel returns a ProgressFunc sending reports to ch. Intermediate
+// reports are dropped while ch is full; the final one of each transfer is
+// always delivered.
+func ProgressChannel(ch chan<- Progress) ProgressFunc {
+	return func(p Progress) {
+		if p.Done {
+			ch <- p
+			return
+		}
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// progressInterval limits how often a transfer reports progress.
+const progressInterval = 100 * time.Millisecond
+
+// tracker turns byte counts into throttled progress reports.
+type tracker struct {
+	fn    ProgressFunc
+	mu    sync.Mutex
+	p     Progress
+	start time.Time
+	last  time.Time
+}
+
+// newTracker returns nil if fn is nil; all tracker methods accept a nil
+// receiver.
+func newTracker(fn ProgressFunc, name string, dir Direction, total int64) *tracker {
+	if fn == nil {
+		return nil
+	}
+	return &tracker{
+		fn:    fn,
+		p:     Progress{Name: name, Direction: dir, Total: total},
+		start: time.Now(),
+	}
+}
+
+func (t *tracker) setTotal(total int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.p.Total = total
+	t.mu.Unlock()
+}
+
+// reset starts counting again, e.g. when a transfer is retried.
+func (t *tracker) reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.p.Bytes = 0
+	t.start = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *tracker) add(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.p.Bytes += int64(n)
+	now := time.Now()
+	if now.Sub(t.last) < progressInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.last = now
+	p := t.snapshot(now)
+	t.mu.Unlock()
+	t.fn(p)
+}
+
+func (t *tracker) finish(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	p := t.snapshot(time.Now())
+	t.mu.Unlock()
+	p.Done = true
+	p.Err = err
+	p.ETA = 0
+	t.fn(p)
+}
+
+func (t *tracker) snapshot(now time.Time) Progress {
+	p := t.p
+	if elapsed := now.Sub(t.start).Seconds(); elapsed > 0 {
+		p.Rate = float64(p.Bytes) / elapsed
+	}
+	if p.Rate > 0 && p.Total > p.Bytes {
+		p.ETA = time.Duration(float64(p.Total-p.Bytes) / p.Rate * float64(time.Second))
+	}
+	return p
+}
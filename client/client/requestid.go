@@ -0,0 +1,37 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDKey is the metadata key the server uses to correlate its logs
+// with a client call.
+const RequestIDKey = "x-request-id"
+
+// WithRequestID returns a context whose calls carry id as request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, RequestIDKey, id)
+}
+
+// ensureRequestID adds a fresh request ID to ctx unless one is already set.
+func ensureRequestID(ctx context.Context) context.Context {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(RequestIDKey)) > 0 {
+		return ctx
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return WithRequestID(ctx, hex.EncodeToString(b))
+}
+
+func requestIDUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(ensureRequestID(ctx), method, req, reply, cc, opts...)
+}
+
+func requestIDStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(ensureRequestID(ctx), desc, cc, method, opts...)
+}
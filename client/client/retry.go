@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+)
+
+// RetryPolicy decides how failed calls are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// 1 disables retries.
+	MaxAttempts int
+	// The delay before retry n is InitialBackoff * Multiplier^(n-1), capped
+	// at MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomises each delay by up to this fraction in either
+	// direction, so that clients cut off together do not retry together.
+	Jitter float64
+	// RetryableCodes lists the status codes worth retrying.
+	RetryableCodes []codes.Code
+}
+
+// DefaultRetryPolicy is used unless WithRetryPolicy or WithRetries is given.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	RetryableCodes: []codes.Code{codes.Unavailable},
+}
+
+func (p RetryPolicy) retryable(code codes.Code) bool {
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(retry-1))
+	if max := float64(p.MaxBackoff); p.MaxBackoff > 0 && d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// retry runs call until it succeeds, fails with a code the policy does not
+// retry, reports that it cannot be repeated, or the attempts are used up.
+func (c *Client) retry(ctx context.Context, call func() (retryable bool, err error)) error {
+	p := c.opts.retry
+	for attempt := 1; ; attempt++ {
+		retryable, err := call()
+		if err == nil || !retryable || attempt >= p.MaxAttempts || !p.retryable(Code(err)) {
+			return err
+		}
+		select {
+		case <-time.After(p.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// retryUnary is retry for unary calls, which are left to the gRPC retry
+// support when the connection was set up by Dial.
+func (c *Client) retryUnary(ctx context.Context, call func() error) error {
+	if c.conn != nil {
+		return call()
+	}
+	return c.retry(ctx, func() (bool, error) { return true, call() })
+}
+
+// idempotentMethods are retried by gRPC itself through the service config.
+// DeleteImage is left out: a retry after a lost response would report
+// NotFound.
+var idempotentMethods = []string{"ListImages", "StatImage"}
+
+// serviceConfig returns the gRPC service config enabling retries of
+// idempotent unary calls according to p. gRPC caps the attempts at 5.
+func serviceConfig(p RetryPolicy) string {
+	// a retry policy needs at least two attempts and one code
+	if p.MaxAttempts < 2 || len(p.RetryableCodes) == 0 {
+		return `{}`
+	}
+	type name struct {
+		Service string `json:"service"`
+		Method  string `json:"method"`
+	}
+	var names []name
+	for _, m := range idempotentMethods {
+		names = append(names, name{Service: "proto.ImageUploadService", Method: m})
+	}
+	var codeNames []string
+	for _, c := range p.RetryableCodes {
+		codeNames = append(codeNames, codeName(c))
+	}
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 1
+	}
+	cfg := map[string]interface{}{
+		"methodConfig": []interface{}{map[string]interface{}{
+			"name": names,
+			"retryPolicy": map[string]interface{}{
+				"maxAttempts":          p.MaxAttempts,
+				"initialBackoff":       seconds(p.InitialBackoff),
+				"maxBackoff":           seconds(p.MaxBackoff),
+				"backoffMultiplier":    multiplier,
+				"retryableStatusCodes": codeNames,
+			},
+		}},
+	}
+	b, _ := json.Marshal(cfg)
+	return string(b)
+}
+
+func seconds(d time.Duration) string {
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	return fmt.Sprintf("%.3fs", d.Seconds())
+}
+
+// codeName converts a code to the form used in service configs, e.g.
+// DeadlineExceeded to DEADLINE_EXCEEDED.
+func codeName(c codes.Code) string {
+	var out []rune
+	prev := rune(0)
+	for _, r := range c.String() {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			out = append(out, '_')
+		}
+		out = append(out, unicode.ToUpper(r))
+		prev = r
+	}
+	return string(out)
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	for retry, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 10: time.Second} {
+		if got := p.backoff(retry); got != want {
+			t.Errorf("retry %d: got %s, want %s", retry, got, want)
+		}
+	}
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(2); got < 160*time.Millisecond || got > 240*time.Millisecond {
+			t.Fatalf("got %s, want 200ms ± 20%%", got)
+		}
+	}
+}
+
+func TestServiceConfig(t *testing.T) {
+	cfg := serviceConfig(DefaultRetryPolicy)
+	for _, want := range []string{`"method":"ListImages"`, `"method":"StatImage"`, `"maxAttempts":3`, `"retryableStatusCodes":["UNAVAILABLE"]`} {
+		if !strings.Contains(cfg, want) {
+			t.Errorf("%s lacks %s", cfg, want)
+		}
+	}
+	if strings.Contains(cfg, "DeleteImage") {
+		t.Errorf("%s retries DeleteImage", cfg)
+	}
+	if cfg := serviceConfig(RetryPolicy{MaxAttempts: 1}); cfg != `{}` {
+		t.Errorf("got %s without retries", cfg)
+	}
+	if got := codeName(codes.DeadlineExceeded); got != "DEADLINE_EXCEEDED" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	c, fs := newTestClient(t)
+	data := sample(10000)
+	fs.put("a.img", data, time.Now())
+	fs.cuts = []int{2500, 0, 3000}
+	var buf bytes.Buffer
+	info, err := c.Download(context.Background(), "a.img", &buf)
+	if err != nil || !bytes.Equal(buf.Bytes(), data) || info.Size != int64(len(data)) {
+		t.Fatalf("got %d bytes, %v, %v", buf.Len(), info, err)
+	}
+	want := []int64{0, 2500, 2500, 5500}
+	if len(fs.offsets) != len(want) {
+		t.Fatalf("resumed at %v, want %v", fs.offsets, want)
+	}
+	for i := range want {
+		if fs.offsets[i] != want[i] {
+			t.Fatalf("resumed at %v, want %v", fs.offsets, want)
+		}
+	}
+}
+
+func TestDownloadResumesWithOlderServer(t *testing.T) {
+	c, fs := newTestClient(t)
+	data := sample(5000)
+	fs.put("a.img", data, time.Now())
+	fs.noResume = true
+	fs.cuts = []int{1500}
+	var buf bytes.Buffer
+	if _, err := c.Download(context.Background(), "a.img", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("got %d bytes, %v", buf.Len(), err)
+	}
+}
+
+func TestDownloadGivesUp(t *testing.T) {
+	c, fs := newTestClient(t)
+	fs.put("a.img", sample(5000), time.Now())
+	fs.cuts = []int{100, 100, 100, 100, 100}
+	_, err := c.Download(context.Background(), "a.img", ioutil.Discard)
+	wantCode(t, err, codes.Unavailable, "connection lost")
+	if len(fs.offsets) != testRetryPolicy.MaxAttempts {
+		t.Fatalf("made %d attempts", len(fs.offsets))
+	}
+
+	// other codes are not retried
+	fs.offsets = nil
+	_, err = c.Download(context.Background(), "missing.img", ioutil.Discard)
+	wantCode(t, err, codes.NotFound, "not found")
+	if len(fs.offsets) != 1 {
+		t.Fatalf("made %d attempts", len(fs.offsets))
+	}
+}
+
+func TestDownloadFailsWhenImageChanges(t *testing.T) {
+	c, fs := newTestClient(t)
+	fs.put("a.img", sample(5000), time.Now())
+	fs.cuts = []int{1000}
+	fs.onCut = func() { fs.put("a.img", sample(6000), time.Now().Add(time.Hour)) }
+	_, err := c.Download(context.Background(), "a.img", ioutil.Discard)
+	wantCode(t, err, codes.FailedPrecondition, "changed while downloading")
+}
+
+func TestUploadRetries(t *testing.T) {
+	c, fs := newTestClient(t)
+	data := sample(5000)
+	fs.uploadFailures = 2
+	res, err := c.Upload(context.Background(), bytes.NewReader(data), ImageInfo{Name: "a.img"})
+	if err != nil || res.Size != int64(len(data)) {
+		t.Fatalf("got %v, %v", res, err)
+	}
+	if got, _ := fs.get("a.img"); !bytes.Equal(got.data, data) || fs.uploads != 3 {
+		t.Fatalf("stored %d bytes after %d attempts", len(got.data), fs.uploads)
+	}
+
+	// a reader that cannot be rewound is sent once
+	fs.uploadFailures, fs.uploads = 1, 0
+	_, err = c.Upload(context.Background(), struct{ io.Reader }{bytes.NewReader(data)}, ImageInfo{Name: "b.img"})
+	wantCode(t, err, codes.Unavailable, "connection lost")
+	if fs.uploads != 1 {
+		t.Fatalf("made %d attempts", fs.uploads)
+	}
+}
+
+func TestDeleteRetries(t *testing.T) {
+	c, fs := newTestClient(t)
+	fs.put("a.img", sample(10), time.Now())
+	fs.deleteErrs = []codes.Code{codes.Unavailable}
+	if err := c.Delete(context.Background(), "a.img"); err != nil {
+		t.Fatalf("lost answer: %v", err)
+	}
+
+	// NotFound is only taken for success after an answer that may be lost
+	policy := testRetryPolicy
+	policy.RetryableCodes = []codes.Code{codes.Unavailable, codes.Aborted}
+	c = fs.client(WithRetryPolicy(policy))
+	fs.deleteErrs = []codes.Code{codes.Aborted}
+	wantCode(t, c.Delete(context.Background(), "b.img"), codes.NotFound, "not found")
+}
@@ -0,0 +1,285 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "tages/client/proto"
+)
+
+// fakeServer keeps images in memory and can cut transfers short, to test
+// the client without a real server.
+type fakeServer struct {
+	pb.UnimplementedImageUploadServiceServer
+
+	mu     sync.Mutex
+	images map[string]fakeImage
+	// cuts ends the next downloads with Unavailable after that many bytes,
+	// one entry per download
+	cuts []int
+	// onCut is called when a download was cut
+	onCut func()
+	// uploadFailures fails that many uploads with Unavailable once all
+	// their data was received
+	uploadFailures int
+	// noResume makes downloads ignore the resume offset, like older servers
+	noResume bool
+	// deleteErrs fails the next deletes with these codes, one per call;
+	// Unavailable comes after the image was deleted, like a lost answer
+	deleteErrs []codes.Code
+	// watchNames are the images reported as created by WatchImages; the
+	// resume token of an event is its index plus one
+	watchNames []string
+	// watchTokens are the resume tokens asked for by the watches
+	watchTokens []string
+	// offsets are the resume offsets asked for by the downloads
+	offsets []int64
+	uploads int
+
+	conn *grpc.ClientConn
+}
+
+type fakeImage struct {
+	data  []byte
+	mtime time.Time
+}
+
+func (img fakeImage) info(name string) *pb.ImageInfo {
+	sum := sha256.Sum256(img.data)
+	return &pb.ImageInfo{
+		Name:     name,
+		Modified: img.mtime.String(),
+		Size:     int64(len(img.data)),
+		Mtime:    img.mtime.UnixNano(),
+		Sha256:   hex.EncodeToString(sum[:]),
+	}
+}
+
+func (s *fakeServer) put(name string, data []byte, mtime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[name] = fakeImage{data: data, mtime: mtime}
+}
+
+func (s *fakeServer) get(name string) (fakeImage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[name]
+	return img, ok
+}
+
+func (s *fakeServer) UploadImage(stream pb.ImageUploadService_UploadImageServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	info := req.GetInfo()
+	var data []byte
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data = append(data, req.GetChunkdata()...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads++
+	if s.uploadFailures > 0 {
+		s.uploadFailures--
+		return status.Error(codes.Unavailable, "connection lost")
+	}
+	mtime := time.Now()
+	if info.GetMtime() > 0 {
+		mtime = time.Unix(0, info.GetMtime())
+	}
+	s.images[info.GetName()] = fakeImage{data: data, mtime: mtime}
+	return stream.SendAndClose(&pb.UploadImageResponse{Name: info.GetName(), Size: uint32(len(data))})
+}
+
+func (s *fakeServer) DownloadImage(name *wrappers.StringValue, stream pb.ImageUploadService_DownloadImageServer) error {
+	s.mu.Lock()
+	img, ok := s.images[name.GetValue()]
+	cut := -1
+	if len(s.cuts) > 0 {
+		cut, s.cuts = s.cuts[0], s.cuts[1:]
+	}
+	var offset int64
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if v := md.Get(resumeOffsetKey); len(v) > 0 {
+		offset, _ = strconv.ParseInt(v[0], 10, 64)
+		s.offsets = append(s.offsets, offset)
+	} else {
+		s.offsets = append(s.offsets, 0)
+	}
+	noResume, onCut := s.noResume, s.onCut
+	s.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "image %q not found", name.GetValue())
+	}
+	if noResume {
+		offset = 0
+	} else if offset > 0 {
+		stream.SetHeader(metadata.Pairs(resumeOffsetKey, strconv.FormatInt(offset, 10)))
+	}
+	if err := stream.Send(&pb.DownloadImageResponse{Data: &pb.DownloadImageResponse_Info{Info: img.info(name.GetValue())}}); err != nil {
+		return err
+	}
+	data := img.data[offset:]
+	sent := 0
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		if cut >= 0 && sent+n > cut {
+			n = cut - sent
+		}
+		if n > 0 {
+			if err := stream.Send(&pb.DownloadImageResponse{Data: &pb.DownloadImageResponse_Chunkdata{Chunkdata: data[:n]}}); err != nil {
+				return err
+			}
+		}
+		sent += n
+		data = data[n:]
+		if sent == cut {
+			if onCut != nil {
+				onCut()
+			}
+			return status.Error(codes.Unavailable, "connection lost")
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) ListImages(_ context.Context, prefix *wrappers.StringValue) (*pb.ImageList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &pb.ImageList{}
+	for name, img := range s.images {
+		if strings.HasPrefix(name, prefix.GetValue()) {
+			res.Images = append(res.Images, img.info(name))
+		}
+	}
+	sort.Slice(res.Images, func(i, j int) bool { return res.Images[i].Name < res.Images[j].Name })
+	return res, nil
+}
+
+func (s *fakeServer) StatImage(_ context.Context, name *wrappers.StringValue) (*pb.ImageInfo, error) {
+	img, ok := s.get(name.GetValue())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "image %q not found", name.GetValue())
+	}
+	return img.info(name.GetValue()), nil
+}
+
+func (s *fakeServer) DeleteImage(_ context.Context, name *wrappers.StringValue) (*empty.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.deleteErrs) > 0 {
+		code := s.deleteErrs[0]
+		s.deleteErrs = s.deleteErrs[1:]
+		if code == codes.Unavailable {
+			delete(s.images, name.GetValue())
+		}
+		return nil, status.Error(code, "delete failed")
+	}
+	if _, ok := s.images[name.GetValue()]; !ok {
+		return nil, status.Errorf(codes.NotFound, "image %q not found", name.GetValue())
+	}
+	delete(s.images, name.GetValue())
+	return &empty.Empty{}, nil
+}
+
+// WatchImages sends at most two events per call, then cuts the watch.
+func (s *fakeServer) WatchImages(req *pb.WatchImagesRequest, stream pb.ImageUploadService_WatchImagesServer) error {
+	s.mu.Lock()
+	s.watchTokens = append(s.watchTokens, req.GetResumeToken())
+	names := s.watchNames
+	s.mu.Unlock()
+	start, _ := strconv.Atoi(req.GetResumeToken())
+	if err := stream.SendHeader(metadata.Pairs(resumeTokenKey, strconv.Itoa(start))); err != nil {
+		return err
+	}
+	for i := start; i < len(names) && i < start+2; i++ {
+		ev := &pb.ImageEvent{Type: pb.ImageEvent_CREATED, Info: &pb.ImageInfo{Name: names[i]}, ResumeToken: strconv.Itoa(i + 1)}
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+	return status.Error(codes.Unavailable, "connection lost")
+}
+
+// testRetryPolicy retries quickly so that tests do not wait.
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     time.Millisecond,
+	Multiplier:     1,
+	RetryableCodes: []codes.Code{codes.Unavailable},
+}
+
+// newTestClient returns a Client of a new fakeServer over an in-memory
+// connection.
+func newTestClient(t *testing.T, opts ...Option) (*Client, *fakeServer) {
+	t.Helper()
+	fs := &fakeServer{images: make(map[string]fakeImage)}
+	s := grpc.NewServer()
+	pb.RegisterImageUploadServiceServer(s, fs)
+	lis := bufconn.Listen(1 << 20)
+	go s.Serve(lis)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+	})
+	fs.conn = conn
+	return fs.client(opts...), fs
+}
+
+// client returns another Client of the server.
+func (s *fakeServer) client(opts ...Option) *Client {
+	return New(s.conn, append([]Option{WithRetryPolicy(testRetryPolicy), WithChunkSize(1000)}, opts...)...)
+}
+
+func wantCode(t *testing.T, err error, code codes.Code, msg string) {
+	t.Helper()
+	if Code(err) != code || err == nil || !strings.Contains(err.Error(), msg) {
+		t.Fatalf("got %v, want %s with %q", err, code, msg)
+	}
+}
+
+// sample returns n bytes of test data.
+func sample(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/251)
+	}
+	return b
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	pb "tages/client/proto"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/metadata"
+)
+
+// ShareOptions set the limits of a share link. Zero values take the server
+// defaults: a TTL of server.share.default_ttl and unlimited downloads.
+type ShareOptions struct {
+	TTL          time.Duration
+	MaxDownloads int
+}
+
+// ShareLink gives access to one image without an auth token until it
+// expires, is used up or is revoked.
+type ShareLink struct {
+	ID    string
+	Token string
+	// URL downloads the image from the REST gateway; empty if the server
+	// has no share.base_url.
+	URL          string
+	Name         string
+	Expires      time.Time
+	MaxDownloads int
+}
+
+// shareTokenKey carries a share token on DownloadImage calls.
+const shareTokenKey = "x-share-token"
+
+// CreateShareLink creates a link to the image called name.
+func (c *Client) CreateShareLink(ctx context.Context, name string, opts ShareOptions) (*ShareLink, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	res, err := c.svc.CreateShareLink(ctx, &pb.CreateShareLinkRequest{
+		Name:         name,
+		TtlSeconds:   int64(opts.TTL / time.Second),
+		MaxDownloads: int32(opts.MaxDownloads),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot share %s: %w", name, err)
+	}
+	return &ShareLink{
+		ID:           res.GetId(),
+		Token:        res.GetToken(),
+		URL:          res.GetUrl(),
+		Name:         res.GetName(),
+		Expires:      time.Unix(0, res.GetExpires()),
+		MaxDownloads: int(res.GetMaxDownloads()),
+	}, nil
+}
+
+// RevokeShareLink makes the share link with the given id unusable.
+func (c *Client) RevokeShareLink(ctx context.Context, id string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	if _, err := c.svc.RevokeShareLink(ctx, &wrappers.StringValue{Value: id}); err != nil {
+		return fmt.Errorf("cannot revoke share link %s: %w", id, err)
+	}
+	return nil
+}
+
+// DownloadShared downloads the image of a share link into w, with no auth
+// token needed. Every attempt, including retries, counts as a download of
+// the link.
+func (c *Client) DownloadShared(ctx context.Context, token string, w io.Writer) (*ImageInfo, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, shareTokenKey, token)
+	return c.Download(ctx, SharedName(token), w)
+}
+
+// DownloadSharedFile downloads the image of a share link to path, like
+// DownloadFile.
+func (c *Client) DownloadSharedFile(ctx context.Context, token, path string) (*ImageInfo, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, shareTokenKey, token)
+	return c.DownloadFile(ctx, SharedName(token), path)
+}
+
+// SharedName returns the name of the image a share token points to, or ""
+// if token is malformed. Only the server can tell whether it is valid.
+func SharedName(token string) string {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return ""
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token[:i])
+	parts := strings.SplitN(string(raw), "\n", 3)
+	if err != nil || len(parts) != 3 {
+		return ""
+	}
+	return parts[2]
+}
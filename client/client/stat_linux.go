@@ -0,0 +1,15 @@
+package client
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileTimes returns the change and modification times of fi.
+func fileTimes(fi os.FileInfo) (created, modified time.Time) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec)), fi.ModTime()
+	}
+	return fi.ModTime(), fi.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package client
+
+import (
+	"os"
+	"time"
+)
+
+// fileTimes returns the modification time of fi for both values; only Linux
+// exposes the change time portably.
+func fileTimes(fi os.FileInfo) (created, modified time.Time) {
+	return fi.ModTime(), fi.ModTime()
+}
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SyncKind is what Sync does with one file.
+type SyncKind string
+
+const (
+	SyncUpload       SyncKind = "upload"
+	SyncDownload     SyncKind = "download"
+	SyncDeleteRemote SyncKind = "delete-remote"
+	SyncDeleteLocal  SyncKind = "delete-local"
+)
+
+// SyncAction is one step of a synchronisation.
+type SyncAction struct {
+	Kind SyncKind
+	// Name is the image name on the server, Path the local file.
+	Name string
+	Path string
+	Size int64
+	// Reason says why the action is needed, e.g. "new" or "local is newer".
+	Reason string
+	Err    error
+}
+
+// SyncOptions tune Sync. By default files missing on one side are copied
+// to it, so nothing is ever deleted.
+type SyncOptions struct {
+	Filter Filter
+	// DeleteRemote deletes images missing locally instead of downloading
+	// them, making the server mirror the directory.
+	DeleteRemote bool
+	// DeleteLocal deletes local files missing on the server instead of
+	// uploading them, making the directory mirror the server.
+	DeleteLocal bool
+	// DryRun only returns the planned actions.
+	DryRun bool
+}
+
+// mtimeSlack absorbs file systems storing modification times coarsely.
+const mtimeSlack = time.Second
+
+type localFile struct {
+	path string
+	size int64
+	mod  time.Time
+}
+
+// Sync brings the directory dir and the images named prefix + "/" + relative
+// path (or just the relative path if prefix is empty) in line.
+//
+// Files present on both sides are equal when their sizes match and either
+// their modification times or their SHA-256 digests do; otherwise the newer
+// side wins. Hidden local files are ignored, as by UploadDir. The actions
+// are run concurrently and returned with their outcome, sorted by name.
+func (c *Client) Sync(ctx context.Context, dir, prefix string, opts SyncOptions) ([]SyncAction, error) {
+	if opts.DeleteLocal && opts.DeleteRemote {
+		return nil, fmt.Errorf("DeleteLocal and DeleteRemote cannot be combined")
+	}
+	if err := opts.Filter.Validate(); err != nil {
+		return nil, err
+	}
+	if prefix == "." {
+		prefix = ""
+	}
+	listPrefix := prefix
+	if prefix != "" {
+		listPrefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+
+	local, err := scanDir(dir, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	images, err := c.ListPrefix(ctx, listPrefix)
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]ImageInfo)
+	for _, img := range images {
+		rel := strings.TrimPrefix(img.Name, listPrefix)
+		if c.opts.encryption != nil {
+			// the server only knows the encrypted data
+			img.Size, img.SHA256 = openedSize(img.Size), ""
+		}
+		if opts.Filter.Match(rel) {
+			remote[rel] = img
+		}
+	}
+
+	var actions []SyncAction
+	for rel, lf := range local {
+		name := path.Join(prefix, rel)
+		img, ok := remote[rel]
+		switch {
+		case !ok && opts.DeleteLocal:
+			actions = append(actions, SyncAction{Kind: SyncDeleteLocal, Name: name, Path: lf.path, Size: lf.size, Reason: "missing on server"})
+		case !ok:
+			actions = append(actions, SyncAction{Kind: SyncUpload, Name: name, Path: lf.path, Size: lf.size, Reason: "new"})
+		default:
+			if a, differ := compare(name, lf, img); differ {
+				actions = append(actions, a)
+			}
+		}
+	}
+	for rel, img := range remote {
+		if _, ok := local[rel]; ok {
+			continue
+		}
+		a := SyncAction{Kind: SyncDownload, Name: img.Name, Size: img.Size, Reason: "new"}
+		if opts.DeleteRemote {
+			a.Kind, a.Reason = SyncDeleteRemote, "missing locally"
+		}
+		if a.Path, err = localPath(dir, rel); err != nil {
+			a.Err = err
+		}
+		actions = append(actions, a)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Name < actions[j].Name })
+
+	if opts.DryRun {
+		return actions, nil
+	}
+	c.Each(len(actions), func(i int) {
+		a := &actions[i]
+		if a.Err == nil {
+			a.Err = c.apply(ctx, a)
+		}
+	})
+	return actions, nil
+}
+
+// compare decides whether the local file and the image differ and, if so,
+// which way to copy.
+func compare(name string, lf localFile, img ImageInfo) (SyncAction, bool) {
+	a := SyncAction{Name: name, Path: lf.path}
+	if lf.size == img.Size {
+		diff := lf.mod.Sub(img.ModTime)
+		if !img.ModTime.IsZero() && diff < mtimeSlack && diff > -mtimeSlack {
+			return a, false
+		}
+		if img.SHA256 != "" {
+			if sum, err := fileDigest(lf.path); err == nil && sum == img.SHA256 {
+				return a, false
+			}
+		}
+	}
+	if img.ModTime.After(lf.mod) {
+		a.Kind, a.Size, a.Reason = SyncDownload, img.Size, "server is newer"
+	} else {
+		a.Kind, a.Size, a.Reason = SyncUpload, lf.size, "local is newer"
+	}
+	return a, true
+}
+
+func (c *Client) apply(ctx context.Context, a *SyncAction) error {
+	switch a.Kind {
+	case SyncUpload:
+		_, err := c.UploadFileAs(ctx, a.Path, a.Name)
+		return err
+	case SyncDownload:
+		if err := os.MkdirAll(filepath.Dir(a.Path), 0755); err != nil {
+			return fmt.Errorf("cannot create directory: %w", err)
+		}
+		_, err := c.DownloadFile(ctx, a.Name, a.Path)
+		return err
+	case SyncDeleteRemote:
+		return c.Delete(ctx, a.Name)
+	case SyncDeleteLocal:
+		return os.Remove(a.Path)
+	}
+	return fmt.Errorf("unknown sync action %q", a.Kind)
+}
+
+// scanDir returns the regular files below dir selected by filter, keyed by
+// slash-separated relative path. A missing dir is treated as empty.
+func scanDir(dir string, filter Filter) (map[string]localFile, error) {
+	files := make(map[string]localFile)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if filter.Match(rel) {
+			files[rel] = localFile{path: p, size: info.Size(), mod: info.ModTime()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory: %w", err)
+	}
+	return files, nil
+}
+
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeLocal(t *testing.T, dir, rel, data string, mtime time.Time) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readLocal(t *testing.T, dir, rel string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// plan returns the actions as "kind name (reason)" lines.
+func plan(actions []SyncAction) string {
+	var lines []string
+	for _, a := range actions {
+		lines = append(lines, string(a.Kind)+" "+a.Name+" ("+a.Reason+")")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// syncFixture fills dir and the server with files in every state.
+func syncFixture(t *testing.T, fs *fakeServer, dir string) {
+	old, now := time.Now().Add(-time.Hour).Truncate(time.Second), time.Now().Truncate(time.Second)
+	writeLocal(t, dir, "same.png", "same", old)
+	fs.put("photos/same.png", []byte("same"), old)
+	// equal content, only the times differ
+	writeLocal(t, dir, "touched.png", "touched", now)
+	fs.put("photos/touched.png", []byte("touched"), old)
+	writeLocal(t, dir, "local.png", "local", now)
+	writeLocal(t, dir, "sub/changed.png", "changed locally", now)
+	fs.put("photos/sub/changed.png", []byte("before"), old)
+	writeLocal(t, dir, "newer.png", "before", old)
+	fs.put("photos/newer.png", []byte("changed on the server"), now)
+	fs.put("photos/remote.png", []byte("remote"), now)
+	writeLocal(t, dir, ".hidden", "ignored", now)
+	fs.put("other/outside.png", []byte("outside the prefix"), now)
+}
+
+func TestSync(t *testing.T) {
+	c, fs := newTestClient(t)
+	dir := t.TempDir()
+	syncFixture(t, fs, dir)
+
+	want := `upload photos/local.png (new)
+download photos/newer.png (server is newer)
+download photos/remote.png (new)
+upload photos/sub/changed.png (local is newer)`
+	actions, err := c.Sync(context.Background(), dir, "photos", SyncOptions{DryRun: true})
+	if err != nil || plan(actions) != want {
+		t.Fatalf("dry run planned\n%s\n%v, want\n%s", plan(actions), err, want)
+	}
+	if _, ok := fs.get("photos/local.png"); ok {
+		t.Fatal("the dry run uploaded")
+	}
+
+	actions, err = c.Sync(context.Background(), dir, "photos", SyncOptions{})
+	if err != nil || plan(actions) != want {
+		t.Fatalf("planned\n%s\n%v, want\n%s", plan(actions), err, want)
+	}
+	for _, a := range actions {
+		if a.Err != nil {
+			t.Fatalf("%s %s: %v", a.Kind, a.Name, a.Err)
+		}
+	}
+	if img, _ := fs.get("photos/sub/changed.png"); string(img.data) != "changed locally" {
+		t.Fatalf("server has %q", img.data)
+	}
+	if got := readLocal(t, dir, "newer.png"); got != "changed on the server" {
+		t.Fatalf("local file has %q", got)
+	}
+	if got := readLocal(t, dir, "remote.png"); got != "remote" {
+		t.Fatalf("local file has %q", got)
+	}
+
+	// nothing left to do
+	if actions, err = c.Sync(context.Background(), dir, "photos", SyncOptions{}); err != nil || len(actions) > 0 {
+		t.Fatalf("second run planned\n%s\n%v", plan(actions), err)
+	}
+}
+
+func TestSyncDeletes(t *testing.T) {
+	c, fs := newTestClient(t)
+	dir := t.TempDir()
+	syncFixture(t, fs, dir)
+	actions, err := c.Sync(context.Background(), dir, "photos", SyncOptions{DeleteRemote: true, Filter: Filter{Exclude: []string{"sub/*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `upload photos/local.png (new)
+download photos/newer.png (server is newer)
+delete-remote photos/remote.png (missing locally)`
+	if plan(actions) != want {
+		t.Fatalf("planned\n%s\nwant\n%s", plan(actions), want)
+	}
+	if _, ok := fs.get("photos/remote.png"); ok {
+		t.Fatal("remote.png was not deleted")
+	}
+	if _, ok := fs.get("other/outside.png"); !ok {
+		t.Fatal("an image outside the prefix was deleted")
+	}
+
+	dir = t.TempDir()
+	writeLocal(t, dir, "extra.png", "extra", time.Now())
+	writeLocal(t, dir, "same.png", "same", time.Now().Add(-time.Hour))
+	actions, err = c.Sync(context.Background(), dir, "photos", SyncOptions{DeleteLocal: true, Filter: Filter{Include: []string{"*.png"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "extra.png")); !os.IsNotExist(err) {
+		t.Fatalf("extra.png was not deleted: %v", err)
+	}
+	if !strings.Contains(plan(actions), "delete-local photos/extra.png (missing on server)") {
+		t.Fatalf("planned\n%s", plan(actions))
+	}
+
+	_, err = c.Sync(context.Background(), dir, "photos", SyncOptions{DeleteLocal: true, DeleteRemote: true})
+	if err == nil {
+		t.Fatal("DeleteLocal and DeleteRemote were combined")
+	}
+}
+
+func TestSyncEncrypted(t *testing.T) {
+	c, fs := newTestClient(t, WithEncryption(keyFile(t, strings.Repeat("k", 32))))
+	dir := t.TempDir()
+	writeLocal(t, dir, "a.png", "first", time.Now().Add(-time.Hour))
+	writeLocal(t, dir, "b/c.png", strings.Repeat("second", 20000), time.Now())
+
+	actions, err := c.Sync(context.Background(), dir, "", SyncOptions{})
+	if err != nil || len(actions) != 2 {
+		t.Fatalf("planned\n%s\n%v", plan(actions), err)
+	}
+	if img, _ := fs.get("a.png"); bytes.Contains(img.data, []byte("first")) {
+		t.Fatal("the server got the content")
+	}
+	// sizes and digests of the server are those of the encrypted data
+	if actions, err = c.Sync(context.Background(), dir, "", SyncOptions{}); err != nil || len(actions) > 0 {
+		t.Fatalf("second run planned\n%s\n%v", plan(actions), err)
+	}
+
+	other := t.TempDir()
+	if _, err := c.Sync(context.Background(), other, "", SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLocal(t, other, "b/c.png"); got != strings.Repeat("second", 20000) {
+		t.Fatalf("got %d bytes", len(got))
+	}
+}
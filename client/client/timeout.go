@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// callContext applies the unary call timeout unless ctx already has a
+// deadline.
+func (c *Client) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || c.opts.callTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.opts.callTimeout)
+}
+
+// watchdog cancels a transfer attempt when no data moved for the stall
+// timeout, or when it runs longer than its size allows at the minimum
+// throughput.
+type watchdog struct {
+	stall   time.Duration
+	minRate int64
+	cancel  context.CancelFunc
+	start   time.Time
+	done    chan struct{}
+
+	mu       sync.Mutex
+	moved    int64
+	deadline time.Time
+	reason   string
+}
+
+// newWatchdog returns nil if neither check is enabled; all watchdog methods
+// accept a nil receiver.
+func (c *Client) newWatchdog(cancel context.CancelFunc) *watchdog {
+	if c.opts.stallTimeout <= 0 && c.opts.minRate <= 0 {
+		return nil
+	}
+	w := &watchdog{
+		stall:   c.opts.stallTimeout,
+		minRate: c.opts.minRate,
+		cancel:  cancel,
+		start:   time.Now(),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *watchdog) run() {
+	interval := time.Second
+	if w.stall > 0 && w.stall/4 < interval {
+		interval = w.stall / 4
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	last, lastChange := int64(0), w.start
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-tick.C:
+			w.mu.Lock()
+			moved, deadline := w.moved, w.deadline
+			w.mu.Unlock()
+			if moved != last {
+				last, lastChange = moved, now
+			}
+			switch {
+			case w.stall > 0 && now.Sub(lastChange) >= w.stall:
+				w.fire("transfer stalled: no data for " + w.stall.String())
+				return
+			case !deadline.IsZero() && now.After(deadline):
+				w.fire("transfer too slow: not finished after " + now.Sub(w.start).Round(10*time.Millisecond).String())
+				return
+			}
+		}
+	}
+}
+
+func (w *watchdog) fire(reason string) {
+	w.mu.Lock()
+	w.reason = reason
+	w.mu.Unlock()
+	w.cancel()
+}
+
+// expect sets the size of the transfer, which bounds its duration when a
+// minimum throughput is configured: stall timeout + size / min rate.
+func (w *watchdog) expect(size int64) {
+	if w == nil || w.minRate <= 0 || size < 0 {
+		return
+	}
+	w.mu.Lock()
+	w.deadline = w.start.Add(w.stall + time.Duration(float64(size)/float64(w.minRate)*float64(time.Second)))
+	w.mu.Unlock()
+}
+
+func (w *watchdog) add(n int) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.moved += int64(n)
+	w.mu.Unlock()
+}
+
+// stop ends the watchdog and replaces err with codes.DeadlineExceeded if
+// the watchdog cancelled the transfer.
+func (w *watchdog) stop(err error) error {
+	if w == nil {
+		return err
+	}
+	close(w.done)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.reason != "" && err != nil {
+		return status.Error(codes.DeadlineExceeded, w.reason)
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("tages/client")
+
+// chunksPerSpan is how many chunks are grouped in one span.
+const chunksPerSpan = 256
+
+// chunkSpans groups the chunks of a transfer into spans, recording how much
+// of each batch was spent on local I/O and how much on the network.
+type chunkSpans struct {
+	ctx     context.Context
+	name    string
+	span    trace.Span
+	chunks  int
+	bytes   int
+	local   time.Duration
+	network time.Duration
+}
+
+func newChunkSpans(ctx context.Context, name string) *chunkSpans {
+	return &chunkSpans{ctx: ctx, name: name}
+}
+
+// add records one chunk of n bytes and the time spent on it.
+func (c *chunkSpans) add(n int, local, network time.Duration) {
+	if c.span == nil {
+		_, c.span = tracer.Start(c.ctx, c.name)
+	}
+	c.chunks++
+	c.bytes += n
+	c.local += local
+	c.network += network
+	if c.chunks == chunksPerSpan {
+		c.end()
+	}
+}
+
+func (c *chunkSpans) end() {
+	if c.span == nil {
+		return
+	}
+	c.span.SetAttributes(
+		attribute.Int("chunks", c.chunks),
+		attribute.Int("bytes", c.bytes),
+		attribute.Int64("local_io_ms", c.local.Milliseconds()),
+		attribute.Int64("network_ms", c.network.Milliseconds()),
+	)
+	c.span.End()
+	*c = chunkSpans{ctx: c.ctx, name: c.name}
+}
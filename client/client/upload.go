@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	pb "tages/client/proto"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// UploadResult is the server's answer to a completed upload.
+type UploadResult struct {
+	Name string
+	Size int64
+}
+
+// Upload streams r to the server under info.Name, encrypted if the Client
+// has WithEncryption. Failed calls are retried from the start following the
+// retry policy, provided r is an io.Seeker so it can be rewound.
+func (c *Client) Upload(ctx context.Context, r io.Reader, info ImageInfo) (*UploadResult, error) {
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ctx, span := tracer.Start(ctx, "Upload", trace.WithAttributes(attribute.String("image.name", info.Name)))
+	defer span.End()
+
+	seeker, _ := r.(io.Seeker)
+	var start int64
+	total := int64(-1)
+	if seeker != nil {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		} else if end, err := seeker.Seek(0, io.SeekEnd); err == nil {
+			total = end - start
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("cannot read image data: %w", err)
+			}
+		}
+	}
+	if c.opts.encryption != nil && total >= 0 {
+		total = sealedSize(total)
+	}
+	progress := newTracker(c.opts.progress, info.Name, Uploading, total)
+
+	var res *UploadResult
+	attempt := 0
+	err = c.retry(ctx, func() (bool, error) {
+		if attempt > 0 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return false, err
+			}
+			progress.reset()
+		}
+		attempt++
+		src := r
+		if c.opts.encryption != nil {
+			var err error
+			if src, err = c.opts.encryption.seal(r); err != nil {
+				return false, err
+			}
+		}
+		var err error
+		res, err = c.upload(ctx, src, info, total, progress)
+		return seeker != nil, err
+	})
+	progress.finish(err)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("cannot upload %s: %w", info.Name, err)
+	}
+	if c.opts.encryption != nil {
+		res.Size = openedSize(res.Size)
+	}
+	return res, nil
+}
+
+// upload makes one attempt at sending r; size is -1 if unknown.
+func (c *Client) upload(ctx context.Context, r io.Reader, info ImageInfo, size int64, progress *tracker) (_ *UploadResult, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wd := c.newWatchdog(cancel)
+	defer func() { err = wd.stop(err) }()
+	wd.expect(size)
+
+	stream, err := c.svc.UploadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_Info{Info: info.toProto()},
+	})
+	if err != nil {
+		return nil, closeErr(stream, err)
+	}
+
+	buffer := make([]byte, c.opts.chunkSize)
+	spans := newChunkSpans(ctx, "Upload.chunks")
+	defer spans.end()
+	for {
+		readStart := time.Now()
+		n, err := io.ReadFull(r, buffer)
+		if n > 0 {
+			sendStart := time.Now()
+			err := stream.Send(&pb.UploadImageRequest{
+				Data: &pb.UploadImageRequest_Chunkdata{Chunkdata: buffer[:n]},
+			})
+			if err != nil {
+				return nil, closeErr(stream, err)
+			}
+			spans.add(n, sendStart.Sub(readStart), time.Since(sendStart))
+			progress.add(n)
+			wd.add(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read image data: %w", err)
+		}
+	}
+	spans.end()
+
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	return &UploadResult{Name: res.GetName(), Size: int64(res.GetSize())}, nil
+}
+
+// closeErr returns the real status after Send failed: gRPC reports io.EOF
+// from Send when the server has already ended the stream.
+func closeErr(stream pb.ImageUploadService_UploadImageClient, err error) error {
+	if errors.Is(err, io.EOF) {
+		_, err = stream.CloseAndRecv()
+	}
+	return err
+}
+
+// UploadFile uploads the file at path, named after its base name.
+func (c *Client) UploadFile(ctx context.Context, path string) (*UploadResult, error) {
+	return c.UploadFileAs(ctx, path, filepath.Base(path))
+}
+
+// UploadFileAs uploads the file at path under the given image name.
+func (c *Client) UploadFileAs(ctx context.Context, path, name string) (*UploadResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat image file: %w", err)
+	}
+	created, modified := fileTimes(fi)
+	return c.Upload(ctx, f, ImageInfo{
+		Name:     name,
+		Created:  created.String(),
+		Modified: modified.String(),
+		ModTime:  fi.ModTime(),
+	})
+}
@@ -0,0 +1,485 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/grpc/codes"
+)
+
+// WatchEventKind tells what happened to a file watched by a Watcher.
+type WatchEventKind string
+
+const (
+	// WatchQueued: the file stopped changing and was added to the queue.
+	WatchQueued WatchEventKind = "queued"
+	// WatchUploaded: the upload succeeded and the file left the queue.
+	WatchUploaded WatchEventKind = "uploaded"
+	// WatchRetrying: the upload failed with a transient error; the file
+	// stays queued. It is also reported, with Path set to the watched
+	// directory, when the initial scan could not reach the server.
+	WatchRetrying WatchEventKind = "retrying"
+	// WatchFailed: the upload failed for good, e.g. because the server
+	// rejected the name; the file left the queue.
+	WatchFailed WatchEventKind = "failed"
+	// WatchDropped: the file disappeared before it could be uploaded.
+	WatchDropped WatchEventKind = "dropped"
+)
+
+type WatchEvent struct {
+	Kind WatchEventKind
+	Name string
+	Path string
+	Err  error
+}
+
+// WatchOptions tune a Watcher.
+type WatchOptions struct {
+	Filter Filter
+	// Debounce is how long a file must stay unchanged before it is
+	// considered fully written. Default 2s.
+	Debounce time.Duration
+	// QueueFile keeps the pending uploads across restarts. Default
+	// ".imgx-queue.json" in the watched directory.
+	QueueFile string
+	// Scan queues, on start, the files that are missing on the server or
+	// differ from it, to catch up with changes made while not watching.
+	Scan bool
+	// OnEvent, if set, is called for every event. It must not block.
+	OnEvent func(WatchEvent)
+}
+
+// Watcher uploads the files written to a directory tree as soon as they
+// are complete. Files are named like UploadDir names them.
+type Watcher struct {
+	c      *Client
+	dir    string
+	prefix string
+	opts   WatchOptions
+	queue  *diskQueue
+	// wake tells the uploader the queue grew
+	wake chan struct{}
+	// rescan asks the uploader to compare the tree with the server, set
+	// when events were lost
+	rescan int32
+}
+
+// NewWatcher prepares a Watcher for dir; nothing happens until Run.
+func (c *Client) NewWatcher(dir, prefix string, opts WatchOptions) (*Watcher, error) {
+	if err := opts.Filter.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = 2 * time.Second
+	}
+	if opts.QueueFile == "" {
+		opts.QueueFile = filepath.Join(dir, ".imgx-queue.json")
+	}
+	if prefix == "." {
+		prefix = ""
+	}
+	q, err := openQueue(opts.QueueFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{c: c, dir: dir, prefix: prefix, opts: opts, queue: q, wake: make(chan struct{}, 1)}, nil
+}
+
+func (w *Watcher) event(kind WatchEventKind, rel string, err error) {
+	if w.opts.OnEvent != nil {
+		w.opts.OnEvent(WatchEvent{Kind: kind, Name: path.Join(w.prefix, rel), Path: w.localPath(rel), Err: err})
+	}
+}
+
+func (w *Watcher) localPath(rel string) string {
+	return filepath.Join(w.dir, filepath.FromSlash(rel))
+}
+
+// Run watches the directory until ctx is cancelled. Uploads still queued
+// then are picked up by the next Run.
+func (w *Watcher) Run(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cannot watch directory: %w", err)
+	}
+	defer fw.Close()
+
+	d := &debouncer{pending: make(map[string]*pendingFile)}
+	if err := w.addTree(fw, w.dir, nil); err != nil {
+		return err
+	}
+	if w.opts.Scan {
+		atomic.StoreInt32(&w.rescan, 1)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.upload(ctx)
+	}()
+	defer wg.Wait()
+	// stops the uploader when watching fails
+	defer cancel()
+
+	tick := time.NewTicker(w.opts.Debounce / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-fw.Errors:
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				return fmt.Errorf("cannot watch directory: %w", err)
+			}
+			// events were lost: watch the directories that may have been
+			// created meanwhile and let the uploader catch up with the files
+			if err := w.addTree(fw, w.dir, nil); err != nil {
+				return err
+			}
+			atomic.StoreInt32(&w.rescan, 1)
+			w.wakeUp()
+		case ev := <-fw.Events:
+			w.handle(fw, d, ev)
+		case now := <-tick.C:
+			for _, rel := range d.settled(now, w.opts.Debounce, w.localPath) {
+				w.enqueue(rel)
+			}
+		}
+	}
+}
+
+// addTree watches dir and its subdirectories. Files already there are
+// reported to found, which is how files moved in with a new directory are
+// not missed.
+func (w *Watcher) addTree(fw *fsnotify.Watcher, dir string, found func(rel string)) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the tree may change under our feet
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p != w.dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := fw.Add(p); err != nil {
+				return fmt.Errorf("cannot watch %s: %w", p, err)
+			}
+			return nil
+		}
+		if rel, ok := w.rel(p); ok && found != nil && info.Mode().IsRegular() {
+			found(rel)
+		}
+		return nil
+	})
+}
+
+// rel returns the slash-separated path of p relative to the watched
+// directory, and whether the file is of interest.
+func (w *Watcher) rel(p string) (string, bool) {
+	r, err := filepath.Rel(w.dir, p)
+	if err != nil {
+		return "", false
+	}
+	r = filepath.ToSlash(r)
+	for _, part := range strings.Split(r, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+	return r, w.opts.Filter.Match(r)
+}
+
+func (w *Watcher) handle(fw *fsnotify.Watcher, d *debouncer, ev fsnotify.Event) {
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		// removed or renamed away: the settle check drops it
+		return
+	}
+	info, err := os.Stat(ev.Name)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		if ev.Has(fsnotify.Create) {
+			w.addTree(fw, ev.Name, func(rel string) { d.touch(rel, time.Now()) })
+		}
+		return
+	}
+	if rel, ok := w.rel(ev.Name); ok && info.Mode().IsRegular() {
+		d.touch(rel, time.Now())
+	}
+}
+
+// scan queues the local files missing on the server or differing from it.
+func (w *Watcher) scan(ctx context.Context) error {
+	actions, err := w.c.Sync(ctx, w.dir, w.prefix, SyncOptions{Filter: w.opts.Filter, DryRun: true})
+	if err != nil {
+		return err
+	}
+	for _, a := range actions {
+		if a.Kind == SyncUpload {
+			if rel, ok := w.rel(a.Path); ok {
+				w.enqueue(rel)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) enqueue(rel string) {
+	// a queue that cannot be saved still works until the next restart
+	err := w.queue.add(rel)
+	w.event(WatchQueued, rel, err)
+	w.wakeUp()
+}
+
+func (w *Watcher) wakeUp() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// upload sends the queued files until ctx is cancelled. After a round with
+// transient failures it waits with exponential backoff, or until new files
+// are queued. Scans, initial or after lost events, are retried the same
+// way, so the watcher can start while the server is unreachable.
+func (w *Watcher) upload(ctx context.Context) {
+	p := w.c.opts.retry
+	failures := 0
+	for {
+		var transient int32
+		if atomic.SwapInt32(&w.rescan, 0) != 0 {
+			if err := w.scan(ctx); err != nil {
+				w.event(WatchRetrying, "", fmt.Errorf("cannot compare with server: %w", err))
+				atomic.StoreInt32(&w.rescan, 1)
+				transient = 1
+			}
+		}
+		items := w.queue.items()
+		w.c.Each(len(items), func(i int) {
+			if w.uploadOne(ctx, items[i]) {
+				atomic.StoreInt32(&transient, 1)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		var wait <-chan time.Time
+		if transient != 0 {
+			failures++
+			d := p.backoff(failures)
+			if d > time.Minute {
+				d = time.Minute
+			}
+			wait = time.After(d)
+		} else {
+			failures = 0
+			if len(items) > 0 {
+				// more may have been queued meanwhile
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-wait:
+		}
+	}
+}
+
+// uploadOne uploads one queued file and reports whether it failed with a
+// transient error.
+func (w *Watcher) uploadOne(ctx context.Context, it queueItem) bool {
+	name := path.Join(w.prefix, it.rel)
+	if _, err := os.Stat(w.localPath(it.rel)); os.IsNotExist(err) {
+		w.queue.done(it)
+		w.event(WatchDropped, it.rel, nil)
+		return false
+	}
+	_, err := w.c.UploadFileAs(ctx, w.localPath(it.rel), name)
+	switch {
+	case err == nil:
+		w.queue.done(it)
+		w.event(WatchUploaded, it.rel, nil)
+	case ctx.Err() != nil:
+	case permanent(err):
+		w.queue.done(it)
+		w.event(WatchFailed, it.rel, err)
+	default:
+		w.event(WatchRetrying, it.rel, err)
+		return true
+	}
+	return false
+}
+
+// permanent reports errors that uploading again will not fix.
+func permanent(err error) bool {
+	switch Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.PermissionDenied,
+		codes.Unauthenticated, codes.AlreadyExists, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// debouncer tracks files being written until they stop changing.
+type debouncer struct {
+	pending map[string]*pendingFile
+}
+
+type pendingFile struct {
+	last time.Time
+	size int64
+	mod  time.Time
+}
+
+func (d *debouncer) touch(rel string, now time.Time) {
+	if f, ok := d.pending[rel]; ok {
+		f.last = now
+		return
+	}
+	d.pending[rel] = &pendingFile{last: now, size: -1}
+}
+
+// settled returns the files that saw no event for quiet and whose size and
+// modification time did not change since the previous check, which catches
+// writers that do not trigger events, e.g. on network file systems.
+func (d *debouncer) settled(now time.Time, quiet time.Duration, local func(string) string) []string {
+	var done []string
+	for rel, f := range d.pending {
+		if now.Sub(f.last) < quiet {
+			continue
+		}
+		info, err := os.Stat(local(rel))
+		if err != nil {
+			delete(d.pending, rel)
+			continue
+		}
+		if info.Size() == f.size && info.ModTime().Equal(f.mod) {
+			delete(d.pending, rel)
+			done = append(done, rel)
+			continue
+		}
+		f.size, f.mod, f.last = info.Size(), info.ModTime(), now
+	}
+	return done
+}
+
+// diskQueue is the set of files waiting to be uploaded, saved to a file
+// after every change.
+type diskQueue struct {
+	path string
+	mu   sync.Mutex
+	// gen changes whenever a file is queued again, so that an upload that
+	// started before the file changed does not take it off the queue
+	gen   map[string]int
+	order []string
+	next  int
+}
+
+type queueItem struct {
+	rel string
+	gen int
+}
+
+func openQueue(name string) (*diskQueue, error) {
+	q := &diskQueue{path: name, gen: make(map[string]int)}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read upload queue: %w", err)
+	}
+	var saved struct {
+		Pending []string `json:"pending"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("cannot read upload queue %s: %w", name, err)
+	}
+	for _, rel := range saved.Pending {
+		q.addLocked(rel)
+	}
+	return q, nil
+}
+
+func (q *diskQueue) addLocked(rel string) {
+	if _, ok := q.gen[rel]; !ok {
+		q.order = append(q.order, rel)
+	}
+	q.next++
+	q.gen[rel] = q.next
+}
+
+func (q *diskQueue) add(rel string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.addLocked(rel)
+	return q.saveLocked()
+}
+
+func (q *diskQueue) items() []queueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]queueItem, 0, len(q.order))
+	for _, rel := range q.order {
+		items = append(items, queueItem{rel: rel, gen: q.gen[rel]})
+	}
+	return items
+}
+
+// done takes it off the queue unless the file was queued again since.
+func (q *diskQueue) done(it queueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.gen[it.rel] != it.gen {
+		return
+	}
+	delete(q.gen, it.rel)
+	for i, rel := range q.order {
+		if rel == it.rel {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	q.saveLocked()
+}
+
+// saveLocked writes the queue to a temporary file renamed over the old one,
+// so a crash leaves either the old or the new queue.
+func (q *diskQueue) saveLocked() error {
+	data, err := json.Marshal(struct {
+		Pending []string `json:"pending"`
+	}{q.order})
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("cannot save upload queue: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("cannot save upload queue: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDebouncer(t *testing.T) {
+	dir := t.TempDir()
+	local := func(rel string) string { return filepath.Join(dir, rel) }
+	start := time.Now()
+	writeLocal(t, dir, "a.png", "a", start)
+	d := &debouncer{pending: make(map[string]*pendingFile)}
+	d.touch("a.png", start)
+	d.touch("gone.png", start)
+
+	if got := d.settled(start.Add(time.Second), 2*time.Second, local); len(got) > 0 {
+		t.Fatalf("settled %v before the quiet period", got)
+	}
+	// the first check only records size and modification time
+	if got := d.settled(start.Add(2*time.Second), 2*time.Second, local); len(got) > 0 {
+		t.Fatalf("settled %v on the first check", got)
+	}
+	if _, ok := d.pending["gone.png"]; ok {
+		t.Fatal("a removed file is still pending")
+	}
+
+	// a writer that triggers no events still delays the upload
+	writeLocal(t, dir, "a.png", "ab", start.Add(time.Second))
+	if got := d.settled(start.Add(4*time.Second), 2*time.Second, local); len(got) > 0 {
+		t.Fatalf("settled %v while it changed", got)
+	}
+	if got := d.settled(start.Add(6*time.Second), 2*time.Second, local); !reflect.DeepEqual(got, []string{"a.png"}) {
+		t.Fatalf("settled %v", got)
+	}
+	if len(d.pending) > 0 {
+		t.Fatalf("still pending: %v", d.pending)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "queue.json")
+	q, err := openQueue(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"a.png", "b/c.png", "d.png"} {
+		if err := q.add(rel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := q.items()
+	// a file queued again while uploading stays queued
+	q.add("a.png")
+	q.done(items[0])
+	q.done(items[1])
+
+	q, err = openQueue(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, it := range q.items() {
+		got = append(got, it.rel)
+	}
+	if want := []string{"a.png", "d.png"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened queue holds %v, want %v", got, want)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	for code, want := range map[codes.Code]bool{
+		codes.InvalidArgument:    true,
+		codes.FailedPrecondition: true,
+		codes.PermissionDenied:   true,
+		codes.Unauthenticated:    true,
+		codes.AlreadyExists:      true,
+		codes.Unavailable:        false,
+		codes.DeadlineExceeded:   false,
+		codes.ResourceExhausted:  true,
+		codes.Internal:           false,
+	} {
+		if got := permanent(status.Error(code, "failed")); got != want {
+			t.Errorf("%s: got %v", code, got)
+		}
+	}
+	if permanent(errors.New("cannot open file")) {
+		t.Error("a local error is permanent")
+	}
+}
+
+func TestWatcherUploads(t *testing.T) {
+	c, fs := newTestClient(t)
+	dir := t.TempDir()
+	writeLocal(t, dir, "old.png", "old", time.Now())
+	events := make(chan WatchEvent, 100)
+	w, err := c.NewWatcher(dir, "photos", WatchOptions{
+		Debounce: 20 * time.Millisecond,
+		Scan:     true,
+		OnEvent:  func(ev WatchEvent) { events <- ev },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	uploaded := func(name string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Kind == WatchUploaded && ev.Name == name {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%s was not uploaded", name)
+			}
+		}
+	}
+	uploaded("photos/old.png")
+	writeLocal(t, dir, "new/a.png", "new", time.Now())
+	uploaded("photos/new/a.png")
+	if img, ok := fs.get("photos/new/a.png"); !ok || string(img.data) != "new" {
+		t.Fatalf("server has %q", img.data)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"tages/client/client"
+	"time"
+)
+
+// errorList collects the failures of a batch command so that it processes
+// all of its arguments. The first error decides the exit status.
+type errorList []error
+
+func (l *errorList) add(err error) {
+	if err != nil {
+		*l = append(*l, err)
+	}
+}
+
+// result returns nil if nothing failed.
+func (l errorList) result() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l errorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (l errorList) Unwrap() error {
+	return l[0]
+}
+
+// collect gathers the per-argument outcome of a batch command, keeping
+// command-line order whatever order the workers finish in.
+func collect(errs []error) errorList {
+	var l errorList
+	for _, err := range errs {
+		l.add(err)
+	}
+	return l
+}
+
+func parse(fs *flag.FlagSet, args []string, minArgs int) error {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil || fs.NArg() < minArgs {
+		return errUsage
+	}
+	return nil
+}
+
+// globList collects a repeatable glob flag.
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(v string) error {
+	*g = append(*g, v)
+	return nil
+}
+
+// filterFlags adds -include and -exclude to fs.
+func filterFlags(fs *flag.FlagSet) *client.Filter {
+	f := &client.Filter{}
+	fs.Var((*globList)(&f.Include), "include", "only transfer files matching this glob, with -r or sync (repeatable)")
+	fs.Var((*globList)(&f.Exclude), "exclude", "skip files matching this glob, with -r or sync (repeatable)")
+	return f
+}
+
+func runUpload(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	name := fs.String("name", "", "image name (only with a single file; default: file base name)")
+	recursive := fs.Bool("r", false, "upload directories recursively")
+	prefix := fs.String("prefix", "", "with -r, name prefix of the uploaded files (default: directory base name, \".\" for none)")
+	filter := filterFlags(fs)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if *name != "" && (fs.NArg() > 1 || *recursive) {
+		return errUsage
+	}
+	if *recursive {
+		var results []client.FileResult
+		for _, dir := range fs.Args() {
+			p := *prefix
+			if p == "" {
+				p = filepath.Base(filepath.Clean(dir))
+			}
+			res, err := a.client.UploadDir(ctx, dir, path.Clean(p), *filter)
+			if err != nil {
+				return err
+			}
+			results = append(results, res...)
+		}
+		a.out.files(results)
+		return fileErrors(results)
+	}
+
+	paths := fs.Args()
+	done := make([]*client.UploadResult, len(paths))
+	errs := make([]error, len(paths))
+	a.client.Each(len(paths), func(i int) {
+		imageName := filepath.Base(paths[i])
+		if *name != "" {
+			imageName = *name
+		}
+		done[i], errs[i] = a.client.UploadFileAs(ctx, paths[i], imageName)
+	})
+
+	var results []client.UploadResult
+	for _, res := range done {
+		if res != nil {
+			results = append(results, *res)
+		}
+	}
+	a.out.uploads(results)
+	return collect(errs).result()
+}
+
+func runDownload(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	dir := fs.String("d", ".", "output directory")
+	recursive := fs.Bool("r", false, "download every image whose name starts with the given prefixes")
+	shared := fs.Bool("share", false, "arguments are share tokens, downloaded without an auth token")
+	filter := filterFlags(fs)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return fmt.Errorf("cannot create output directory: %w", err)
+	}
+	if *shared {
+		tokens := fs.Args()
+		done := make([]*client.ImageInfo, len(tokens))
+		errs := make([]error, len(tokens))
+		a.client.Each(len(tokens), func(i int) {
+			name := client.SharedName(tokens[i])
+			if name == "" {
+				errs[i] = fmt.Errorf("malformed share token %q", tokens[i])
+				return
+			}
+			done[i], errs[i] = a.client.DownloadSharedFile(ctx, tokens[i], filepath.Join(*dir, path.Base(name)))
+		})
+		a.out.images(infos(done))
+		return collect(errs).result()
+	}
+	if *recursive {
+		var results []client.FileResult
+		for _, prefix := range fs.Args() {
+			res, err := a.client.DownloadPrefix(ctx, prefix, *dir, *filter)
+			if err != nil {
+				return err
+			}
+			results = append(results, res...)
+		}
+		a.out.files(results)
+		return fileErrors(results)
+	}
+
+	names := fs.Args()
+	done := make([]*client.ImageInfo, len(names))
+	errs := make([]error, len(names))
+	a.client.Each(len(names), func(i int) {
+		done[i], errs[i] = a.client.DownloadFile(ctx, names[i], filepath.Join(*dir, path.Base(names[i])))
+	})
+	a.out.images(infos(done))
+	return collect(errs).result()
+}
+
+// fileErrors returns the failures of a directory transfer, which the
+// summary has already shown.
+func fileErrors(results []client.FileResult) error {
+	errs := make([]error, len(results))
+	for i, r := range results {
+		errs[i] = r.Err
+	}
+	return collect(errs).result()
+}
+
+func runList(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	if err := parse(fs, args, 0); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	images, err := a.client.ListPrefix(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	a.out.images(images)
+	return nil
+}
+
+func runRemove(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	names := fs.Args()
+	errs := make([]error, len(names))
+	a.client.Each(len(names), func(i int) {
+		errs[i] = a.client.Delete(ctx, names[i])
+	})
+	return collect(errs).result()
+}
+
+func runStat(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("stat", flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	names := fs.Args()
+	done := make([]*client.ImageInfo, len(names))
+	errs := make([]error, len(names))
+	a.client.Each(len(names), func(i int) {
+		done[i], errs[i] = a.client.Stat(ctx, names[i])
+	})
+	a.out.details(infos(done))
+	return collect(errs).result()
+}
+
+// infos drops the entries of failed calls.
+func infos(done []*client.ImageInfo) []client.ImageInfo {
+	var out []client.ImageInfo
+	for _, info := range done {
+		if info != nil {
+			out = append(out, *info)
+		}
+	}
+	return out
+}
+
+// runArchive saves the selected images as one archive; "-f -" writes it
+// to stdout. A failed download leaves no file behind.
+func runArchive(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+	format := fs.String("format", "zip", "archive format: zip or tar.gz")
+	out := fs.String("f", "", "output file, - for stdout (default images.zip or images.tar.gz)")
+	prefix := fs.String("prefix", "", "archive every image whose name starts with this prefix")
+	if err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if (fs.NArg() == 0) == (*prefix == "") {
+		return errUsage
+	}
+	f, err := client.ParseArchiveFormat(*format)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	req := client.ArchiveRequest{Names: fs.Args(), Prefix: *prefix, Format: f}
+	if *out == "-" {
+		_, err := a.client.DownloadArchive(ctx, req, os.Stdout)
+		return err
+	}
+	if *out == "" {
+		*out = "images." + f.String()
+	}
+	file, err := ioutil.TempFile(filepath.Dir(*out), "."+filepath.Base(*out)+".*.part")
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	size, err := a.client.DownloadArchive(ctx, req, file)
+	if cerr := file.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("cannot write file: %w", cerr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), *out); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	a.out.archive(*out, size)
+	return nil
+}
+
+// runImport stores the files of a tar, tar.gz or zip archive; "-" reads
+// it from stdin.
+func runImport(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "prefix added to the names of the imported images")
+	if err := parse(fs, args, 1); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	r := os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	results, err := a.client.ImportArchive(ctx, r, *prefix)
+	if err != nil {
+		return err
+	}
+	a.out.files(results)
+	return fileErrors(results)
+}
+
+func runBackup(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	if err := parse(fs, args, 0); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	info, err := a.client.Backup(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	a.out.backup(info)
+	return nil
+}
+
+func runRestore(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	info, err := a.client.RestoreBackup(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	a.out.backup(info)
+	return nil
+}
+
+func runRotateKeys(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	if err := parse(fs, args, 0); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	r, err := a.client.RotateKeys(ctx)
+	if err != nil {
+		return err
+	}
+	a.out.keyRotation(r)
+	return nil
+}
+
+func runShare(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("share", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "how long the links stay valid (0 = server default)")
+	max := fs.Int("max", 0, "number of downloads allowed per link (0 = unlimited)")
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	names := fs.Args()
+	links := make([]*client.ShareLink, len(names))
+	errs := make([]error, len(names))
+	a.client.Each(len(names), func(i int) {
+		links[i], errs[i] = a.client.CreateShareLink(ctx, names[i], client.ShareOptions{TTL: *ttl, MaxDownloads: *max})
+	})
+	var done []client.ShareLink
+	for _, l := range links {
+		if l != nil {
+			done = append(done, *l)
+		}
+	}
+	a.out.shareLinks(done)
+	return collect(errs).result()
+}
+
+func runUnshare(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("unshare", flag.ContinueOnError)
+	if err := parse(fs, args, 1); err != nil {
+		return err
+	}
+	ids := fs.Args()
+	errs := make([]error, len(ids))
+	a.client.Each(len(ids), func(i int) {
+		errs[i] = a.client.RevokeShareLink(ctx, ids[i])
+	})
+	return collect(errs).result()
+}
+
+func runSync(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	dryRun := fs.Bool("n", false, "dry run: only print the planned actions")
+	prefix := fs.String("prefix", ".", "name prefix of the images mirrored by DIR (\".\" for all)")
+	deleteRemote := fs.Bool("delete-remote", false, "delete images missing locally instead of downloading them")
+	deleteLocal := fs.Bool("delete-local", false, "delete local files missing on the server instead of uploading them")
+	filter := filterFlags(fs)
+	if err := parse(fs, args, 1); err != nil || fs.NArg() != 1 || *deleteRemote && *deleteLocal {
+		return errUsage
+	}
+	actions, err := a.client.Sync(ctx, fs.Arg(0), *prefix, client.SyncOptions{
+		Filter:       *filter,
+		DeleteRemote: *deleteRemote,
+		DeleteLocal:  *deleteLocal,
+		DryRun:       *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+	a.out.actions(actions, *dryRun)
+	errs := make([]error, len(actions))
+	for i, act := range actions {
+		errs[i] = act.Err
+	}
+	return collect(errs).result()
+}
+
+// runWatch uploads files as they appear until interrupted. Files not yet
+// uploaded then are kept in the queue file and sent on the next run.
+func runWatch(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	prefix := fs.String("prefix", ".", "name prefix of the uploaded images (\".\" for none)")
+	debounce := fs.Duration("debounce", 2*time.Second, "how long a file must stay unchanged before it is uploaded")
+	queue := fs.String("queue", "", "file keeping the pending uploads (default DIR/.imgx-queue.json)")
+	scan := fs.Bool("scan", false, "on start, also upload the files missing on the server or differing from it")
+	filter := filterFlags(fs)
+	if err := parse(fs, args, 1); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	var mu sync.Mutex
+	w, err := a.client.NewWatcher(fs.Arg(0), *prefix, client.WatchOptions{
+		Filter:    *filter,
+		Debounce:  *debounce,
+		QueueFile: *queue,
+		Scan:      *scan,
+		OnEvent: func(ev client.WatchEvent) {
+			mu.Lock()
+			a.out.event(ev)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, stop := untilInterrupted(ctx)
+	defer stop()
+	return w.Run(ctx)
+}
+
+// untilInterrupted returns a context cancelled by SIGINT or SIGTERM, for
+// commands running until the user stops them.
+func untilInterrupted(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+// runEvents prints the changes below a prefix until interrupted. The resume
+// token of the last event printed continues from there with -token.
+func runEvents(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	token := fs.String("token", "", "resume token of the last event seen, to print the changes missed since")
+	if err := parse(fs, args, 0); err != nil || fs.NArg() > 1 {
+		return errUsage
+	}
+	ctx, stop := untilInterrupted(ctx)
+	defer stop()
+	return a.client.Watch(ctx, fs.Arg(0), *token, func(ev client.ImageEvent) error {
+		a.out.imageEvent(ev)
+		return nil
+	})
+}
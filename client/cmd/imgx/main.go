@@ -0,0 +1,245 @@
+// Command imgx is a command-line client for the image service.
+//
+// Usage:
+//
+//	imgx [global flags] <command> [command flags] [args]
+//
+// Commands: upload, download, ls, rm, stat, archive, import, backup, restore,
+// rotate-keys, share, unshare, sync, watch, events. Run "imgx help" for
+// details.
+//
+// With -e2e-key FILE, or -e2e and a passphrase in IMGX_PASSPHRASE, images
+// are encrypted before upload and decrypted after download, so the server
+// never sees their content.
+//
+// The exit status is 0 on success, 64 for usage errors and otherwise the
+// numeric gRPC status code of the first failure (e.g. 5 for NotFound, 14 for
+// Unavailable, 16 for Unauthenticated).
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"tages/client/client"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+const exitUsage = 64
+
+// errUsage marks errors caused by invalid command-line arguments.
+var errUsage = errors.New("usage error")
+
+type globalFlags struct {
+	server     string
+	useTLS     bool
+	caFile     string
+	serverName string
+	token      string
+	output     string
+	timeout    time.Duration
+	jobs       int
+	quiet      bool
+	retries    int
+	stall      time.Duration
+	minRate    int64
+	e2e        bool
+	e2eKey     string
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, app *app, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"upload", "[-name NAME] FILE... | -r [-prefix P] DIR...", "upload files or directories", runUpload},
+		{"download", "[-d DIR] NAME... | -r [-d DIR] PREFIX... | -share TOKEN...", "download images, name prefixes or share links", runDownload},
+		{"ls", "[PREFIX]", "list stored images", runList},
+		{"rm", "NAME...", "delete images", runRemove},
+		{"stat", "NAME...", "show image details", runStat},
+		{"archive", "[-format zip|tar.gz] [-f FILE] NAME... | -prefix P", "download images as a single archive", runArchive},
+		{"import", "[-prefix P] ARCHIVE|-", "store the files of a tar, tar.gz or zip archive", runImport},
+		{"backup", "[NAME]", "make the server back up all images to its backup directory (admin)", runBackup},
+		{"restore", "NAME", "restore a backup into a server without images (admin)", runRestore},
+		{"rotate-keys", "", "re-encrypt all images with the first key of the server's key file (admin)", runRotateKeys},
+		{"share", "[-ttl D] [-max N] NAME...", "create links downloading images without an auth token", runShare},
+		{"unshare", "ID...", "revoke share links", runUnshare},
+		{"sync", "[-n] [-prefix P] [-delete-remote|-delete-local] DIR", "synchronise a directory with the server", runSync},
+		{"watch", "[-prefix P] [-debounce D] [-queue FILE] [-scan] DIR", "upload files as they are written to DIR", runWatch},
+		{"events", "[-token T] [PREFIX]", "print changes to the stored images as they happen", runEvents},
+	}
+}
+
+// app carries what every command needs.
+type app struct {
+	client *client.Client
+	out    *printer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	var g globalFlags
+	fs := flag.NewFlagSet("imgx", flag.ContinueOnError)
+	fs.StringVar(&g.server, "server", envOr("IMGX_SERVER", "localhost:50051"), "server address (env IMGX_SERVER)")
+	fs.BoolVar(&g.useTLS, "tls", false, "connect over TLS")
+	fs.StringVar(&g.caFile, "ca", "", "CA certificate used to verify the server (implies -tls)")
+	fs.StringVar(&g.serverName, "server-name", "", "override the TLS server name")
+	fs.StringVar(&g.token, "token", "", "auth token (env IMGX_TOKEN)")
+	fs.StringVar(&g.output, "o", "table", "output format: table or json")
+	fs.DurationVar(&g.timeout, "timeout", 0, "overall timeout (0 = none)")
+	fs.DurationVar(&g.stall, "stall-timeout", 30*time.Second, "cancel a transfer when no data moved for this long (0 = never)")
+	fs.Int64Var(&g.minRate, "min-rate", 0, "fail transfers slower than this many bytes per second (0 = no limit)")
+	fs.IntVar(&g.jobs, "j", 4, "number of transfers run in parallel")
+	fs.BoolVar(&g.quiet, "q", false, "do not show progress bars")
+	fs.IntVar(&g.retries, "retries", client.DefaultRetryPolicy.MaxAttempts-1, "retries of calls failing with a transient error")
+	fs.BoolVar(&g.e2e, "e2e", false, "encrypt images end to end with the passphrase in IMGX_PASSPHRASE")
+	fs.StringVar(&g.e2eKey, "e2e-key", "", "encrypt images end to end with the key in this file")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if g.token == "" {
+		g.token = os.Getenv("IMGX_TOKEN")
+	}
+	if g.jobs < 1 {
+		fmt.Fprintln(os.Stderr, "imgx: -j must be at least 1")
+		return exitUsage
+	}
+	if fs.NArg() == 0 || fs.Arg(0) == "help" {
+		usage(fs)
+		return exitUsage
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.name == fs.Arg(0) {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "imgx: unknown command %q\n", fs.Arg(0))
+		usage(fs)
+		return exitUsage
+	}
+	out, err := newPrinter(os.Stdout, g.output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "imgx: %v\n", err)
+		return exitUsage
+	}
+
+	opts := []client.Option{client.WithConcurrency(g.jobs), client.WithRetries(g.retries),
+		client.WithStallTimeout(g.stall), client.WithMinThroughput(g.minRate)}
+	if g.useTLS || g.caFile != "" {
+		cfg, err := tlsConfig(g.caFile, g.serverName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "imgx: %v\n", err)
+			return exitUsage
+		}
+		opts = append(opts, client.WithTLSConfig(cfg))
+	}
+	if g.token != "" {
+		opts = append(opts, client.WithToken(g.token))
+	}
+	if g.e2e || g.e2eKey != "" {
+		enc, err := encryption(g)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "imgx: %v\n", err)
+			return exitUsage
+		}
+		opts = append(opts, client.WithEncryption(enc))
+	}
+	if !g.quiet && isTerminal(os.Stderr) {
+		opts = append(opts, client.WithProgress(newProgressBars(os.Stderr).update))
+	}
+	c, err := client.Dial(g.server, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "imgx: %v\n", err)
+		return int(codes.Unavailable)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	err = cmd.run(ctx, &app{client: c, out: out}, fs.Args()[1:])
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(os.Stderr, "usage: imgx %s %s\n", cmd.name, cmd.args)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "imgx: %s\n", strings.ReplaceAll(err.Error(), "\n", "\nimgx: "))
+	}
+	return exitCode(err)
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "usage: imgx [global flags] <command> [command flags] [args]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-11s %-52s %s\n", c.name, c.args, c.summary)
+	}
+	fmt.Fprintf(w, "\nglobal flags:\n")
+	fs.PrintDefaults()
+}
+
+// exitCode maps err to the process exit status: the numeric gRPC code.
+func exitCode(err error) int {
+	return int(client.Code(err))
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func encryption(g globalFlags) (*client.Encryption, error) {
+	if g.e2e && g.e2eKey != "" {
+		return nil, errors.New("-e2e and -e2e-key cannot be combined")
+	}
+	if g.e2eKey != "" {
+		return client.EncryptWithKeyFile(g.e2eKey)
+	}
+	if os.Getenv("IMGX_PASSPHRASE") == "" {
+		return nil, errors.New("-e2e needs the passphrase in IMGX_PASSPHRASE")
+	}
+	return client.EncryptWithPassphrase(os.Getenv("IMGX_PASSPHRASE"))
+}
+
+func tlsConfig(caFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
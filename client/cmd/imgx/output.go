@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"tages/client/client"
+	"text/tabwriter"
+	"time"
+)
+
+// printer writes command results as an aligned table or as JSON.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case "table":
+		return &printer{w: w}, nil
+	case "json":
+		return &printer{w: w, json: true}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+type imageJSON struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Created  string `json:"created,omitempty"`
+	Modified string `json:"modified,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+func toJSON(images []client.ImageInfo) []imageJSON {
+	out := make([]imageJSON, 0, len(images))
+	for _, img := range images {
+		out = append(out, imageJSON{Name: img.Name, Size: img.Size, Created: img.Created, Modified: img.Modified, SHA256: img.SHA256})
+	}
+	return out
+}
+
+func (p *printer) encode(v interface{}) {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (p *printer) table(header string, rows func(w io.Writer)) {
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	rows(tw)
+	tw.Flush()
+}
+
+func (p *printer) images(images []client.ImageInfo) {
+	if p.json {
+		p.encode(toJSON(images))
+		return
+	}
+	p.table("NAME\tSIZE\tMODIFIED", func(w io.Writer) {
+		for _, img := range images {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", img.Name, img.Size, img.Modified)
+		}
+	})
+}
+
+func (p *printer) details(images []client.ImageInfo) {
+	if p.json {
+		p.encode(toJSON(images))
+		return
+	}
+	for i, img := range images {
+		if i > 0 {
+			fmt.Fprintln(p.w)
+		}
+		fmt.Fprintf(p.w, "Name:     %s\nSize:     %d\nCreated:  %s\nModified: %s\nSHA-256:  %s\n",
+			img.Name, img.Size, img.Created, img.Modified, img.SHA256)
+	}
+}
+
+func (p *printer) uploads(results []client.UploadResult) {
+	if p.json {
+		type uploadJSON struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		out := make([]uploadJSON, 0, len(results))
+		for _, r := range results {
+			out = append(out, uploadJSON{Name: r.Name, Size: r.Size})
+		}
+		p.encode(out)
+		return
+	}
+	p.table("NAME\tSIZE", func(w io.Writer) {
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%d\n", r.Name, r.Size)
+		}
+	})
+}
+
+func (p *printer) archive(path string, size int64) {
+	if p.json {
+		p.encode(struct {
+			Path string `json:"path"`
+			Size int64  `json:"size"`
+		}{path, size})
+		return
+	}
+	p.table("FILE\tSIZE", func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%d\n", path, size)
+	})
+}
+
+func (p *printer) backup(b *client.BackupInfo) {
+	if p.json {
+		p.encode(struct {
+			Name    string    `json:"name"`
+			Images  int       `json:"images"`
+			Bytes   int64     `json:"bytes"`
+			Created time.Time `json:"created"`
+		}{b.Name, b.Images, b.Bytes, b.Created})
+		return
+	}
+	p.table("BACKUP\tIMAGES\tBYTES\tCREATED", func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", b.Name, b.Images, b.Bytes, b.Created.Format(time.RFC3339))
+	})
+}
+
+func (p *printer) keyRotation(r *client.KeyRotation) {
+	if p.json {
+		p.encode(struct {
+			Rewrapped int `json:"rewrapped"`
+			Encrypted int `json:"encrypted"`
+			Unchanged int `json:"unchanged"`
+		}{r.Rewrapped, r.Encrypted, r.Unchanged})
+		return
+	}
+	p.table("REWRAPPED\tENCRYPTED\tUNCHANGED", func(w io.Writer) {
+		fmt.Fprintf(w, "%d\t%d\t%d\n", r.Rewrapped, r.Encrypted, r.Unchanged)
+	})
+}
+
+// shareLinks prints the links with their token, which the URL contains
+// if the server knows its public address.
+func (p *printer) shareLinks(links []client.ShareLink) {
+	if p.json {
+		type linkJSON struct {
+			ID           string    `json:"id"`
+			Name         string    `json:"name"`
+			Token        string    `json:"token"`
+			URL          string    `json:"url,omitempty"`
+			Expires      time.Time `json:"expires"`
+			MaxDownloads int       `json:"max_downloads,omitempty"`
+		}
+		out := make([]linkJSON, 0, len(links))
+		for _, l := range links {
+			out = append(out, linkJSON{ID: l.ID, Name: l.Name, Token: l.Token, URL: l.URL, Expires: l.Expires, MaxDownloads: l.MaxDownloads})
+		}
+		p.encode(out)
+		return
+	}
+	p.table("ID\tNAME\tEXPIRES\tMAX\tLINK", func(w io.Writer) {
+		for _, l := range links {
+			link := l.URL
+			if link == "" {
+				link = l.Token
+			}
+			max := "-"
+			if l.MaxDownloads > 0 {
+				max = strconv.Itoa(l.MaxDownloads)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", l.ID, l.Name, l.Expires.Format(time.RFC3339), max, link)
+		}
+	})
+}
+
+// files prints the per-file summary of a directory transfer followed by
+// the totals.
+func (p *printer) files(results []client.FileResult) {
+	var failed int
+	var bytes int64
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		} else {
+			bytes += r.Size
+		}
+	}
+	if p.json {
+		type fileJSON struct {
+			Name  string `json:"name"`
+			Path  string `json:"path"`
+			Size  int64  `json:"size"`
+			Error string `json:"error,omitempty"`
+		}
+		out := make([]fileJSON, 0, len(results))
+		for _, r := range results {
+			f := fileJSON{Name: r.Name, Path: r.Path, Size: r.Size}
+			if r.Err != nil {
+				f.Error = r.Err.Error()
+			}
+			out = append(out, f)
+		}
+		p.encode(out)
+		return
+	}
+	p.table("NAME\tPATH\tSIZE\tSTATUS", func(w io.Writer) {
+		for _, r := range results {
+			state := "ok"
+			if r.Err != nil {
+				state = "failed: " + client.Code(r.Err).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", r.Name, r.Path, r.Size, state)
+		}
+	})
+	fmt.Fprintf(p.w, "%d files, %d failed, %d bytes transferred\n", len(results), failed, bytes)
+}
+
+// actions prints the steps of a sync, or the plan of a dry run.
+func (p *printer) actions(actions []client.SyncAction, dryRun bool) {
+	if p.json {
+		type actionJSON struct {
+			Action string `json:"action"`
+			Name   string `json:"name"`
+			Path   string `json:"path,omitempty"`
+			Size   int64  `json:"size"`
+			Reason string `json:"reason"`
+			Error  string `json:"error,omitempty"`
+		}
+		out := make([]actionJSON, 0, len(actions))
+		for _, a := range actions {
+			j := actionJSON{Action: string(a.Kind), Name: a.Name, Path: a.Path, Size: a.Size, Reason: a.Reason}
+			if a.Err != nil {
+				j.Error = a.Err.Error()
+			}
+			out = append(out, j)
+		}
+		p.encode(out)
+		return
+	}
+	failed := 0
+	p.table("ACTION\tNAME\tPATH\tSIZE\tREASON\tSTATUS", func(w io.Writer) {
+		for _, a := range actions {
+			state := "ok"
+			switch {
+			case dryRun:
+				state = "planned"
+			case a.Err != nil:
+				state = "failed: " + client.Code(a.Err).String()
+				failed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", a.Kind, a.Name, a.Path, a.Size, a.Reason, state)
+		}
+	})
+	if dryRun {
+		fmt.Fprintf(p.w, "%d actions planned (dry run)\n", len(actions))
+		return
+	}
+	fmt.Fprintf(p.w, "%d actions, %d failed\n", len(actions), failed)
+}
+
+// event prints one watch event as a line, or a JSON object per line.
+func (p *printer) event(ev client.WatchEvent) {
+	if p.json {
+		type eventJSON struct {
+			Time  time.Time `json:"time"`
+			Event string    `json:"event"`
+			Name  string    `json:"name"`
+			Path  string    `json:"path"`
+			Error string    `json:"error,omitempty"`
+		}
+		j := eventJSON{Time: time.Now(), Event: string(ev.Kind), Name: ev.Name, Path: ev.Path}
+		if ev.Err != nil {
+			j.Error = ev.Err.Error()
+		}
+		json.NewEncoder(p.w).Encode(j)
+		return
+	}
+	line := fmt.Sprintf("%s %-8s %s", time.Now().Format("15:04:05"), ev.Kind, ev.Name)
+	if ev.Err != nil {
+		line += ": " + ev.Err.Error()
+	}
+	fmt.Fprintln(p.w, line)
+}
+
+// imageEvent prints one change reported by the server.
+func (p *printer) imageEvent(ev client.ImageEvent) {
+	if p.json {
+		type imageEventJSON struct {
+			Time   time.Time `json:"time"`
+			Event  string    `json:"event"`
+			Name   string    `json:"name"`
+			Size   int64     `json:"size,omitempty"`
+			SHA256 string    `json:"sha256,omitempty"`
+			Token  string    `json:"resume_token"`
+		}
+		json.NewEncoder(p.w).Encode(imageEventJSON{Time: ev.Time, Event: string(ev.Type), Name: ev.Image.Name,
+			Size: ev.Image.Size, SHA256: ev.Image.SHA256, Token: ev.ResumeToken})
+		return
+	}
+	line := fmt.Sprintf("%s %-8s %s", ev.Time.Format("15:04:05"), ev.Type, ev.Image.Name)
+	if ev.Type != client.ImageDeleted {
+		line += fmt.Sprintf(" (%d bytes)", ev.Image.Size)
+	}
+	fmt.Fprintf(p.w, "%s  [%s]\n", line, ev.ResumeToken)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"tages/client/client"
+	"time"
+)
+
+const barWidth = 24
+
+// progressBars draws one line per transfer and redraws them in place as
+// reports arrive from the client.
+type progressBars struct {
+	mu    sync.Mutex
+	w     io.Writer
+	order []string
+	state map[string]client.Progress
+	drawn int
+}
+
+func newProgressBars(w io.Writer) *progressBars {
+	return &progressBars{w: w, state: make(map[string]client.Progress)}
+}
+
+// isTerminal reports whether f looks like an interactive terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (b *progressBars) update(p client.Progress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := p.Direction.String() + " " + p.Name
+	if _, ok := b.state[key]; !ok {
+		b.order = append(b.order, key)
+	}
+	b.state[key] = p
+
+	if b.drawn > 0 {
+		fmt.Fprintf(b.w, "\x1b[%dA", b.drawn)
+	}
+	for _, k := range b.order {
+		fmt.Fprintf(b.w, "\r\x1b[K%s\n", progressLine(b.state[k]))
+	}
+	b.drawn = len(b.order)
+}
+
+func progressLine(p client.Progress) string {
+	name := p.Name
+	if r := []rune(name); len(r) > 24 {
+		name = "..." + string(r[len(r)-21:])
+	}
+	bar := strings.Repeat(" ", barWidth)
+	percent := "   ?"
+	if p.Total > 0 {
+		filled := int(float64(barWidth) * float64(p.Bytes) / float64(p.Total))
+		if filled > barWidth {
+			filled = barWidth
+		}
+		bar = strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+		percent = fmt.Sprintf("%3d%%", p.Bytes*100/p.Total)
+	}
+	line := fmt.Sprintf("%-8s %-24s [%s] %s %9s %11s", p.Direction, name, bar, percent,
+		humanBytes(p.Bytes), humanBytes(int64(p.Rate))+"/s")
+	switch {
+	case p.Done && p.Err != nil:
+		return line + "  failed"
+	case p.Done:
+		return line + "  done"
+	case p.ETA > 0:
+		return line + "  ETA " + p.ETA.Round(time.Second).String()
+	}
+	return line
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -3,8 +3,15 @@ module tages/client
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/golang/protobuf v1.5.2
 	github.com/zenthangplus/goccm v0.0.0-20200608171100-39e9e08b694a
-	golang.org/x/time v0.0.0-20210611083556-38a9dc6acbc6
-	google.golang.org/grpc v1.38.0
+	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.40.0
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.14.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.14.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/trace v1.14.0
+	golang.org/x/crypto v0.6.0
+	google.golang.org/grpc v1.53.0
 )
@@ -1,205 +1,107 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
-	"strings"
 	"sync"
-	"syscall"
-	pb "tages/client/proto"
+	"tages/client/client"
 	"time"
 
-	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/zenthangplus/goccm"
-	"google.golang.org/grpc"
 )
 
 const (
-	address = "localhost:50051"
+	address      = "localhost:50051"
+	stallTimeout = 15 * time.Second
+	callTimeout  = 5 * time.Second
 )
 
-var mutex = &sync.Mutex{}
 var getFilesLimiter = goccm.New(100)
 var upDownLoadLimiter = goccm.New(10)
 
-func testUploadImage(imageClient pb.ImageUploadServiceClient) {
-	uploadImage(imageClient, "tmp/javascript.png")
-	uploadImage(imageClient, "tmp/python.png")
-	uploadImage(imageClient, "tmp/scala.png")
+// running tracks the goroutines started by spawn. goccm's WaitAllDone never
+// returns if everything finished before it was called, so it is not used.
+var running sync.WaitGroup
+
+// spawn runs f in a new goroutine once limiter has a free slot. The slot is
+// given back even if f panics or returns early.
+func spawn(limiter goccm.ConcurrencyManager, f func()) {
+	limiter.Wait()
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		defer limiter.Done()
+		f()
+	}()
 }
 
-func timespectotime(ts syscall.Timespec) time.Time {
-	return time.Unix(int64(ts.Sec), int64(ts.Nsec))
-}
-
-func uploadImage(imageClient pb.ImageUploadServiceClient, imagePath string) {
-	mutex.Lock()
-
-	file, err := os.Open(imagePath)
-
-	if err != nil {
-		log.Fatal("cannot open image file: ", err)
-	}
-
-	stats, err := file.Stat()
-
-	stat_t := stats.Sys().(*syscall.Stat_t)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	defer file.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	stream, err := imageClient.UploadImage(ctx)
-
+// testUploadImage uploads the images of the tmp directory, keeping their
+// relative paths as names.
+func testUploadImage(c *client.Client) {
+	filter := client.Filter{Include: []string{"*.png", "*.jpg", "*.jpeg"}}
+	results, err := c.UploadDir(context.Background(), "tmp", ".", filter)
 	if err != nil {
-		log.Fatal("cannot upload image: ", err)
-	}
-	fil_n := strings.Split(imagePath, "/")
-	filename := fil_n[len(fil_n)-1]
-
-	req := &pb.UploadImageRequest{
-		Data: &pb.UploadImageRequest_Info{
-			Info: &pb.ImageInfo{
-				Name: filename,
-				//ImageType: filepath.Ext(imagePath),
-				Created:  timespectotime(stat_t.Ctim).String(), //stats.ModTime().String(),
-				Modified: timespectotime(stat_t.Mtim).String(), //stats.ModTime().String(),
-			},
-		},
-	}
-
-	err = stream.Send(req)
-
-	if err != nil {
-		log.Fatal("cannot send image info to server: ", err, stream)
+		log.Println(err)
+		return
 	}
-
-	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
-
-	for {
-		n, err := reader.Read(buffer)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatal("cannot read chunck to buffer: ", err)
-		}
-
-		req := &pb.UploadImageRequest{
-			Data: &pb.UploadImageRequest_Chunkdata{
-				Chunkdata: buffer[:n],
-			},
-		}
-
-		err = stream.Send(req)
-		if err != nil {
-			log.Fatal("cannot send chunk to server: ", err)
+	for _, r := range results {
+		if r.Err != nil {
+			log.Printf("%s: %v", r.Path, r.Err)
+			continue
 		}
+		log.Printf("image uploaded with name: %s, size: %d", r.Name, r.Size)
 	}
-
-	res, err := stream.CloseAndRecv()
-	if err != nil {
-		log.Fatal("cannot receive response: ", err)
-	}
-
-	mutex.Unlock()
-	log.Printf("image uploaded with name: %s, size: %d", res.GetName(), res.GetSize())
-	upDownLoadLimiter.Done()
 }
 
-func Save(imageName string, imageData bytes.Buffer) (string, error) {
-	filename := path.Join("files", imageName)
-	//data := bufio.NewWriter(&imageData)
-	err := ioutil.WriteFile(filename, imageData.Bytes(), 0777)
+func uploadImage(c *client.Client, imagePath string) {
+	res, err := c.UploadFile(context.Background(), imagePath)
 	if err != nil {
-		return "", fmt.Errorf("cannot write image to file: %w", err)
+		log.Println(err)
+		return
 	}
-	return imageName, nil
+	log.Printf("image uploaded with name: %s, size: %d", res.Name, res.Size)
 }
 
-func getImagesList(imageClient pb.ImageUploadServiceClient) {
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-
-	defer cancel()
-	r, err := imageClient.ListImages(ctx, &wrappers.StringValue{Value: ""})
+func getImagesList(c *client.Client) {
+	r, err := c.List(context.Background())
 	if err != nil {
 		log.Println(err)
+		return
 	}
 	log.Println(r)
-	getFilesLimiter.Done()
 }
 
-func DownloadImage(imageClient pb.ImageUploadServiceClient, filename string) {
-
-	mutex.Lock()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	stream, err := imageClient.DownloadImage(ctx, &wrappers.StringValue{Value: filename})
+func DownloadImage(c *client.Client, filename string) {
+	info, err := c.DownloadFile(context.Background(), filename, path.Join("files", filename))
 	if err != nil {
-		fmt.Println(err)
-	}
-
-	res, err := stream.Recv()
-	if err != nil {
-		fmt.Println("cannot receive image info")
+		log.Println(err)
+		return
 	}
-	fmt.Println(res)
-	///all image info
-
-	imageData := bytes.Buffer{}
-
-	for {
-		res, err := stream.Recv()
-		chunk := res.GetChunkdata()
-		size := len(chunk)
-
-		log.Printf("chunck of %d received", size)
-
-		if err == io.EOF {
-			log.Println("No more date to receive")
-			break
-		}
+	log.Printf("Downloaded image with name %s, size: %d", info.Name, info.Size)
+}
 
-		_, err = imageData.Write(chunk)
-		if err != nil {
-			fmt.Printf("cannot write chunk data: %v", err)
-		}
-	}
+func main() {
 
-	imageName, err := Save(filename, imageData)
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		fmt.Printf("cannot save image to the store: %v", err)
+		log.Fatal(err)
 	}
-	mutex.Unlock()
-	fmt.Printf("Downloaded image with name %s", imageName)
-	upDownLoadLimiter.Done()
-
-}
+	defer shutdownTracing(context.Background())
 
-func main() {
-
-	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	// transfers are cancelled when they stall rather than after a fixed
+	// time, so large images have as long as they need
+	c, err := client.Dial(address,
+		client.WithStallTimeout(stallTimeout),
+		client.WithCallTimeout(callTimeout))
 
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
 
-	defer conn.Close()
+	defer c.Close()
 
 	err = os.Mkdir("tmp", 0777)
 	if err != nil {
@@ -210,34 +112,32 @@ func main() {
 		log.Println("Directory files already exists")
 	}
 
-	c := pb.NewImageUploadServiceClient(conn)
-
 	//Загрузить файл
 	//testUploadImage(c)
 
 	//Получить файл от сервис
-	DownloadImage(c, "Java.jpg")
+	spawn(upDownLoadLimiter, func() { DownloadImage(c, "Java.jpg") })
 	//for i := 0; i < 15; i++ {
-	//	go DownloadImage(c, "java.jpg")
+	//	spawn(upDownLoadLimiter, func() { DownloadImage(c, "java.jpg") })
 	//}
 
 	//Одновременно загрузить 6 файлов и получить списку файлов
 	liste := []string{"tmp/chicago.jpg", "tmp/canada.jpeg", "tmp/javascript.png", "tmp/new_york.jpg", "tmp/python.png", "tmp/scala.png"}
-	for i := 0; i < 6; i++ {
-		go uploadImage(c, liste[i])
-		go getImagesList(c)
+	for _, p := range liste {
+		p := p
+		spawn(upDownLoadLimiter, func() { uploadImage(c, p) })
+		spawn(getFilesLimiter, func() { getImagesList(c) })
 	}
-	getFilesLimiter.WaitAllDone()
-	upDownLoadLimiter.WaitAllDone()
+	running.Wait()
 
 	//
 
 	//Running getImagesList concurrently (Одновременно)
 	//100 конкурентых запросов одновременно
 	/*for i := 0; i < 300; i++ {
-		go getImagesList(c)
+		spawn(getFilesLimiter, func() { getImagesList(c) })
 	}
-	getFilesLimiter.WaitAllDone()*/
+	running.Wait()*/
 
 	fmt.Println("Program ended")
 
@@ -7,6 +7,7 @@ import (
 	context "context"
 	fmt "fmt"
 	proto "github.com/golang/protobuf/proto"
+	empty "github.com/golang/protobuf/ptypes/empty"
 	wrappers "github.com/golang/protobuf/ptypes/wrappers"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
@@ -25,7 +26,63 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
-//for uploading image
+type ImageEvent_Type int32
+
+const (
+	ImageEvent_UNKNOWN ImageEvent_Type = 0
+	ImageEvent_CREATED ImageEvent_Type = 1
+	ImageEvent_UPDATED ImageEvent_Type = 2
+	ImageEvent_DELETED ImageEvent_Type = 3
+)
+
+var ImageEvent_Type_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "CREATED",
+	2: "UPDATED",
+	3: "DELETED",
+}
+
+var ImageEvent_Type_value = map[string]int32{
+	"UNKNOWN": 0,
+	"CREATED": 1,
+	"UPDATED": 2,
+	"DELETED": 3,
+}
+
+func (x ImageEvent_Type) String() string {
+	return proto.EnumName(ImageEvent_Type_name, int32(x))
+}
+
+func (ImageEvent_Type) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{7, 0}
+}
+
+type DownloadArchiveRequest_Format int32
+
+const (
+	DownloadArchiveRequest_ZIP    DownloadArchiveRequest_Format = 0
+	DownloadArchiveRequest_TAR_GZ DownloadArchiveRequest_Format = 1
+)
+
+var DownloadArchiveRequest_Format_name = map[int32]string{
+	0: "ZIP",
+	1: "TAR_GZ",
+}
+
+var DownloadArchiveRequest_Format_value = map[string]int32{
+	"ZIP":    0,
+	"TAR_GZ": 1,
+}
+
+func (x DownloadArchiveRequest_Format) String() string {
+	return proto.EnumName(DownloadArchiveRequest_Format_name, int32(x))
+}
+
+func (DownloadArchiveRequest_Format) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{10, 0}
+}
+
+// for uploading image
 type UploadImageRequest struct {
 	// Types that are valid to be assigned to Data:
 	//	*UploadImageRequest_Info
@@ -107,9 +164,14 @@ func (*UploadImageRequest) XXX_OneofWrappers() []interface{} {
 }
 
 type ImageInfo struct {
-	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Created              string   `protobuf:"bytes,2,opt,name=created,proto3" json:"created,omitempty"`
-	Modified             string   `protobuf:"bytes,3,opt,name=modified,proto3" json:"modified,omitempty"`
+	Name     string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Created  string `protobuf:"bytes,2,opt,name=created,proto3" json:"created,omitempty"`
+	Modified string `protobuf:"bytes,3,opt,name=modified,proto3" json:"modified,omitempty"`
+	Size     int64  `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+	// modification time in Unix nanoseconds; kept by the server on upload
+	Mtime int64 `protobuf:"varint,5,opt,name=mtime,proto3" json:"mtime,omitempty"`
+	// hex SHA-256 of the content, set by the server
+	Sha256               string   `protobuf:"bytes,6,opt,name=sha256,proto3" json:"sha256,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -161,6 +223,27 @@ func (m *ImageInfo) GetModified() string {
 	return ""
 }
 
+func (m *ImageInfo) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *ImageInfo) GetMtime() int64 {
+	if m != nil {
+		return m.Mtime
+	}
+	return 0
+}
+
+func (m *ImageInfo) GetSha256() string {
+	if m != nil {
+		return m.Sha256
+	}
+	return ""
+}
+
 type UploadImageResponse struct {
 	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
 	Size                 uint32   `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
@@ -247,7 +330,7 @@ func (m *ImageList) GetImages() []*ImageInfo {
 	return nil
 }
 
-//for downloading image
+// for downloading image
 type DownloadImageRequest struct {
 	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -367,244 +450,1497 @@ func (*DownloadImageResponse) XXX_OneofWrappers() []interface{} {
 	}
 }
 
-func init() {
-	proto.RegisterType((*UploadImageRequest)(nil), "proto.UploadImageRequest")
-	proto.RegisterType((*ImageInfo)(nil), "proto.ImageInfo")
-	proto.RegisterType((*UploadImageResponse)(nil), "proto.UploadImageResponse")
-	proto.RegisterType((*ImageList)(nil), "proto.ImageList")
-	proto.RegisterType((*DownloadImageRequest)(nil), "proto.DownloadImageRequest")
-	proto.RegisterType((*DownloadImageResponse)(nil), "proto.DownloadImageResponse")
+// for watching changes
+type WatchImagesRequest struct {
+	// only images whose name starts with prefix are reported
+	Prefix string `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	// resume_token of the last event received, to replay what was missed
+	ResumeToken          string   `protobuf:"bytes,2,opt,name=resume_token,json=resumeToken,proto3" json:"resume_token,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
-func init() { proto.RegisterFile("image_info.proto", fileDescriptor_8085f4b4731c381e) }
-
-var fileDescriptor_8085f4b4731c381e = []byte{
-	// 360 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x52, 0xc1, 0x4a, 0xc3, 0x40,
-	0x10, 0x4d, 0x6c, 0xac, 0x66, 0x6a, 0xa1, 0x8c, 0x0a, 0x31, 0x94, 0x52, 0xf6, 0x20, 0xc1, 0x43,
-	0x2a, 0x15, 0x8f, 0x7a, 0x10, 0x0f, 0x2d, 0x08, 0x42, 0x4a, 0xbd, 0xca, 0xb6, 0xd9, 0xc4, 0xc5,
-	0x76, 0x37, 0x66, 0x13, 0x0b, 0xfe, 0xb4, 0xbf, 0x20, 0xd9, 0xa4, 0xd5, 0xda, 0x80, 0x17, 0x4f,
-	0xbb, 0x93, 0xf7, 0xe6, 0xcd, 0xdb, 0x97, 0x81, 0x0e, 0x5f, 0xd2, 0x98, 0x3d, 0x73, 0x11, 0x49,
-	0x3f, 0x49, 0x65, 0x26, 0x71, 0x5f, 0x1f, 0x6e, 0x2f, 0x96, 0x32, 0x5e, 0xb0, 0x81, 0xae, 0x66,
-	0x79, 0x34, 0x58, 0xa5, 0x34, 0x49, 0x58, 0xaa, 0x4a, 0x1a, 0x09, 0x01, 0xa7, 0xc9, 0x42, 0xd2,
-	0x70, 0x5c, 0x08, 0x04, 0xec, 0x2d, 0x67, 0x2a, 0xc3, 0x73, 0xb0, 0x0a, 0x29, 0xc7, 0xec, 0x9b,
-	0x5e, 0x6b, 0xd8, 0x29, 0xb9, 0xbe, 0xa6, 0x8c, 0x45, 0x24, 0x47, 0x46, 0xa0, 0x71, 0xec, 0x81,
-	0x3d, 0x7f, 0xc9, 0xc5, 0x6b, 0x48, 0x33, 0xea, 0xec, 0xf5, 0x4d, 0xef, 0x68, 0x64, 0x04, 0xdf,
-	0x9f, 0xee, 0x9a, 0x60, 0x15, 0x27, 0x99, 0x82, 0xbd, 0x69, 0x46, 0x04, 0x4b, 0xd0, 0x25, 0xd3,
-	0xe2, 0x76, 0xa0, 0xef, 0xe8, 0xc0, 0xc1, 0x3c, 0x65, 0x34, 0x63, 0xa1, 0x96, 0xb1, 0x83, 0x75,
-	0x89, 0x2e, 0x1c, 0x2e, 0x65, 0xc8, 0x23, 0xce, 0x42, 0xa7, 0xa1, 0xa1, 0x4d, 0x4d, 0x6e, 0xe0,
-	0x78, 0xcb, 0xbc, 0x4a, 0xa4, 0x50, 0xac, 0x76, 0x00, 0x82, 0xa5, 0xf8, 0x07, 0xd3, 0xea, 0xed,
-	0x40, 0xdf, 0xc9, 0x75, 0xe5, 0xea, 0x81, 0xab, 0x0c, 0x3d, 0x68, 0xea, 0x0c, 0x95, 0x63, 0xf6,
-	0x1b, 0x75, 0x8f, 0x0e, 0x2a, 0x9c, 0x5c, 0xc0, 0xc9, 0xbd, 0x5c, 0x89, 0x9d, 0xd0, 0x6a, 0xc6,
-	0x92, 0x18, 0x4e, 0x7f, 0x71, 0x2b, 0x8f, 0xff, 0x9c, 0xf0, 0xf0, 0xd3, 0x04, 0xd4, 0xdd, 0x65,
-	0x20, 0x13, 0x96, 0xbe, 0xf3, 0x39, 0xc3, 0x11, 0xb4, 0x7e, 0x24, 0x84, 0x67, 0xd5, 0x9c, 0xdd,
-	0x5f, 0xee, 0xba, 0x75, 0x50, 0x69, 0x96, 0x18, 0x9e, 0x89, 0xb7, 0x00, 0x45, 0x4e, 0x1a, 0x50,
-	0xd8, 0xf5, 0xcb, 0xbd, 0xf2, 0xd7, 0x7b, 0xe5, 0x4f, 0xb2, 0x94, 0x8b, 0xf8, 0x89, 0x2e, 0x72,
-	0xe6, 0x6e, 0x3d, 0xa7, 0xe8, 0x22, 0x06, 0x3e, 0x42, 0x7b, 0x2b, 0x89, 0x3f, 0x24, 0xba, 0x95,
-	0x44, 0x6d, 0x7a, 0xc4, 0xb8, 0x34, 0x67, 0x4d, 0x4d, 0xb8, 0xfa, 0x0a, 0x00, 0x00, 0xff, 0xff,
-	0x9d, 0x78, 0x67, 0xb5, 0xfb, 0x02, 0x00, 0x00,
+func (m *WatchImagesRequest) Reset()         { *m = WatchImagesRequest{} }
+func (m *WatchImagesRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchImagesRequest) ProtoMessage()    {}
+func (*WatchImagesRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{6}
 }
 
-// Reference imports to suppress errors if they are not otherwise used.
-var _ context.Context
-var _ grpc.ClientConn
-
-// This is a compile-time assertion to ensure that this generated file
-// is compatible with the grpc package it is being compiled against.
-const _ = grpc.SupportPackageIsVersion4
-
-// ImageUploadServiceClient is the client API for ImageUploadService service.
-//
-// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
-type ImageUploadServiceClient interface {
-	UploadImage(ctx context.Context, opts ...grpc.CallOption) (ImageUploadService_UploadImageClient, error)
-	ListImages(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*ImageList, error)
-	DownloadImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (ImageUploadService_DownloadImageClient, error)
+func (m *WatchImagesRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchImagesRequest.Unmarshal(m, b)
 }
-
-type imageUploadServiceClient struct {
-	cc *grpc.ClientConn
+func (m *WatchImagesRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchImagesRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchImagesRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchImagesRequest.Merge(m, src)
+}
+func (m *WatchImagesRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchImagesRequest.Size(m)
+}
+func (m *WatchImagesRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchImagesRequest.DiscardUnknown(m)
 }
 
-func NewImageUploadServiceClient(cc *grpc.ClientConn) ImageUploadServiceClient {
-	return &imageUploadServiceClient{cc}
+var xxx_messageInfo_WatchImagesRequest proto.InternalMessageInfo
+
+func (m *WatchImagesRequest) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
 }
 
-func (c *imageUploadServiceClient) UploadImage(ctx context.Context, opts ...grpc.CallOption) (ImageUploadService_UploadImageClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_ImageUploadService_serviceDesc.Streams[0], "/proto.ImageUploadService/UploadImage", opts...)
-	if err != nil {
-		return nil, err
+func (m *WatchImagesRequest) GetResumeToken() string {
+	if m != nil {
+		return m.ResumeToken
 	}
-	x := &imageUploadServiceUploadImageClient{stream}
-	return x, nil
+	return ""
 }
 
-type ImageUploadService_UploadImageClient interface {
-	Send(*UploadImageRequest) error
-	CloseAndRecv() (*UploadImageResponse, error)
-	grpc.ClientStream
+type ImageEvent struct {
+	Type ImageEvent_Type `protobuf:"varint,1,opt,name=type,proto3,enum=proto.ImageEvent_Type" json:"type,omitempty"`
+	// only the name is set for DELETED
+	Info        *ImageInfo `protobuf:"bytes,2,opt,name=info,proto3" json:"info,omitempty"`
+	ResumeToken string     `protobuf:"bytes,3,opt,name=resume_token,json=resumeToken,proto3" json:"resume_token,omitempty"`
+	// time of the change in Unix nanoseconds
+	Time                 int64    `protobuf:"varint,4,opt,name=time,proto3" json:"time,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
-type imageUploadServiceUploadImageClient struct {
-	grpc.ClientStream
+func (m *ImageEvent) Reset()         { *m = ImageEvent{} }
+func (m *ImageEvent) String() string { return proto.CompactTextString(m) }
+func (*ImageEvent) ProtoMessage()    {}
+func (*ImageEvent) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{7}
 }
 
-func (x *imageUploadServiceUploadImageClient) Send(m *UploadImageRequest) error {
-	return x.ClientStream.SendMsg(m)
+func (m *ImageEvent) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ImageEvent.Unmarshal(m, b)
+}
+func (m *ImageEvent) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ImageEvent.Marshal(b, m, deterministic)
+}
+func (m *ImageEvent) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ImageEvent.Merge(m, src)
+}
+func (m *ImageEvent) XXX_Size() int {
+	return xxx_messageInfo_ImageEvent.Size(m)
+}
+func (m *ImageEvent) XXX_DiscardUnknown() {
+	xxx_messageInfo_ImageEvent.DiscardUnknown(m)
 }
 
-func (x *imageUploadServiceUploadImageClient) CloseAndRecv() (*UploadImageResponse, error) {
-	if err := x.ClientStream.CloseSend(); err != nil {
-		return nil, err
-	}
-	m := new(UploadImageResponse)
-	if err := x.ClientStream.RecvMsg(m); err != nil {
-		return nil, err
+var xxx_messageInfo_ImageEvent proto.InternalMessageInfo
+
+func (m *ImageEvent) GetType() ImageEvent_Type {
+	if m != nil {
+		return m.Type
 	}
-	return m, nil
+	return ImageEvent_UNKNOWN
 }
 
-func (c *imageUploadServiceClient) ListImages(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*ImageList, error) {
-	out := new(ImageList)
-	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/ListImages", in, out, opts...)
-	if err != nil {
-		return nil, err
+func (m *ImageEvent) GetInfo() *ImageInfo {
+	if m != nil {
+		return m.Info
 	}
-	return out, nil
+	return nil
 }
 
-func (c *imageUploadServiceClient) DownloadImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (ImageUploadService_DownloadImageClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_ImageUploadService_serviceDesc.Streams[1], "/proto.ImageUploadService/DownloadImage", opts...)
-	if err != nil {
-		return nil, err
-	}
-	x := &imageUploadServiceDownloadImageClient{stream}
-	if err := x.ClientStream.SendMsg(in); err != nil {
-		return nil, err
-	}
-	if err := x.ClientStream.CloseSend(); err != nil {
-		return nil, err
+func (m *ImageEvent) GetResumeToken() string {
+	if m != nil {
+		return m.ResumeToken
 	}
-	return x, nil
+	return ""
 }
 
-type ImageUploadService_DownloadImageClient interface {
-	Recv() (*DownloadImageResponse, error)
-	grpc.ClientStream
+func (m *ImageEvent) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
 }
 
-type imageUploadServiceDownloadImageClient struct {
-	grpc.ClientStream
+// for sharing an image with someone without credentials
+type CreateShareLinkRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// validity of the link in seconds; 0 for the server default
+	TtlSeconds int64 `protobuf:"varint,2,opt,name=ttl_seconds,json=ttlSeconds,proto3" json:"ttl_seconds,omitempty"`
+	// number of downloads allowed; 0 for no limit
+	MaxDownloads         int32    `protobuf:"varint,3,opt,name=max_downloads,json=maxDownloads,proto3" json:"max_downloads,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
-func (x *imageUploadServiceDownloadImageClient) Recv() (*DownloadImageResponse, error) {
-	m := new(DownloadImageResponse)
-	if err := x.ClientStream.RecvMsg(m); err != nil {
-		return nil, err
-	}
-	return m, nil
+func (m *CreateShareLinkRequest) Reset()         { *m = CreateShareLinkRequest{} }
+func (m *CreateShareLinkRequest) String() string { return proto.CompactTextString(m) }
+func (*CreateShareLinkRequest) ProtoMessage()    {}
+func (*CreateShareLinkRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{8}
 }
 
-// ImageUploadServiceServer is the server API for ImageUploadService service.
-type ImageUploadServiceServer interface {
-	UploadImage(ImageUploadService_UploadImageServer) error
-	ListImages(context.Context, *wrappers.StringValue) (*ImageList, error)
-	DownloadImage(*wrappers.StringValue, ImageUploadService_DownloadImageServer) error
+func (m *CreateShareLinkRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CreateShareLinkRequest.Unmarshal(m, b)
 }
-
-// UnimplementedImageUploadServiceServer can be embedded to have forward compatible implementations.
-type UnimplementedImageUploadServiceServer struct {
+func (m *CreateShareLinkRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CreateShareLinkRequest.Marshal(b, m, deterministic)
 }
-
-func (*UnimplementedImageUploadServiceServer) UploadImage(srv ImageUploadService_UploadImageServer) error {
-	return status.Errorf(codes.Unimplemented, "method UploadImage not implemented")
+func (m *CreateShareLinkRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CreateShareLinkRequest.Merge(m, src)
 }
-func (*UnimplementedImageUploadServiceServer) ListImages(ctx context.Context, req *wrappers.StringValue) (*ImageList, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ListImages not implemented")
+func (m *CreateShareLinkRequest) XXX_Size() int {
+	return xxx_messageInfo_CreateShareLinkRequest.Size(m)
 }
-func (*UnimplementedImageUploadServiceServer) DownloadImage(req *wrappers.StringValue, srv ImageUploadService_DownloadImageServer) error {
-	return status.Errorf(codes.Unimplemented, "method DownloadImage not implemented")
+func (m *CreateShareLinkRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CreateShareLinkRequest.DiscardUnknown(m)
 }
 
-func RegisterImageUploadServiceServer(s *grpc.Server, srv ImageUploadServiceServer) {
-	s.RegisterService(&_ImageUploadService_serviceDesc, srv)
+var xxx_messageInfo_CreateShareLinkRequest proto.InternalMessageInfo
+
+func (m *CreateShareLinkRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
 }
 
-func _ImageUploadService_UploadImage_Handler(srv interface{}, stream grpc.ServerStream) error {
-	return srv.(ImageUploadServiceServer).UploadImage(&imageUploadServiceUploadImageServer{stream})
+func (m *CreateShareLinkRequest) GetTtlSeconds() int64 {
+	if m != nil {
+		return m.TtlSeconds
+	}
+	return 0
 }
 
-type ImageUploadService_UploadImageServer interface {
-	SendAndClose(*UploadImageResponse) error
-	Recv() (*UploadImageRequest, error)
-	grpc.ServerStream
+func (m *CreateShareLinkRequest) GetMaxDownloads() int32 {
+	if m != nil {
+		return m.MaxDownloads
+	}
+	return 0
 }
 
-type imageUploadServiceUploadImageServer struct {
-	grpc.ServerStream
+type ShareLink struct {
+	// identifies the link for RevokeShareLink
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// sent as "x-share-token" metadata with DownloadImage, or used as
+	// /share/<token> on the HTTP gateway
+	Token string `protobuf:"bytes,2,opt,name=token,proto3" json:"token,omitempty"`
+	// the HTTP link, if the server knows its public address
+	Url  string `protobuf:"bytes,3,opt,name=url,proto3" json:"url,omitempty"`
+	Name string `protobuf:"bytes,4,opt,name=name,proto3" json:"name,omitempty"`
+	// expiry time in Unix nanoseconds
+	Expires              int64    `protobuf:"varint,5,opt,name=expires,proto3" json:"expires,omitempty"`
+	MaxDownloads         int32    `protobuf:"varint,6,opt,name=max_downloads,json=maxDownloads,proto3" json:"max_downloads,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
-func (x *imageUploadServiceUploadImageServer) SendAndClose(m *UploadImageResponse) error {
-	return x.ServerStream.SendMsg(m)
+func (m *ShareLink) Reset()         { *m = ShareLink{} }
+func (m *ShareLink) String() string { return proto.CompactTextString(m) }
+func (*ShareLink) ProtoMessage()    {}
+func (*ShareLink) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{9}
 }
 
-func (x *imageUploadServiceUploadImageServer) Recv() (*UploadImageRequest, error) {
-	m := new(UploadImageRequest)
-	if err := x.ServerStream.RecvMsg(m); err != nil {
-		return nil, err
+func (m *ShareLink) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ShareLink.Unmarshal(m, b)
+}
+func (m *ShareLink) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ShareLink.Marshal(b, m, deterministic)
+}
+func (m *ShareLink) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ShareLink.Merge(m, src)
+}
+func (m *ShareLink) XXX_Size() int {
+	return xxx_messageInfo_ShareLink.Size(m)
+}
+func (m *ShareLink) XXX_DiscardUnknown() {
+	xxx_messageInfo_ShareLink.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ShareLink proto.InternalMessageInfo
+
+func (m *ShareLink) GetId() string {
+	if m != nil {
+		return m.Id
 	}
-	return m, nil
+	return ""
 }
 
-func _ImageUploadService_ListImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(wrappers.StringValue)
-	if err := dec(in); err != nil {
-		return nil, err
+func (m *ShareLink) GetToken() string {
+	if m != nil {
+		return m.Token
 	}
-	if interceptor == nil {
-		return srv.(ImageUploadServiceServer).ListImages(ctx, in)
+	return ""
+}
+
+func (m *ShareLink) GetUrl() string {
+	if m != nil {
+		return m.Url
 	}
-	info := &grpc.UnaryServerInfo{
-		Server:     srv,
-		FullMethod: "/proto.ImageUploadService/ListImages",
+	return ""
+}
+
+func (m *ShareLink) GetName() string {
+	if m != nil {
+		return m.Name
 	}
-	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(ImageUploadServiceServer).ListImages(ctx, req.(*wrappers.StringValue))
+	return ""
+}
+
+func (m *ShareLink) GetExpires() int64 {
+	if m != nil {
+		return m.Expires
 	}
-	return interceptor(ctx, in, info, handler)
+	return 0
 }
 
-func _ImageUploadService_DownloadImage_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(wrappers.StringValue)
-	if err := stream.RecvMsg(m); err != nil {
-		return err
+func (m *ShareLink) GetMaxDownloads() int32 {
+	if m != nil {
+		return m.MaxDownloads
 	}
-	return srv.(ImageUploadServiceServer).DownloadImage(m, &imageUploadServiceDownloadImageServer{stream})
+	return 0
 }
 
-type ImageUploadService_DownloadImageServer interface {
-	Send(*DownloadImageResponse) error
-	grpc.ServerStream
+// for downloading several images as one archive
+type DownloadArchiveRequest struct {
+	// either names or prefix selects the images
+	Names                []string                      `protobuf:"bytes,1,rep,name=names,proto3" json:"names,omitempty"`
+	Prefix               string                        `protobuf:"bytes,2,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	Format               DownloadArchiveRequest_Format `protobuf:"varint,3,opt,name=format,proto3,enum=proto.DownloadArchiveRequest_Format" json:"format,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}                      `json:"-"`
+	XXX_unrecognized     []byte                        `json:"-"`
+	XXX_sizecache        int32                         `json:"-"`
 }
 
-type imageUploadServiceDownloadImageServer struct {
-	grpc.ServerStream
+func (m *DownloadArchiveRequest) Reset()         { *m = DownloadArchiveRequest{} }
+func (m *DownloadArchiveRequest) String() string { return proto.CompactTextString(m) }
+func (*DownloadArchiveRequest) ProtoMessage()    {}
+func (*DownloadArchiveRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{10}
 }
 
-func (x *imageUploadServiceDownloadImageServer) Send(m *DownloadImageResponse) error {
-	return x.ServerStream.SendMsg(m)
+func (m *DownloadArchiveRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DownloadArchiveRequest.Unmarshal(m, b)
+}
+func (m *DownloadArchiveRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DownloadArchiveRequest.Marshal(b, m, deterministic)
+}
+func (m *DownloadArchiveRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DownloadArchiveRequest.Merge(m, src)
+}
+func (m *DownloadArchiveRequest) XXX_Size() int {
+	return xxx_messageInfo_DownloadArchiveRequest.Size(m)
+}
+func (m *DownloadArchiveRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DownloadArchiveRequest.DiscardUnknown(m)
 }
 
-var _ImageUploadService_serviceDesc = grpc.ServiceDesc{
-	ServiceName: "proto.ImageUploadService",
-	HandlerType: (*ImageUploadServiceServer)(nil),
-	Methods: []grpc.MethodDesc{
-		{
-			MethodName: "ListImages",
-			Handler:    _ImageUploadService_ListImages_Handler,
-		},
-	},
-	Streams: []grpc.StreamDesc{
+var xxx_messageInfo_DownloadArchiveRequest proto.InternalMessageInfo
+
+func (m *DownloadArchiveRequest) GetNames() []string {
+	if m != nil {
+		return m.Names
+	}
+	return nil
+}
+
+func (m *DownloadArchiveRequest) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+func (m *DownloadArchiveRequest) GetFormat() DownloadArchiveRequest_Format {
+	if m != nil {
+		return m.Format
+	}
+	return DownloadArchiveRequest_ZIP
+}
+
+type ArchiveChunk struct {
+	Data                 []byte   `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ArchiveChunk) Reset()         { *m = ArchiveChunk{} }
+func (m *ArchiveChunk) String() string { return proto.CompactTextString(m) }
+func (*ArchiveChunk) ProtoMessage()    {}
+func (*ArchiveChunk) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{11}
+}
+
+func (m *ArchiveChunk) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ArchiveChunk.Unmarshal(m, b)
+}
+func (m *ArchiveChunk) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ArchiveChunk.Marshal(b, m, deterministic)
+}
+func (m *ArchiveChunk) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ArchiveChunk.Merge(m, src)
+}
+func (m *ArchiveChunk) XXX_Size() int {
+	return xxx_messageInfo_ArchiveChunk.Size(m)
+}
+func (m *ArchiveChunk) XXX_DiscardUnknown() {
+	xxx_messageInfo_ArchiveChunk.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ArchiveChunk proto.InternalMessageInfo
+
+func (m *ArchiveChunk) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+// for importing the images of a tar, tar.gz or zip archive
+type ImportArchiveRequest struct {
+	// Types that are valid to be assigned to Data:
+	//	*ImportArchiveRequest_Options
+	//	*ImportArchiveRequest_Chunkdata
+	Data                 isImportArchiveRequest_Data `protobuf_oneof:"data"`
+	XXX_NoUnkeyedLiteral struct{}                    `json:"-"`
+	XXX_unrecognized     []byte                      `json:"-"`
+	XXX_sizecache        int32                       `json:"-"`
+}
+
+func (m *ImportArchiveRequest) Reset()         { *m = ImportArchiveRequest{} }
+func (m *ImportArchiveRequest) String() string { return proto.CompactTextString(m) }
+func (*ImportArchiveRequest) ProtoMessage()    {}
+func (*ImportArchiveRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{12}
+}
+
+func (m *ImportArchiveRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ImportArchiveRequest.Unmarshal(m, b)
+}
+func (m *ImportArchiveRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ImportArchiveRequest.Marshal(b, m, deterministic)
+}
+func (m *ImportArchiveRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ImportArchiveRequest.Merge(m, src)
+}
+func (m *ImportArchiveRequest) XXX_Size() int {
+	return xxx_messageInfo_ImportArchiveRequest.Size(m)
+}
+func (m *ImportArchiveRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ImportArchiveRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ImportArchiveRequest proto.InternalMessageInfo
+
+type isImportArchiveRequest_Data interface {
+	isImportArchiveRequest_Data()
+}
+
+type ImportArchiveRequest_Options struct {
+	Options *ImportArchiveOptions `protobuf:"bytes,1,opt,name=options,proto3,oneof"`
+}
+
+type ImportArchiveRequest_Chunkdata struct {
+	Chunkdata []byte `protobuf:"bytes,2,opt,name=chunkdata,proto3,oneof"`
+}
+
+func (*ImportArchiveRequest_Options) isImportArchiveRequest_Data() {}
+
+func (*ImportArchiveRequest_Chunkdata) isImportArchiveRequest_Data() {}
+
+func (m *ImportArchiveRequest) GetData() isImportArchiveRequest_Data {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (m *ImportArchiveRequest) GetOptions() *ImportArchiveOptions {
+	if x, ok := m.GetData().(*ImportArchiveRequest_Options); ok {
+		return x.Options
+	}
+	return nil
+}
+
+func (m *ImportArchiveRequest) GetChunkdata() []byte {
+	if x, ok := m.GetData().(*ImportArchiveRequest_Chunkdata); ok {
+		return x.Chunkdata
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*ImportArchiveRequest) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*ImportArchiveRequest_Options)(nil),
+		(*ImportArchiveRequest_Chunkdata)(nil),
+	}
+}
+
+type ImportArchiveOptions struct {
+	// prepended to the entry names
+	Prefix               string   `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ImportArchiveOptions) Reset()         { *m = ImportArchiveOptions{} }
+func (m *ImportArchiveOptions) String() string { return proto.CompactTextString(m) }
+func (*ImportArchiveOptions) ProtoMessage()    {}
+func (*ImportArchiveOptions) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{13}
+}
+
+func (m *ImportArchiveOptions) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ImportArchiveOptions.Unmarshal(m, b)
+}
+func (m *ImportArchiveOptions) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ImportArchiveOptions.Marshal(b, m, deterministic)
+}
+func (m *ImportArchiveOptions) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ImportArchiveOptions.Merge(m, src)
+}
+func (m *ImportArchiveOptions) XXX_Size() int {
+	return xxx_messageInfo_ImportArchiveOptions.Size(m)
+}
+func (m *ImportArchiveOptions) XXX_DiscardUnknown() {
+	xxx_messageInfo_ImportArchiveOptions.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ImportArchiveOptions proto.InternalMessageInfo
+
+func (m *ImportArchiveOptions) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+type ImportEntryResult struct {
+	// path of the entry in the archive
+	Entry string `protobuf:"bytes,1,opt,name=entry,proto3" json:"entry,omitempty"`
+	// image name, prefix included
+	Name string `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Size int64  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	// gRPC status code, 0 if the image was stored
+	Code                 int32    `protobuf:"varint,4,opt,name=code,proto3" json:"code,omitempty"`
+	Error                string   `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ImportEntryResult) Reset()         { *m = ImportEntryResult{} }
+func (m *ImportEntryResult) String() string { return proto.CompactTextString(m) }
+func (*ImportEntryResult) ProtoMessage()    {}
+func (*ImportEntryResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{14}
+}
+
+func (m *ImportEntryResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ImportEntryResult.Unmarshal(m, b)
+}
+func (m *ImportEntryResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ImportEntryResult.Marshal(b, m, deterministic)
+}
+func (m *ImportEntryResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ImportEntryResult.Merge(m, src)
+}
+func (m *ImportEntryResult) XXX_Size() int {
+	return xxx_messageInfo_ImportEntryResult.Size(m)
+}
+func (m *ImportEntryResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_ImportEntryResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ImportEntryResult proto.InternalMessageInfo
+
+func (m *ImportEntryResult) GetEntry() string {
+	if m != nil {
+		return m.Entry
+	}
+	return ""
+}
+
+func (m *ImportEntryResult) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *ImportEntryResult) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *ImportEntryResult) GetCode() int32 {
+	if m != nil {
+		return m.Code
+	}
+	return 0
+}
+
+func (m *ImportEntryResult) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type ImportArchiveResponse struct {
+	Entries              []*ImportEntryResult `protobuf:"bytes,1,rep,name=entries,proto3" json:"entries,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *ImportArchiveResponse) Reset()         { *m = ImportArchiveResponse{} }
+func (m *ImportArchiveResponse) String() string { return proto.CompactTextString(m) }
+func (*ImportArchiveResponse) ProtoMessage()    {}
+func (*ImportArchiveResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{15}
+}
+
+func (m *ImportArchiveResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ImportArchiveResponse.Unmarshal(m, b)
+}
+func (m *ImportArchiveResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ImportArchiveResponse.Marshal(b, m, deterministic)
+}
+func (m *ImportArchiveResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ImportArchiveResponse.Merge(m, src)
+}
+func (m *ImportArchiveResponse) XXX_Size() int {
+	return xxx_messageInfo_ImportArchiveResponse.Size(m)
+}
+func (m *ImportArchiveResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ImportArchiveResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ImportArchiveResponse proto.InternalMessageInfo
+
+func (m *ImportArchiveResponse) GetEntries() []*ImportEntryResult {
+	if m != nil {
+		return m.Entries
+	}
+	return nil
+}
+
+// for backing up and restoring the whole store; both need an admin token
+type BackupRequest struct {
+	// directory below the server's backup.dir; Backup names it after the
+	// current time if empty
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BackupRequest) Reset()         { *m = BackupRequest{} }
+func (m *BackupRequest) String() string { return proto.CompactTextString(m) }
+func (*BackupRequest) ProtoMessage()    {}
+func (*BackupRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{16}
+}
+
+func (m *BackupRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BackupRequest.Unmarshal(m, b)
+}
+func (m *BackupRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BackupRequest.Marshal(b, m, deterministic)
+}
+func (m *BackupRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BackupRequest.Merge(m, src)
+}
+func (m *BackupRequest) XXX_Size() int {
+	return xxx_messageInfo_BackupRequest.Size(m)
+}
+func (m *BackupRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_BackupRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BackupRequest proto.InternalMessageInfo
+
+func (m *BackupRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+type BackupInfo struct {
+	Name   string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Images int32  `protobuf:"varint,2,opt,name=images,proto3" json:"images,omitempty"`
+	Bytes  int64  `protobuf:"varint,3,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	// time of the snapshot in Unix nanoseconds
+	Created              int64    `protobuf:"varint,4,opt,name=created,proto3" json:"created,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BackupInfo) Reset()         { *m = BackupInfo{} }
+func (m *BackupInfo) String() string { return proto.CompactTextString(m) }
+func (*BackupInfo) ProtoMessage()    {}
+func (*BackupInfo) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{17}
+}
+
+func (m *BackupInfo) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BackupInfo.Unmarshal(m, b)
+}
+func (m *BackupInfo) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BackupInfo.Marshal(b, m, deterministic)
+}
+func (m *BackupInfo) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BackupInfo.Merge(m, src)
+}
+func (m *BackupInfo) XXX_Size() int {
+	return xxx_messageInfo_BackupInfo.Size(m)
+}
+func (m *BackupInfo) XXX_DiscardUnknown() {
+	xxx_messageInfo_BackupInfo.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BackupInfo proto.InternalMessageInfo
+
+func (m *BackupInfo) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *BackupInfo) GetImages() int32 {
+	if m != nil {
+		return m.Images
+	}
+	return 0
+}
+
+func (m *BackupInfo) GetBytes() int64 {
+	if m != nil {
+		return m.Bytes
+	}
+	return 0
+}
+
+func (m *BackupInfo) GetCreated() int64 {
+	if m != nil {
+		return m.Created
+	}
+	return 0
+}
+
+// result of re-encrypting the store with the primary master key; needs an
+// admin token
+type RotateKeysResult struct {
+	// images whose data key was wrapped again with the primary key
+	Rewrapped int32 `protobuf:"varint,1,opt,name=rewrapped,proto3" json:"rewrapped,omitempty"`
+	// images that were stored in plain and are now encrypted
+	Encrypted int32 `protobuf:"varint,2,opt,name=encrypted,proto3" json:"encrypted,omitempty"`
+	// images already using the primary key
+	Unchanged            int32    `protobuf:"varint,3,opt,name=unchanged,proto3" json:"unchanged,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RotateKeysResult) Reset()         { *m = RotateKeysResult{} }
+func (m *RotateKeysResult) String() string { return proto.CompactTextString(m) }
+func (*RotateKeysResult) ProtoMessage()    {}
+func (*RotateKeysResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8085f4b4731c381e, []int{18}
+}
+
+func (m *RotateKeysResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RotateKeysResult.Unmarshal(m, b)
+}
+func (m *RotateKeysResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RotateKeysResult.Marshal(b, m, deterministic)
+}
+func (m *RotateKeysResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RotateKeysResult.Merge(m, src)
+}
+func (m *RotateKeysResult) XXX_Size() int {
+	return xxx_messageInfo_RotateKeysResult.Size(m)
+}
+func (m *RotateKeysResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_RotateKeysResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RotateKeysResult proto.InternalMessageInfo
+
+func (m *RotateKeysResult) GetRewrapped() int32 {
+	if m != nil {
+		return m.Rewrapped
+	}
+	return 0
+}
+
+func (m *RotateKeysResult) GetEncrypted() int32 {
+	if m != nil {
+		return m.Encrypted
+	}
+	return 0
+}
+
+func (m *RotateKeysResult) GetUnchanged() int32 {
+	if m != nil {
+		return m.Unchanged
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterEnum("proto.ImageEvent_Type", ImageEvent_Type_name, ImageEvent_Type_value)
+	proto.RegisterEnum("proto.DownloadArchiveRequest_Format", DownloadArchiveRequest_Format_name, DownloadArchiveRequest_Format_value)
+	proto.RegisterType((*UploadImageRequest)(nil), "proto.UploadImageRequest")
+	proto.RegisterType((*ImageInfo)(nil), "proto.ImageInfo")
+	proto.RegisterType((*UploadImageResponse)(nil), "proto.UploadImageResponse")
+	proto.RegisterType((*ImageList)(nil), "proto.ImageList")
+	proto.RegisterType((*DownloadImageRequest)(nil), "proto.DownloadImageRequest")
+	proto.RegisterType((*DownloadImageResponse)(nil), "proto.DownloadImageResponse")
+	proto.RegisterType((*WatchImagesRequest)(nil), "proto.WatchImagesRequest")
+	proto.RegisterType((*ImageEvent)(nil), "proto.ImageEvent")
+	proto.RegisterType((*CreateShareLinkRequest)(nil), "proto.CreateShareLinkRequest")
+	proto.RegisterType((*ShareLink)(nil), "proto.ShareLink")
+	proto.RegisterType((*DownloadArchiveRequest)(nil), "proto.DownloadArchiveRequest")
+	proto.RegisterType((*ArchiveChunk)(nil), "proto.ArchiveChunk")
+	proto.RegisterType((*ImportArchiveRequest)(nil), "proto.ImportArchiveRequest")
+	proto.RegisterType((*ImportArchiveOptions)(nil), "proto.ImportArchiveOptions")
+	proto.RegisterType((*ImportEntryResult)(nil), "proto.ImportEntryResult")
+	proto.RegisterType((*ImportArchiveResponse)(nil), "proto.ImportArchiveResponse")
+	proto.RegisterType((*BackupRequest)(nil), "proto.BackupRequest")
+	proto.RegisterType((*BackupInfo)(nil), "proto.BackupInfo")
+	proto.RegisterType((*RotateKeysResult)(nil), "proto.RotateKeysResult")
+}
+
+func init() {
+	proto.RegisterFile("image_info.proto", fileDescriptor_8085f4b4731c381e)
+}
+
+var fileDescriptor_8085f4b4731c381e = []byte{
+	// 1104 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0xef, 0x6e, 0x1b, 0x45,
+	0x10, 0xf7, 0xf9, 0xcf, 0x19, 0x8f, 0xe3, 0xc4, 0xd9, 0xba, 0xc6, 0xb8, 0x69, 0x09, 0xdb, 0x0a,
+	0x45, 0xfd, 0xe0, 0x22, 0x57, 0x05, 0xa9, 0xa2, 0x54, 0x69, 0x6c, 0x88, 0x95, 0x28, 0xa9, 0x36,
+	0x29, 0x95, 0xfa, 0x25, 0xba, 0xf8, 0xd6, 0xf6, 0x29, 0xbe, 0xdb, 0x63, 0x6f, 0x9d, 0xc4, 0xf0,
+	0x1a, 0x08, 0x1e, 0x80, 0x27, 0xe2, 0x8d, 0xd0, 0xfe, 0xb9, 0xcb, 0xd9, 0xbe, 0x94, 0x80, 0xfa,
+	0xe9, 0xf6, 0x37, 0x33, 0x3b, 0x3b, 0xff, 0xe7, 0xa0, 0xee, 0xf9, 0xce, 0x98, 0x9e, 0x79, 0xc1,
+	0x88, 0x75, 0x42, 0xce, 0x04, 0x43, 0x25, 0xf5, 0x69, 0x3f, 0x1a, 0x33, 0x36, 0x9e, 0xd2, 0x67,
+	0x0a, 0x9d, 0xcf, 0x46, 0xcf, 0xae, 0xb8, 0x13, 0x86, 0x94, 0x47, 0x5a, 0xac, 0xfd, 0x60, 0x99,
+	0x4f, 0xfd, 0x50, 0xcc, 0x35, 0x13, 0xbb, 0x80, 0xde, 0x85, 0x53, 0xe6, 0xb8, 0x03, 0xa9, 0x9d,
+	0xd0, 0x5f, 0x66, 0x34, 0x12, 0xe8, 0x6b, 0x28, 0xca, 0x77, 0x5a, 0xd6, 0xb6, 0xb5, 0x53, 0xed,
+	0xd6, 0xb5, 0x6c, 0x47, 0x89, 0x0c, 0x82, 0x11, 0xdb, 0xcf, 0x11, 0xc5, 0x47, 0x8f, 0xa0, 0x32,
+	0x9c, 0xcc, 0x82, 0x0b, 0xd7, 0x11, 0x4e, 0x2b, 0xbf, 0x6d, 0xed, 0xac, 0xed, 0xe7, 0xc8, 0x0d,
+	0xe9, 0x8d, 0x0d, 0x45, 0xf9, 0xc5, 0x7f, 0x5a, 0x50, 0x49, 0x6e, 0x23, 0x04, 0xc5, 0xc0, 0xf1,
+	0xa9, 0xd2, 0x5e, 0x21, 0xea, 0x8c, 0x5a, 0x50, 0x1e, 0x72, 0xea, 0x08, 0xea, 0x2a, 0x3d, 0x15,
+	0x12, 0x43, 0xd4, 0x86, 0xcf, 0x7c, 0xe6, 0x7a, 0x23, 0x8f, 0xba, 0xad, 0x82, 0x62, 0x25, 0x58,
+	0x6a, 0x8a, 0xbc, 0x5f, 0x69, 0xab, 0xb8, 0x6d, 0xed, 0x14, 0x88, 0x3a, 0xa3, 0x06, 0x94, 0x7c,
+	0xe1, 0xf9, 0xb4, 0x55, 0x52, 0x44, 0x0d, 0x50, 0x13, 0xec, 0x68, 0xe2, 0x74, 0x5f, 0x7c, 0xdb,
+	0xb2, 0x95, 0x0e, 0x83, 0xf0, 0x2b, 0xb8, 0xb7, 0xe0, 0x7f, 0x14, 0xb2, 0x20, 0xa2, 0x99, 0x26,
+	0xc6, 0x8f, 0x49, 0xfb, 0x6a, 0xfa, 0x31, 0xfc, 0xc2, 0xf8, 0x75, 0xe8, 0x45, 0x02, 0xed, 0x80,
+	0xad, 0x72, 0x14, 0xb5, 0xac, 0xed, 0x42, 0x56, 0xdc, 0x88, 0xe1, 0xe3, 0xa7, 0xd0, 0xe8, 0xb1,
+	0xab, 0x60, 0x25, 0xee, 0x19, 0xcf, 0xe2, 0x31, 0xdc, 0x5f, 0x92, 0x35, 0x36, 0x7e, 0xea, 0x24,
+	0x1d, 0x03, 0x7a, 0xef, 0x88, 0xe1, 0x44, 0x69, 0x88, 0x62, 0x93, 0x9a, 0x60, 0x87, 0x9c, 0x8e,
+	0xbc, 0x6b, 0x63, 0x94, 0x41, 0xe8, 0x2b, 0x58, 0xe3, 0x34, 0x9a, 0xf9, 0xf4, 0x4c, 0xb0, 0x0b,
+	0x1a, 0x98, 0xac, 0x55, 0x35, 0xed, 0x54, 0x92, 0xf0, 0xdf, 0x16, 0x80, 0x52, 0xd6, 0xbf, 0xa4,
+	0x81, 0x40, 0x4f, 0xa1, 0x28, 0xe6, 0xa1, 0x76, 0x6e, 0xbd, 0xdb, 0x4c, 0xdb, 0xab, 0x04, 0x3a,
+	0xa7, 0xf3, 0x90, 0x12, 0x25, 0x83, 0x9e, 0x18, 0xdf, 0xf2, 0xd9, 0xbe, 0x19, 0xcf, 0x96, 0x6d,
+	0x28, 0xac, 0xd8, 0x20, 0x23, 0xaa, 0x8a, 0xc1, 0x54, 0x88, 0x3c, 0xe3, 0x97, 0x50, 0x94, 0x4f,
+	0xa1, 0x2a, 0x94, 0xdf, 0x1d, 0x1d, 0x1c, 0x1d, 0xbf, 0x3f, 0xaa, 0xe7, 0x24, 0xd8, 0x23, 0xfd,
+	0xdd, 0xd3, 0x7e, 0xaf, 0x6e, 0x29, 0xce, 0xdb, 0x9e, 0x02, 0x79, 0x09, 0x7a, 0xfd, 0xc3, 0xbe,
+	0x04, 0x05, 0xcc, 0xa1, 0xb9, 0xa7, 0x0a, 0xf3, 0x64, 0xe2, 0x70, 0x7a, 0xe8, 0x05, 0x17, 0x1f,
+	0xc9, 0x1d, 0xfa, 0x12, 0xaa, 0x42, 0x4c, 0xcf, 0x22, 0x3a, 0x64, 0x81, 0x1b, 0x29, 0x6f, 0x0a,
+	0x04, 0x84, 0x98, 0x9e, 0x68, 0x0a, 0x7a, 0x0c, 0x35, 0xdf, 0xb9, 0x3e, 0x73, 0x4d, 0x82, 0x23,
+	0xe5, 0x42, 0x89, 0xac, 0xf9, 0xce, 0x75, 0x9c, 0xf4, 0x08, 0xff, 0x61, 0x41, 0x25, 0x79, 0x0e,
+	0xad, 0x43, 0xde, 0x73, 0xcd, 0x2b, 0x79, 0xcf, 0x95, 0xf5, 0x9e, 0xce, 0x80, 0x06, 0xa8, 0x0e,
+	0x85, 0x19, 0x9f, 0x9a, 0x88, 0xc8, 0x63, 0x62, 0x5f, 0x71, 0xb1, 0xeb, 0xe8, 0x75, 0xe8, 0x71,
+	0x1a, 0x99, 0x6e, 0x89, 0xe1, 0xaa, 0x61, 0x76, 0x86, 0x61, 0x7f, 0x59, 0xd0, 0x8c, 0xd1, 0x2e,
+	0x1f, 0x4e, 0xbc, 0xcb, 0xa4, 0x92, 0x1b, 0x50, 0x92, 0x2f, 0xe8, 0x56, 0xa8, 0x10, 0x0d, 0x52,
+	0xc5, 0x94, 0x5f, 0x28, 0xa6, 0xef, 0xc1, 0x1e, 0x31, 0xee, 0x3b, 0x42, 0x19, 0xbc, 0xde, 0x7d,
+	0x62, 0x12, 0x9e, 0xad, 0xbc, 0xf3, 0xa3, 0x92, 0x25, 0xe6, 0x0e, 0x7e, 0x08, 0xb6, 0xa6, 0xa0,
+	0x32, 0x14, 0x3e, 0x0c, 0xde, 0xd6, 0x73, 0x08, 0xc0, 0x3e, 0xdd, 0x25, 0x67, 0x3f, 0x7d, 0xa8,
+	0x5b, 0x18, 0xc3, 0x9a, 0xb9, 0xbf, 0x27, 0x6b, 0x1e, 0x21, 0x5d, 0xef, 0x2a, 0x84, 0x6b, 0x44,
+	0x9d, 0xf1, 0x15, 0x34, 0x06, 0x7e, 0xc8, 0xb8, 0x58, 0x72, 0xe3, 0x3b, 0x28, 0xb3, 0x50, 0x78,
+	0x2c, 0x88, 0x4c, 0x9b, 0x3d, 0x48, 0x4a, 0x31, 0x25, 0x7d, 0xac, 0x45, 0xf6, 0x73, 0x24, 0x96,
+	0xbe, 0x73, 0xd3, 0x75, 0xa0, 0x91, 0xa5, 0xea, 0xb6, 0xb6, 0xc3, 0xbf, 0xc1, 0xa6, 0x96, 0xef,
+	0x07, 0x82, 0xcf, 0x09, 0x8d, 0x66, 0x53, 0x15, 0x6c, 0x2a, 0xa1, 0x91, 0xd5, 0x20, 0x49, 0x78,
+	0x3e, 0x63, 0x86, 0x15, 0x52, 0x03, 0x13, 0x41, 0x71, 0xc8, 0x5c, 0x5d, 0x18, 0x25, 0xa2, 0xce,
+	0x4a, 0x23, 0xe7, 0x8c, 0xb7, 0x4a, 0x46, 0xa3, 0x04, 0xf8, 0x00, 0xee, 0x2f, 0x45, 0xc9, 0x8c,
+	0xa2, 0x2e, 0x94, 0xe5, 0x9b, 0x5e, 0x32, 0xfa, 0x5a, 0x0b, 0x61, 0x4a, 0xd9, 0x4a, 0x62, 0x41,
+	0xfc, 0x18, 0x6a, 0x6f, 0x9c, 0xe1, 0xc5, 0x2c, 0xfc, 0xd8, 0xf0, 0x9b, 0x00, 0x68, 0xa1, 0x5b,
+	0x17, 0x47, 0x33, 0x19, 0xba, 0x79, 0x65, 0xbf, 0x41, 0xd2, 0x83, 0xf3, 0xb9, 0xa0, 0x91, 0x71,
+	0x55, 0x83, 0xf4, 0x9a, 0xd1, 0x13, 0x21, 0x86, 0x78, 0x0a, 0x75, 0xc2, 0x84, 0x23, 0xe8, 0x01,
+	0x9d, 0x47, 0x26, 0xae, 0x5b, 0x50, 0xe1, 0x54, 0x6f, 0x53, 0xdd, 0x71, 0x25, 0x72, 0x43, 0x90,
+	0x5c, 0x1a, 0x0c, 0xf9, 0x3c, 0x8c, 0x97, 0x56, 0x89, 0xdc, 0x10, 0x24, 0x77, 0x16, 0x0c, 0x27,
+	0x4e, 0x30, 0x36, 0x7b, 0xab, 0x44, 0x6e, 0x08, 0xdd, 0xdf, 0xcb, 0x80, 0xd4, 0x34, 0xd3, 0xcb,
+	0xe7, 0x84, 0xf2, 0x4b, 0x6f, 0x48, 0xd1, 0x3e, 0x54, 0x53, 0xdb, 0x08, 0x7d, 0x61, 0xa2, 0xb8,
+	0xba, 0xa1, 0xdb, 0xed, 0x2c, 0x96, 0xce, 0x06, 0xce, 0xed, 0x58, 0xe8, 0x07, 0x00, 0xb9, 0x93,
+	0x06, 0x3a, 0x18, 0x5b, 0x1d, 0xfd, 0x0f, 0xd0, 0x89, 0xff, 0x01, 0x3a, 0x27, 0x82, 0x7b, 0xc1,
+	0xf8, 0x67, 0x67, 0x3a, 0xa3, 0xed, 0x85, 0xf1, 0x2a, 0x6f, 0xe1, 0x1c, 0x3a, 0x86, 0xda, 0xc2,
+	0xd6, 0xf9, 0x17, 0x15, 0x5b, 0x4b, 0x0d, 0xbb, 0x64, 0xd0, 0x37, 0x16, 0x7a, 0x05, 0x95, 0x13,
+	0xe1, 0x88, 0xbb, 0x28, 0x5b, 0x19, 0xf7, 0x38, 0x87, 0xfa, 0x50, 0xed, 0xd1, 0x29, 0x15, 0xf4,
+	0x2e, 0x0a, 0x9a, 0x2b, 0xdc, 0xbe, 0xfc, 0xe5, 0xc1, 0x39, 0xf4, 0x1a, 0xaa, 0xa9, 0x1d, 0x97,
+	0x04, 0x78, 0x75, 0xef, 0xb5, 0x37, 0x57, 0xf6, 0x93, 0x72, 0xa3, 0x07, 0x1b, 0x4b, 0xf3, 0x1f,
+	0x3d, 0x34, 0x92, 0xd9, 0x7b, 0x21, 0xf1, 0x26, 0x61, 0xe0, 0x1c, 0x1a, 0xc0, 0x06, 0xa1, 0x97,
+	0xec, 0x22, 0xa5, 0xe5, 0xff, 0x7a, 0x34, 0x80, 0x8d, 0xa5, 0x29, 0x99, 0x18, 0x94, 0x3d, 0x3d,
+	0xdb, 0xf7, 0x0c, 0x3b, 0x3d, 0x14, 0x95, 0x6f, 0x47, 0x50, 0x5b, 0x68, 0x6f, 0x94, 0x39, 0xec,
+	0x62, 0x35, 0x5b, 0xd9, 0xcc, 0x54, 0x0d, 0x3e, 0x07, 0x5b, 0x37, 0x2f, 0x6a, 0x18, 0xd9, 0x85,
+	0x86, 0x6f, 0x6f, 0x2e, 0x50, 0x4d, 0xa2, 0x5f, 0x42, 0x8d, 0xd0, 0x48, 0x30, 0x4e, 0xff, 0xfb,
+	0xdd, 0xd7, 0x00, 0x37, 0x3d, 0x8c, 0x6e, 0x89, 0x59, 0xfb, 0x73, 0x73, 0x75, 0xb9, 0xdd, 0x71,
+	0xee, 0xdc, 0x56, 0x9c, 0xe7, 0xff, 0x0c, 0x00, 0xee, 0x86, 0x00, 0x84, 0x6c, 0x0b, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// ImageUploadServiceClient is the client API for ImageUploadService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ImageUploadServiceClient interface {
+	UploadImage(ctx context.Context, opts ...grpc.CallOption) (ImageUploadService_UploadImageClient, error)
+	ListImages(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*ImageList, error)
+	DownloadImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (ImageUploadService_DownloadImageClient, error)
+	StatImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*ImageInfo, error)
+	DeleteImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*empty.Empty, error)
+	WatchImages(ctx context.Context, in *WatchImagesRequest, opts ...grpc.CallOption) (ImageUploadService_WatchImagesClient, error)
+	CreateShareLink(ctx context.Context, in *CreateShareLinkRequest, opts ...grpc.CallOption) (*ShareLink, error)
+	// takes the link id
+	RevokeShareLink(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*empty.Empty, error)
+	DownloadArchive(ctx context.Context, in *DownloadArchiveRequest, opts ...grpc.CallOption) (ImageUploadService_DownloadArchiveClient, error)
+	ImportArchive(ctx context.Context, opts ...grpc.CallOption) (ImageUploadService_ImportArchiveClient, error)
+	Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupInfo, error)
+	// restores into a server without images
+	RestoreBackup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupInfo, error)
+	RotateKeys(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*RotateKeysResult, error)
+}
+
+type imageUploadServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewImageUploadServiceClient(cc grpc.ClientConnInterface) ImageUploadServiceClient {
+	return &imageUploadServiceClient{cc}
+}
+
+func (c *imageUploadServiceClient) UploadImage(ctx context.Context, opts ...grpc.CallOption) (ImageUploadService_UploadImageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ImageUploadService_serviceDesc.Streams[0], "/proto.ImageUploadService/UploadImage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &imageUploadServiceUploadImageClient{stream}
+	return x, nil
+}
+
+type ImageUploadService_UploadImageClient interface {
+	Send(*UploadImageRequest) error
+	CloseAndRecv() (*UploadImageResponse, error)
+	grpc.ClientStream
+}
+
+type imageUploadServiceUploadImageClient struct {
+	grpc.ClientStream
+}
+
+func (x *imageUploadServiceUploadImageClient) Send(m *UploadImageRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *imageUploadServiceUploadImageClient) CloseAndRecv() (*UploadImageResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadImageResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *imageUploadServiceClient) ListImages(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*ImageList, error) {
+	out := new(ImageList)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/ListImages", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageUploadServiceClient) DownloadImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (ImageUploadService_DownloadImageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ImageUploadService_serviceDesc.Streams[1], "/proto.ImageUploadService/DownloadImage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &imageUploadServiceDownloadImageClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ImageUploadService_DownloadImageClient interface {
+	Recv() (*DownloadImageResponse, error)
+	grpc.ClientStream
+}
+
+type imageUploadServiceDownloadImageClient struct {
+	grpc.ClientStream
+}
+
+func (x *imageUploadServiceDownloadImageClient) Recv() (*DownloadImageResponse, error) {
+	m := new(DownloadImageResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *imageUploadServiceClient) StatImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*ImageInfo, error) {
+	out := new(ImageInfo)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/StatImage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageUploadServiceClient) DeleteImage(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/DeleteImage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageUploadServiceClient) WatchImages(ctx context.Context, in *WatchImagesRequest, opts ...grpc.CallOption) (ImageUploadService_WatchImagesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ImageUploadService_serviceDesc.Streams[2], "/proto.ImageUploadService/WatchImages", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &imageUploadServiceWatchImagesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ImageUploadService_WatchImagesClient interface {
+	Recv() (*ImageEvent, error)
+	grpc.ClientStream
+}
+
+type imageUploadServiceWatchImagesClient struct {
+	grpc.ClientStream
+}
+
+func (x *imageUploadServiceWatchImagesClient) Recv() (*ImageEvent, error) {
+	m := new(ImageEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *imageUploadServiceClient) CreateShareLink(ctx context.Context, in *CreateShareLinkRequest, opts ...grpc.CallOption) (*ShareLink, error) {
+	out := new(ShareLink)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/CreateShareLink", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageUploadServiceClient) RevokeShareLink(ctx context.Context, in *wrappers.StringValue, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/RevokeShareLink", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageUploadServiceClient) DownloadArchive(ctx context.Context, in *DownloadArchiveRequest, opts ...grpc.CallOption) (ImageUploadService_DownloadArchiveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ImageUploadService_serviceDesc.Streams[3], "/proto.ImageUploadService/DownloadArchive", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &imageUploadServiceDownloadArchiveClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ImageUploadService_DownloadArchiveClient interface {
+	Recv() (*ArchiveChunk, error)
+	grpc.ClientStream
+}
+
+type imageUploadServiceDownloadArchiveClient struct {
+	grpc.ClientStream
+}
+
+func (x *imageUploadServiceDownloadArchiveClient) Recv() (*ArchiveChunk, error) {
+	m := new(ArchiveChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *imageUploadServiceClient) ImportArchive(ctx context.Context, opts ...grpc.CallOption) (ImageUploadService_ImportArchiveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ImageUploadService_serviceDesc.Streams[4], "/proto.ImageUploadService/ImportArchive", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &imageUploadServiceImportArchiveClient{stream}
+	return x, nil
+}
+
+type ImageUploadService_ImportArchiveClient interface {
+	Send(*ImportArchiveRequest) error
+	CloseAndRecv() (*ImportArchiveResponse, error)
+	grpc.ClientStream
+}
+
+type imageUploadServiceImportArchiveClient struct {
+	grpc.ClientStream
+}
+
+func (x *imageUploadServiceImportArchiveClient) Send(m *ImportArchiveRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *imageUploadServiceImportArchiveClient) CloseAndRecv() (*ImportArchiveResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportArchiveResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *imageUploadServiceClient) Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupInfo, error) {
+	out := new(BackupInfo)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/Backup", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageUploadServiceClient) RestoreBackup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupInfo, error) {
+	out := new(BackupInfo)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/RestoreBackup", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageUploadServiceClient) RotateKeys(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*RotateKeysResult, error) {
+	out := new(RotateKeysResult)
+	err := c.cc.Invoke(ctx, "/proto.ImageUploadService/RotateKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ImageUploadServiceServer is the server API for ImageUploadService service.
+type ImageUploadServiceServer interface {
+	UploadImage(ImageUploadService_UploadImageServer) error
+	ListImages(context.Context, *wrappers.StringValue) (*ImageList, error)
+	DownloadImage(*wrappers.StringValue, ImageUploadService_DownloadImageServer) error
+	StatImage(context.Context, *wrappers.StringValue) (*ImageInfo, error)
+	DeleteImage(context.Context, *wrappers.StringValue) (*empty.Empty, error)
+	WatchImages(*WatchImagesRequest, ImageUploadService_WatchImagesServer) error
+	CreateShareLink(context.Context, *CreateShareLinkRequest) (*ShareLink, error)
+	// takes the link id
+	RevokeShareLink(context.Context, *wrappers.StringValue) (*empty.Empty, error)
+	DownloadArchive(*DownloadArchiveRequest, ImageUploadService_DownloadArchiveServer) error
+	ImportArchive(ImageUploadService_ImportArchiveServer) error
+	Backup(context.Context, *BackupRequest) (*BackupInfo, error)
+	// restores into a server without images
+	RestoreBackup(context.Context, *BackupRequest) (*BackupInfo, error)
+	RotateKeys(context.Context, *empty.Empty) (*RotateKeysResult, error)
+}
+
+// UnimplementedImageUploadServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedImageUploadServiceServer struct {
+}
+
+func (*UnimplementedImageUploadServiceServer) UploadImage(srv ImageUploadService_UploadImageServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadImage not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) ListImages(ctx context.Context, req *wrappers.StringValue) (*ImageList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListImages not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) DownloadImage(req *wrappers.StringValue, srv ImageUploadService_DownloadImageServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadImage not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) StatImage(ctx context.Context, req *wrappers.StringValue) (*ImageInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StatImage not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) DeleteImage(ctx context.Context, req *wrappers.StringValue) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteImage not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) WatchImages(req *WatchImagesRequest, srv ImageUploadService_WatchImagesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchImages not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) CreateShareLink(ctx context.Context, req *CreateShareLinkRequest) (*ShareLink, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateShareLink not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) RevokeShareLink(ctx context.Context, req *wrappers.StringValue) (*empty.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeShareLink not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) DownloadArchive(req *DownloadArchiveRequest, srv ImageUploadService_DownloadArchiveServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadArchive not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) ImportArchive(srv ImageUploadService_ImportArchiveServer) error {
+	return status.Errorf(codes.Unimplemented, "method ImportArchive not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) Backup(ctx context.Context, req *BackupRequest) (*BackupInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Backup not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) RestoreBackup(ctx context.Context, req *BackupRequest) (*BackupInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreBackup not implemented")
+}
+func (*UnimplementedImageUploadServiceServer) RotateKeys(ctx context.Context, req *empty.Empty) (*RotateKeysResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateKeys not implemented")
+}
+
+func RegisterImageUploadServiceServer(s *grpc.Server, srv ImageUploadServiceServer) {
+	s.RegisterService(&_ImageUploadService_serviceDesc, srv)
+}
+
+func _ImageUploadService_UploadImage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ImageUploadServiceServer).UploadImage(&imageUploadServiceUploadImageServer{stream})
+}
+
+type ImageUploadService_UploadImageServer interface {
+	SendAndClose(*UploadImageResponse) error
+	Recv() (*UploadImageRequest, error)
+	grpc.ServerStream
+}
+
+type imageUploadServiceUploadImageServer struct {
+	grpc.ServerStream
+}
+
+func (x *imageUploadServiceUploadImageServer) SendAndClose(m *UploadImageResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *imageUploadServiceUploadImageServer) Recv() (*UploadImageRequest, error) {
+	m := new(UploadImageRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ImageUploadService_ListImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrappers.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).ListImages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/ListImages",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).ListImages(ctx, req.(*wrappers.StringValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageUploadService_DownloadImage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(wrappers.StringValue)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ImageUploadServiceServer).DownloadImage(m, &imageUploadServiceDownloadImageServer{stream})
+}
+
+type ImageUploadService_DownloadImageServer interface {
+	Send(*DownloadImageResponse) error
+	grpc.ServerStream
+}
+
+type imageUploadServiceDownloadImageServer struct {
+	grpc.ServerStream
+}
+
+func (x *imageUploadServiceDownloadImageServer) Send(m *DownloadImageResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ImageUploadService_StatImage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrappers.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).StatImage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/StatImage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).StatImage(ctx, req.(*wrappers.StringValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageUploadService_DeleteImage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrappers.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).DeleteImage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/DeleteImage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).DeleteImage(ctx, req.(*wrappers.StringValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageUploadService_WatchImages_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchImagesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ImageUploadServiceServer).WatchImages(m, &imageUploadServiceWatchImagesServer{stream})
+}
+
+type ImageUploadService_WatchImagesServer interface {
+	Send(*ImageEvent) error
+	grpc.ServerStream
+}
+
+type imageUploadServiceWatchImagesServer struct {
+	grpc.ServerStream
+}
+
+func (x *imageUploadServiceWatchImagesServer) Send(m *ImageEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ImageUploadService_CreateShareLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateShareLinkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).CreateShareLink(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/CreateShareLink",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).CreateShareLink(ctx, req.(*CreateShareLinkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageUploadService_RevokeShareLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrappers.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).RevokeShareLink(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/RevokeShareLink",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).RevokeShareLink(ctx, req.(*wrappers.StringValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageUploadService_DownloadArchive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadArchiveRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ImageUploadServiceServer).DownloadArchive(m, &imageUploadServiceDownloadArchiveServer{stream})
+}
+
+type ImageUploadService_DownloadArchiveServer interface {
+	Send(*ArchiveChunk) error
+	grpc.ServerStream
+}
+
+type imageUploadServiceDownloadArchiveServer struct {
+	grpc.ServerStream
+}
+
+func (x *imageUploadServiceDownloadArchiveServer) Send(m *ArchiveChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ImageUploadService_ImportArchive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ImageUploadServiceServer).ImportArchive(&imageUploadServiceImportArchiveServer{stream})
+}
+
+type ImageUploadService_ImportArchiveServer interface {
+	SendAndClose(*ImportArchiveResponse) error
+	Recv() (*ImportArchiveRequest, error)
+	grpc.ServerStream
+}
+
+type imageUploadServiceImportArchiveServer struct {
+	grpc.ServerStream
+}
+
+func (x *imageUploadServiceImportArchiveServer) SendAndClose(m *ImportArchiveResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *imageUploadServiceImportArchiveServer) Recv() (*ImportArchiveRequest, error) {
+	m := new(ImportArchiveRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ImageUploadService_Backup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).Backup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/Backup",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).Backup(ctx, req.(*BackupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageUploadService_RestoreBackup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).RestoreBackup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/RestoreBackup",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).RestoreBackup(ctx, req.(*BackupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageUploadService_RotateKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageUploadServiceServer).RotateKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.ImageUploadService/RotateKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageUploadServiceServer).RotateKeys(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _ImageUploadService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "proto.ImageUploadService",
+	HandlerType: (*ImageUploadServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListImages",
+			Handler:    _ImageUploadService_ListImages_Handler,
+		},
+		{
+			MethodName: "StatImage",
+			Handler:    _ImageUploadService_StatImage_Handler,
+		},
+		{
+			MethodName: "DeleteImage",
+			Handler:    _ImageUploadService_DeleteImage_Handler,
+		},
+		{
+			MethodName: "CreateShareLink",
+			Handler:    _ImageUploadService_CreateShareLink_Handler,
+		},
+		{
+			MethodName: "RevokeShareLink",
+			Handler:    _ImageUploadService_RevokeShareLink_Handler,
+		},
+		{
+			MethodName: "Backup",
+			Handler:    _ImageUploadService_Backup_Handler,
+		},
+		{
+			MethodName: "RestoreBackup",
+			Handler:    _ImageUploadService_RestoreBackup_Handler,
+		},
+		{
+			MethodName: "RotateKeys",
+			Handler:    _ImageUploadService_RotateKeys_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "UploadImage",
 			Handler:       _ImageUploadService_UploadImage_Handler,
@@ -615,6 +1951,21 @@ var _ImageUploadService_serviceDesc = grpc.ServiceDesc{
 			Handler:       _ImageUploadService_DownloadImage_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "WatchImages",
+			Handler:       _ImageUploadService_WatchImages_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "DownloadArchive",
+			Handler:       _ImageUploadService_DownloadArchive_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ImportArchive",
+			Handler:       _ImageUploadService_ImportArchive_Handler,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "image_info.proto",
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	pb "tages/service/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DownloadArchive streams the selected images as a zip or tar.gz archive.
+// The archive is built while it is sent, one image after the other, so it
+// never sits on disk or in memory. Named images must all exist before
+// anything is sent; images matching a prefix that are deleted meanwhile are
+// left out.
+func (s *server) DownloadArchive(req *pb.DownloadArchiveRequest, stream pb.ImageUploadService_DownloadArchiveServer) (err error) {
+	ctx := stream.Context()
+	if len(req.GetNames()) > 0 && req.GetPrefix() != "" {
+		return status.Error(codes.InvalidArgument, "names and prefix cannot be used together")
+	}
+	files, err := s.archiveFiles(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	done := s.stats.begin()
+	tl := newTransferLog(ctx)
+	if len(req.GetNames()) > 0 {
+		tl.setName(fmt.Sprintf("archive of %d images", len(files)))
+	} else {
+		tl.setName("archive of " + req.GetPrefix() + "*")
+	}
+	defer func() {
+		done(err)
+		tl.finish(err)
+	}()
+
+	return withStallTimeout(ctx, s.cfg.Limits.StallTimeout, tl.progress, func(ctx context.Context) error {
+		cw := &chunkSender{stream: stream, buf: make([]byte, 0, s.cfg.ChunkSize), tl: tl}
+		var err error
+		switch req.GetFormat() {
+		case pb.DownloadArchiveRequest_ZIP:
+			err = s.writeZip(ctx, cw, files, req.GetPrefix() != "")
+		case pb.DownloadArchiveRequest_TAR_GZ:
+			err = s.writeTarGz(ctx, cw, files, req.GetPrefix() != "")
+		default:
+			err = status.Errorf(codes.InvalidArgument, "unknown archive format %v", req.GetFormat())
+		}
+		if err == nil {
+			err = cw.flush()
+		}
+		return err
+	})
+}
+
+// archiveFiles returns the images selected by req, without duplicates.
+func (s *server) archiveFiles(ctx context.Context, req *pb.DownloadArchiveRequest) ([]os.FileInfo, error) {
+	if len(req.GetNames()) == 0 {
+		files, err := s.store.list(ctx, req.GetPrefix())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot list images: %v", err)
+		}
+		return files, nil
+	}
+	seen := make(map[string]bool)
+	var files []os.FileInfo
+	for _, name := range req.GetNames() {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		info, err := s.store.stat(ctx, name)
+		if err != nil {
+			return nil, storageError(err, name, "cannot stat image")
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// openEntry opens an image to add to the archive. It returns a nil file if
+// skipMissing is set and the image no longer exists.
+func (s *server) openEntry(ctx context.Context, name string, skipMissing bool) (io.ReadCloser, os.FileInfo, error) {
+	f, info, err := s.store.open(ctx, name)
+	if err != nil {
+		if skipMissing && os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, storageError(err, name, "cannot open image file")
+	}
+	return f, info, nil
+}
+
+func (s *server) writeZip(ctx context.Context, w io.Writer, files []os.FileInfo, skipMissing bool) error {
+	zw := zip.NewWriter(w)
+	for _, fi := range files {
+		f, info, err := s.openEntry(ctx, fi.Name(), skipMissing)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			continue
+		}
+		ew, err := zw.CreateHeader(&zip.FileHeader{Name: fi.Name(), Method: zip.Deflate, Modified: info.ModTime()})
+		if err == nil {
+			_, err = io.CopyN(ew, f, info.Size())
+		}
+		f.Close()
+		if err != nil {
+			return archiveError(err, fi.Name())
+		}
+	}
+	return archiveError(zw.Close(), "")
+}
+
+func (s *server) writeTarGz(ctx context.Context, w io.Writer, files []os.FileInfo, skipMissing bool) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, fi := range files {
+		f, info, err := s.openEntry(ctx, fi.Name(), skipMissing)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			continue
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     fi.Name(),
+			Size:     info.Size(),
+			Mode:     0644,
+			ModTime:  info.ModTime(),
+		})
+		if err == nil {
+			_, err = io.CopyN(tw, f, info.Size())
+		}
+		f.Close()
+		if err != nil {
+			return archiveError(err, fi.Name())
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return archiveError(err, "")
+	}
+	return archiveError(gz.Close(), "")
+}
+
+// archiveError passes on the errors of the stream, which already carry a
+// status, and reports the others as failures to read an image.
+func archiveError(err error, name string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Internal, "cannot add %s to the archive: %v", name, err)
+}
+
+// chunkSender cuts the archive into messages of the configured chunk size.
+type chunkSender struct {
+	stream pb.ImageUploadService_DownloadArchiveServer
+	buf    []byte
+	tl     *transferLog
+}
+
+func (c *chunkSender) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+k]
+		p = p[k:]
+		if len(c.buf) == cap(c.buf) {
+			if err := c.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkSender) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	if err := c.stream.Send(&pb.ArchiveChunk{Data: c.buf}); err != nil {
+		return status.Errorf(codes.Unavailable, "cannot send archive to the client: %v", err)
+	}
+	bytesDownloaded.Add(float64(len(c.buf)))
+	c.tl.add(len(c.buf))
+	c.buf = c.buf[:0]
+	return nil
+}
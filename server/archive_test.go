@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+
+	pb "tages/service/proto"
+)
+
+func downloadArchive(ctx context.Context, c pb.ImageUploadServiceClient, req *pb.DownloadArchiveRequest) ([]byte, error) {
+	stream, err := c.DownloadArchive(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(chunk.GetData())
+	}
+}
+
+func readZip(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("cannot open zip archive: %v", err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("cannot read %s: %v", f.Name, err)
+		}
+		files[f.Name] = string(b)
+	}
+	return files
+}
+
+func readTarGz(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cannot open tar.gz archive: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("cannot read tar.gz archive: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(b)
+	}
+	// the gzip trailer is checked once the stream is read to the end
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		t.Fatalf("cannot read tar.gz archive: %v", err)
+	}
+	return files
+}
+
+func TestArchive(t *testing.T) {
+	_, c := newTestServer(t, nil)
+	ctx := context.Background()
+	mustUpload(t, ctx, c, "a/1.img", []byte("one"))
+	mustUpload(t, ctx, c, "a/2.img", []byte("two"))
+	mustUpload(t, ctx, c, "b.img", []byte("three"))
+
+	data, err := downloadArchive(ctx, c, &pb.DownloadArchiveRequest{Prefix: "a/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readZip(t, data); len(got) != 2 || got["a/1.img"] != "one" || got["a/2.img"] != "two" {
+		t.Fatalf("zip holds %v", got)
+	}
+	data, err = downloadArchive(ctx, c, &pb.DownloadArchiveRequest{Names: []string{"b.img", "a/1.img", "b.img"}, Format: pb.DownloadArchiveRequest_TAR_GZ})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTarGz(t, data); len(got) != 2 || got["b.img"] != "three" || got["a/1.img"] != "one" {
+		t.Fatalf("tar.gz holds %v", got)
+	}
+
+	_, err = downloadArchive(ctx, c, &pb.DownloadArchiveRequest{Names: []string{"a/1.img", "missing.img"}})
+	wantCode(t, err, codes.NotFound, "missing.img")
+}
+
+func TestArchiveSkipsImagesDeletedMeanwhile(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	ctx := context.Background()
+	mustUpload(t, ctx, c, "a/1.img", []byte("one"))
+	mustUpload(t, ctx, c, "a/3.img", []byte("three"))
+
+	for _, format := range []string{"zip", "tar.gz"} {
+		t.Run(format, func(t *testing.T) {
+			mustUpload(t, ctx, c, "a/2.img", []byte("two"))
+			files, err := srv.archiveFiles(ctx, &pb.DownloadArchiveRequest{Prefix: "a/"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// deleted once the archive lists it, but before it is written
+			if err := srv.store.remove(ctx, "a/2.img"); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			var got map[string]string
+			if format == "zip" {
+				err = srv.writeZip(ctx, &buf, files, true)
+				got = readZip(t, buf.Bytes())
+			} else {
+				err = srv.writeTarGz(ctx, &buf, files, true)
+				got = readTarGz(t, buf.Bytes())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 || got["a/1.img"] != "one" || got["a/3.img"] != "three" {
+				t.Fatalf("archive holds %v", got)
+			}
+		})
+	}
+}
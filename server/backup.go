@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	pb "tages/service/proto"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A backup is a directory below backup.dir holding
+//
+//	manifest.json        every image with its size, mtime, SHA-256 and
+//	                     whether it is encrypted
+//	blobs/<sha256>       the content of the plain images, stored once per digest
+//	blobs/<sha256>.enc   the encrypted images, copied as they are stored
+//
+// Only the images are kept: digests are part of the manifest, while share
+// links and the event log are not backed up.
+const (
+	backupManifest = "manifest.json"
+	backupBlobs    = "blobs"
+	backupVersion  = 1
+)
+
+type manifest struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Images  []backupImage `json:"images"`
+}
+
+type backupImage struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+	// Encrypted is set for images encrypted at rest
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// backupDir returns the directory of the backup called name.
+func (s *server) backupDir(name string) (string, error) {
+	if s.cfg.Backup.Dir == "" {
+		return "", status.Error(codes.FailedPrecondition, "backups are disabled: backup.dir is not set")
+	}
+	if !validName(name) || strings.Contains(name, "/") {
+		return "", status.Errorf(codes.InvalidArgument, "invalid backup name %q", name)
+	}
+	return filepath.Join(s.cfg.Backup.Dir, name), nil
+}
+
+// Backup writes a point-in-time copy of the store to backup.dir. Uploads
+// and deletions wait only while the snapshot is taken, which hard-links the
+// images without copying them; the copy is then made from the links. The
+// backup appears under its name once complete.
+func (s *server) Backup(ctx context.Context, req *pb.BackupRequest) (*pb.BackupInfo, error) {
+	name := req.GetName()
+	if name == "" {
+		name = time.Now().UTC().Format("20060102T150405Z")
+	}
+	dir, err := s.backupDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "backup %q already exists", name)
+	}
+	if err := os.MkdirAll(s.cfg.Backup.Dir, 0700); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create backup directory: %v", err)
+	}
+	tmp := filepath.Join(s.cfg.Backup.Dir, "."+name+".partial")
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, backupBlobs), 0700); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create backup directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	snap, entries, err := s.store.snapshot(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot take snapshot: %v", err)
+	}
+	defer os.RemoveAll(snap)
+	m := manifest{Version: backupVersion, Created: time.Now().UTC(), Images: make([]backupImage, 0, len(entries))}
+
+	var bytes int64
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, status.FromContextError(err).Err()
+		}
+		sum, err := s.store.copyBlob(e.path, filepath.Join(tmp, backupBlobs), e.encrypted)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot back up %s: %v", e.name, err)
+		}
+		m.Images = append(m.Images, backupImage{Name: e.name, Size: e.info.Size(), ModTime: e.info.ModTime().UTC(), SHA256: sum, Encrypted: e.encrypted})
+		bytes += e.info.Size()
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(tmp, backupManifest), data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot write backup: %v", err)
+	}
+	loggerFrom(ctx).Info("backup written", "backup", name, "images", len(m.Images), "bytes", bytes)
+	return &pb.BackupInfo{Name: name, Images: int32(len(m.Images)), Bytes: bytes, Created: m.Created.UnixNano()}, nil
+}
+
+// copyBlob copies the file at src into blobs, named after the SHA-256 of its
+// content. Encrypted images are copied as they are, so backups stay
+// encrypted, and read back to compute the digest.
+func (st *storage) copyBlob(src, blobs string, encrypted bool) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(blobs, ".*.partial")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	sum, err := st.blobDigest(out.Name(), encrypted)
+	if err != nil {
+		return "", err
+	}
+	return sum, os.Rename(out.Name(), filepath.Join(blobs, blobName(sum, encrypted)))
+}
+
+// blobName returns the name of the blob of an image with the given digest.
+func blobName(sum string, encrypted bool) string {
+	if encrypted {
+		return sum + ".enc"
+	}
+	return sum
+}
+
+func (st *storage) blobDigest(p string, encrypted bool) (string, error) {
+	r, _, err := st.openBlob(p, encrypted)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openBlob returns the content of a backup blob, decrypted if it is
+// encrypted.
+func (st *storage) openBlob(p string, encrypted bool) (io.ReadCloser, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	r, size, err := st.reader(f, info, encrypted)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return r, size, nil
+}
+
+// RestoreBackup stores the images of a backup in a server that has none,
+// checking every image against the digest of the manifest. Changes are
+// blocked while it runs, and nothing is kept if it fails. Events are
+// published once all images are restored.
+func (s *server) RestoreBackup(ctx context.Context, req *pb.BackupRequest) (*pb.BackupInfo, error) {
+	name := req.GetName()
+	dir, err := s.backupDir(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, backupManifest))
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "backup %q not found", name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot read backup manifest: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, status.Errorf(codes.DataLoss, "invalid backup manifest: %v", err)
+	}
+	if m.Version != backupVersion {
+		return nil, status.Errorf(codes.FailedPrecondition, "unsupported backup version %d", m.Version)
+	}
+
+	s.store.changes.Lock()
+	restored, bytes, err := s.restoreImages(ctx, dir, m.Images)
+	if err != nil {
+		for _, img := range restored {
+			s.store.removeLocked(img)
+		}
+	}
+	s.store.changes.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range restored {
+		s.publishStored(ctx, img, false)
+	}
+	loggerFrom(ctx).Info("backup restored", "backup", name, "images", len(restored), "bytes", bytes)
+	return &pb.BackupInfo{Name: name, Images: int32(len(restored)), Bytes: bytes, Created: m.Created.UnixNano()}, nil
+}
+
+// restoreImages returns the images it stored, even if it fails. The caller
+// holds s.store.changes.
+func (s *server) restoreImages(ctx context.Context, dir string, images []backupImage) ([]string, int64, error) {
+	if files, err := s.store.list(ctx, ""); err != nil {
+		return nil, 0, status.Errorf(codes.Internal, "cannot list images: %v", err)
+	} else if len(files) > 0 {
+		return nil, 0, status.Errorf(codes.FailedPrecondition, "the server already has %d images; restore needs an empty server", len(files))
+	}
+	var restored []string
+	var bytes int64
+	for _, img := range images {
+		if err := ctx.Err(); err != nil {
+			return restored, 0, status.FromContextError(err).Err()
+		}
+		if err := s.restoreImage(ctx, dir, img); err != nil {
+			return restored, 0, err
+		}
+		restored = append(restored, img.Name)
+		bytes += img.Size
+	}
+	return restored, bytes, nil
+}
+
+func (s *server) restoreImage(ctx context.Context, dir string, img backupImage) error {
+	f, _, err := s.store.openBlob(filepath.Join(dir, backupBlobs, blobName(filepath.Base(img.SHA256), img.Encrypted)), img.Encrypted)
+	if keyUnavailable(err) {
+		return status.Errorf(codes.FailedPrecondition, "cannot read %s from the backup: %v", img.Name, err)
+	}
+	if err != nil {
+		return status.Errorf(codes.DataLoss, "cannot read %s from the backup: %v", img.Name, err)
+	}
+	defer f.Close()
+	up, err := s.store.create(ctx, img.Name)
+	if err == errInvalidName {
+		return status.Errorf(codes.DataLoss, "invalid image name %q in the backup", img.Name)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot create image: %v", err)
+	}
+	defer up.abort()
+	up.modTime = img.ModTime
+	if _, err := io.Copy(up, f); err == errCorruptImage {
+		return status.Errorf(codes.DataLoss, "cannot restore %s: %v", img.Name, err)
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "cannot restore %s: %v", img.Name, err)
+	}
+	if sum := hex.EncodeToString(up.hash.Sum(nil)); sum != img.SHA256 || up.size != img.Size {
+		return status.Errorf(codes.DataLoss, "%s does not match the digest in the backup manifest", img.Name)
+	}
+	if err := up.commitLocked(); err != nil {
+		return status.Errorf(codes.Internal, "cannot restore %s: %v", img.Name, err)
+	}
+	return nil
+}
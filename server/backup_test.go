@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+
+	pb "tages/service/proto"
+)
+
+// storeEntries returns the paths below root, share links aside.
+func storeEntries(t *testing.T, root string) []string {
+	t.Helper()
+	var entries []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		switch rel {
+		case ".", uploadsDir, metaDir, filepath.Join(metaDir, shareKeyFile), filepath.Join(metaDir, shareStateFile):
+		default:
+			entries = append(entries, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func backupServer(t *testing.T, dir string) (*server, pb.ImageUploadServiceClient, context.Context) {
+	srv, c := newTestServer(t, func(cfg *Config) {
+		cfg.Backup.Dir = dir
+		cfg.Auth.Tokens = []string{testToken}
+		cfg.Auth.AdminTokens = []string{testAdminToken}
+	})
+	return srv, c, withToken(context.Background(), testAdminToken)
+}
+
+var backupImages = map[string]string{"a.img": "first", "b/c.img": "second", "d.img": "first"}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	_, c, ctx := backupServer(t, dir)
+	for name, data := range backupImages {
+		mustUpload(t, ctx, c, name, []byte(data))
+	}
+	_, err := c.Backup(withToken(context.Background(), testToken), &pb.BackupRequest{Name: "b1"})
+	wantCode(t, err, codes.PermissionDenied, "admin token")
+	info, err := c.Backup(ctx, &pb.BackupRequest{Name: "b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Images != 3 || info.Bytes != 16 {
+		t.Fatalf("got %v", info)
+	}
+	// identical images share a blob
+	if blobs, _ := ioutil.ReadDir(filepath.Join(dir, "b1", backupBlobs)); len(blobs) != 2 {
+		t.Fatalf("backup holds %d blobs", len(blobs))
+	}
+	_, err = c.Backup(ctx, &pb.BackupRequest{Name: "b1"})
+	wantCode(t, err, codes.AlreadyExists, "already exists")
+
+	_, c2, ctx2 := backupServer(t, dir)
+	if _, err := c2.RestoreBackup(ctx2, &pb.BackupRequest{Name: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range backupImages {
+		got, err := downloadImage(ctx2, c2, name)
+		if err != nil || string(got) != data {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestRestoreCorruptBlob(t *testing.T) {
+	dir := t.TempDir()
+	_, c, ctx := backupServer(t, dir)
+	for name, data := range backupImages {
+		mustUpload(t, ctx, c, name, []byte(data))
+	}
+	if _, err := c.Backup(ctx, &pb.BackupRequest{Name: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	// the blob of b/c.img, restored after a.img
+	info, err := c.StatImage(ctx, &wrappers.StringValue{Value: "b/c.img"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b1", backupBlobs, info.Sha256), []byte("sec0nd"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv2, c2, ctx2 := backupServer(t, dir)
+	_, err = c2.RestoreBackup(ctx2, &pb.BackupRequest{Name: "b1"})
+	wantCode(t, err, codes.DataLoss, "b/c.img")
+	if left := storeEntries(t, srv2.store.root); len(left) > 0 {
+		t.Fatalf("failed restore left %v", left)
+	}
+	res, err := c2.ListImages(ctx2, &wrappers.StringValue{})
+	if err != nil || len(res.Images) > 0 {
+		t.Fatalf("got %v, %v", res, err)
+	}
+}
+
+func TestRestoreIntoNonEmptyStore(t *testing.T) {
+	dir := t.TempDir()
+	_, c, ctx := backupServer(t, dir)
+	mustUpload(t, ctx, c, "a.img", []byte("backed up"))
+	if _, err := c.Backup(ctx, &pb.BackupRequest{Name: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv2, c2, ctx2 := backupServer(t, dir)
+	mustUpload(t, ctx2, c2, "other.img", []byte("already there"))
+	before := storeEntries(t, srv2.store.root)
+	_, err := c2.RestoreBackup(ctx2, &pb.BackupRequest{Name: "b1"})
+	wantCode(t, err, codes.FailedPrecondition, "empty server")
+	after := storeEntries(t, srv2.store.root)
+	if len(after) != len(before) {
+		t.Fatalf("store changed from %v to %v", before, after)
+	}
+	got, err := downloadImage(ctx2, c2, "other.img")
+	if err != nil || string(got) != "already there" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	_, err = c2.RestoreBackup(ctx2, &pb.BackupRequest{Name: "missing"})
+	wantCode(t, err, codes.NotFound, "not found")
+}
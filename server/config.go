@@ -0,0 +1,628 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is prepended to every environment variable read by the server,
+// e.g. TAGES_LISTEN or TAGES_STORAGE_ROOT.
+const envPrefix = "TAGES_"
+
+// Config holds all server settings. Values are resolved in this order, each
+// step overriding the previous one: built-in defaults, the YAML config file,
+// TAGES_* environment variables and finally command-line flags.
+type Config struct {
+	Listen     string           `yaml:"listen"`
+	Storage    StorageConfig    `yaml:"storage"`
+	ChunkSize  int              `yaml:"chunk_size"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Log        LogConfig        `yaml:"log"`
+	Health     HealthConfig     `yaml:"health"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	HTTP       HTTPConfig       `yaml:"http"`
+	GRPCWeb    GRPCWebConfig    `yaml:"grpc_web"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Events     EventsConfig     `yaml:"events"`
+	Webhooks   WebhooksConfig   `yaml:"webhooks"`
+	Share      ShareConfig      `yaml:"share"`
+	Backup     BackupConfig     `yaml:"backup"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	// Reflection registers the gRPC server reflection service, used by
+	// tools such as grpcurl.
+	Reflection bool `yaml:"reflection"`
+	// ShutdownGracePeriod is how long in-flight transfers may keep running
+	// after SIGINT/SIGTERM before they are cancelled.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+}
+
+type StorageConfig struct {
+	Root string `yaml:"root"`
+}
+
+type LimitsConfig struct {
+	// MaxFileSize is the largest upload accepted, in bytes. 0 means no limit.
+	MaxFileSize int64 `yaml:"max_file_size"`
+	// MaxArchiveSize is the largest zip archive received for import, which
+	// is kept on disk until it is extracted, in bytes. 0 means no limit.
+	MaxArchiveSize int64 `yaml:"max_archive_size"`
+	// MaxConcurrentStreams caps the number of concurrent RPCs per connection.
+	MaxConcurrentStreams uint32 `yaml:"max_concurrent_streams"`
+	// MaxRecvMsgSize is the largest single message the server accepts, in bytes.
+	MaxRecvMsgSize int `yaml:"max_recv_msg_size"`
+	// StallTimeout cancels an upload or download after this long without
+	// any data moving, whatever the size of the image. 0 disables it.
+	StallTimeout time.Duration `yaml:"stall_timeout"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile enables mutual TLS when set.
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+	// Format is "text" or "json".
+	Format string `yaml:"format"`
+}
+
+type AuthConfig struct {
+	// Tokens accepted as "authorization: Bearer <token>". Empty disables
+	// authentication.
+	Tokens []string `yaml:"tokens"`
+	// AdminTokens are accepted for every call and are the only ones allowed
+	// to back up and restore the store and rotate its encryption keys when
+	// authentication is enabled.
+	AdminTokens []string `yaml:"admin_tokens"`
+}
+
+type EventsConfig struct {
+	// LogSize is how many changes are kept for WatchImages clients that
+	// resume after a disconnection.
+	LogSize int `yaml:"log_size"`
+}
+
+type WebhooksConfig struct {
+	Endpoints []WebhookEndpoint `yaml:"endpoints"`
+	// MaxAttempts is how many times a delivery is tried before it goes to
+	// the dead-letter log.
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// Timeout bounds one delivery attempt.
+	Timeout time.Duration `yaml:"timeout"`
+	// QueueSize is how many deliveries may wait per endpoint.
+	QueueSize int `yaml:"queue_size"`
+	// DeadLetterFile receives the deliveries given up on, one JSON object
+	// per line. Defaults to webhooks-dead-letter.jsonl in the storage
+	// metadata directory.
+	DeadLetterFile string `yaml:"dead_letter_file"`
+}
+
+type WebhookEndpoint struct {
+	URL string `yaml:"url"`
+	// Secret keys the HMAC-SHA256 signature of every delivery.
+	Secret string `yaml:"secret"`
+	// Events lists the events sent: created, updated and deleted. Empty
+	// means all of them.
+	Events []string `yaml:"events"`
+	// Prefix restricts the events to images whose name starts with it.
+	Prefix string `yaml:"prefix"`
+}
+
+type ShareConfig struct {
+	// Secret keys the HMAC signature of share tokens. Empty uses a random
+	// key kept in the storage metadata directory.
+	Secret string `yaml:"secret"`
+	// BaseURL is the public address of the REST gateway, used to build
+	// the URL of share links, e.g. https://img.example.com.
+	BaseURL    string        `yaml:"base_url"`
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+	MaxTTL     time.Duration `yaml:"max_ttl"`
+}
+
+type BackupConfig struct {
+	// Dir receives the backups made with the Backup RPC, and is where
+	// RestoreBackup reads them. Empty disables both.
+	Dir string `yaml:"dir"`
+}
+
+type EncryptionConfig struct {
+	// KeyFile holds the master keys, one "<id> <base64 key>" per line with
+	// the key wrapping new images first. Empty stores images in plain.
+	KeyFile string `yaml:"key_file"`
+}
+
+type HTTPConfig struct {
+	// Listen is the address of the REST gateway; empty disables it. It
+	// uses the TLS settings of the gRPC server.
+	Listen string `yaml:"listen"`
+}
+
+type GRPCWebConfig struct {
+	// Listen is the HTTP address serving gRPC-Web to browsers; empty
+	// disables it. It uses the TLS settings of the gRPC server.
+	Listen string `yaml:"listen"`
+	// AllowedOrigins lists the origins of the pages allowed to call the
+	// service, e.g. "https://dash.example.com", or "*" for any.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// Websockets enables the websocket transport, needed for uploads.
+	Websockets bool `yaml:"websockets"`
+}
+
+type MetricsConfig struct {
+	// Listen is the HTTP address serving /metrics; empty disables it.
+	Listen string `yaml:"listen"`
+}
+
+type TracingConfig struct {
+	// Exporter is "none", "stdout" or "otlp".
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP/gRPC collector address, e.g. localhost:4317.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure disables TLS towards the collector.
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio is the fraction of new traces recorded, from 0 to 1.
+	// Traces started by clients follow the client's sampling decision.
+	SampleRatio float64 `yaml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name"`
+}
+
+type HealthConfig struct {
+	// Enabled registers the grpc.health.v1 service.
+	Enabled bool `yaml:"enabled"`
+	// Interval between storage probes.
+	Interval time.Duration `yaml:"interval"`
+	// MinFreeBytes is the free disk space below which the server reports
+	// NOT_SERVING.
+	MinFreeBytes uint64 `yaml:"min_free_bytes"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:    ":50051",
+		Storage:   StorageConfig{Root: "files"},
+		ChunkSize: 1024,
+		Limits: LimitsConfig{
+			MaxArchiveSize:       4 << 30,
+			MaxConcurrentStreams: 100,
+			MaxRecvMsgSize:       4 << 20,
+			StallTimeout:         time.Minute,
+		},
+		Log: LogConfig{Level: "info", Format: "text"},
+		Health: HealthConfig{
+			Enabled:      true,
+			Interval:     10 * time.Second,
+			MinFreeBytes: 64 << 20,
+		},
+		Reflection: true,
+		// only gRPC listens unless more is asked for
+		GRPCWeb: GRPCWebConfig{Websockets: true},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "localhost:4317",
+			SampleRatio: 1,
+			ServiceName: "image-service",
+		},
+		Events: EventsConfig{LogSize: 1000},
+		Webhooks: WebhooksConfig{
+			MaxAttempts:    8,
+			InitialBackoff: time.Second,
+			MaxBackoff:     5 * time.Minute,
+			Timeout:        10 * time.Second,
+			QueueSize:      1000,
+		},
+		Share: ShareConfig{
+			DefaultTTL: 24 * time.Hour,
+			MaxTTL:     30 * 24 * time.Hour,
+		},
+		ShutdownGracePeriod: 30 * time.Second,
+	}
+}
+
+// loadConfig builds the server configuration from args (usually os.Args[1:]),
+// the environment and the optional config file, and validates the result.
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file")
+	listen := fs.String("listen", "", "address to listen on, e.g. :50051")
+	root := fs.String("storage-root", "", "directory where images are stored")
+	chunkSize := fs.Int("chunk-size", 0, "size in bytes of the chunks streamed to clients")
+	maxFileSize := fs.Int64("max-file-size", 0, "largest accepted upload in bytes (0 = unlimited)")
+	maxArchiveSize := fs.Int64("max-archive-size", 0, "largest zip archive accepted for import in bytes (0 = unlimited)")
+	maxStreams := fs.Uint("max-concurrent-streams", 0, "maximum concurrent RPCs per connection")
+	maxRecv := fs.Int("max-recv-msg-size", 0, "largest accepted message in bytes")
+	stallTimeout := fs.Duration("stall-timeout", 0, "cancel transfers with no data moving for this long (0 = never)")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file")
+	tlsKey := fs.String("tls-key", "", "TLS private key file")
+	tlsClientCA := fs.String("tls-client-ca", "", "CA bundle used to verify client certificates")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error")
+	logFormat := fs.String("log-format", "", "log format: text or json")
+	healthEnabled := fs.Bool("health", false, "register the gRPC health service")
+	httpListen := fs.String("http-listen", "", "address of the REST gateway (empty disables)")
+	grpcWebListen := fs.String("grpc-web-listen", "", "address serving gRPC-Web (empty disables)")
+	grpcWebOrigins := fs.String("grpc-web-allowed-origins", "", "comma-separated origins allowed to call gRPC-Web, or *")
+	metricsListen := fs.String("metrics-listen", "", "HTTP address for Prometheus /metrics (empty disables)")
+	traceExporter := fs.String("trace-exporter", "", "trace exporter: none, stdout or otlp")
+	traceEndpoint := fs.String("trace-endpoint", "", "OTLP/gRPC collector address")
+	authTokens := fs.String("auth-tokens", "", "comma-separated bearer tokens accepted by the server")
+	adminTokens := fs.String("auth-admin-tokens", "", "comma-separated bearer tokens also allowed to back up and restore")
+	backupDir := fs.String("backup-dir", "", "directory of the backups (empty disables backup and restore)")
+	keyFile := fs.String("encryption-key-file", "", "file of the master keys encrypting stored images (empty disables encryption)")
+	reflection := fs.Bool("reflection", false, "register the gRPC reflection service")
+	eventsLogSize := fs.Int("events-log-size", 0, "number of changes kept for resuming WatchImages")
+	shareBaseURL := fs.String("share-base-url", "", "public address of the REST gateway used in share links")
+	grace := fs.Duration("shutdown-grace-period", 0, "time allowed for in-flight transfers on shutdown")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "storage-root":
+			cfg.Storage.Root = *root
+		case "chunk-size":
+			cfg.ChunkSize = *chunkSize
+		case "max-file-size":
+			cfg.Limits.MaxFileSize = *maxFileSize
+		case "max-archive-size":
+			cfg.Limits.MaxArchiveSize = *maxArchiveSize
+		case "max-concurrent-streams":
+			cfg.Limits.MaxConcurrentStreams = uint32(*maxStreams)
+		case "max-recv-msg-size":
+			cfg.Limits.MaxRecvMsgSize = *maxRecv
+		case "stall-timeout":
+			cfg.Limits.StallTimeout = *stallTimeout
+		case "tls-cert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = *tlsKey
+		case "tls-client-ca":
+			cfg.TLS.ClientCAFile = *tlsClientCA
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		case "health":
+			cfg.Health.Enabled = *healthEnabled
+		case "http-listen":
+			cfg.HTTP.Listen = *httpListen
+		case "grpc-web-listen":
+			cfg.GRPCWeb.Listen = *grpcWebListen
+		case "grpc-web-allowed-origins":
+			cfg.GRPCWeb.AllowedOrigins = splitList(*grpcWebOrigins)
+		case "metrics-listen":
+			cfg.Metrics.Listen = *metricsListen
+		case "trace-exporter":
+			cfg.Tracing.Exporter = *traceExporter
+		case "trace-endpoint":
+			cfg.Tracing.Endpoint = *traceEndpoint
+		case "auth-tokens":
+			cfg.Auth.Tokens = splitList(*authTokens)
+		case "auth-admin-tokens":
+			cfg.Auth.AdminTokens = splitList(*adminTokens)
+		case "backup-dir":
+			cfg.Backup.Dir = *backupDir
+		case "encryption-key-file":
+			cfg.Encryption.KeyFile = *keyFile
+		case "reflection":
+			cfg.Reflection = *reflection
+		case "events-log-size":
+			cfg.Events.LogSize = *eventsLogSize
+		case "share-base-url":
+			cfg.Share.BaseURL = *shareBaseURL
+		case "shutdown-grace-period":
+			cfg.ShutdownGracePeriod = *grace
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("cannot parse config file %s: %w", name, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	str := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(envPrefix + key); ok {
+			*dst = v
+		}
+	}
+	num := func(key string, bits int, set func(int64)) error {
+		v, ok := os.LookupEnv(envPrefix + key)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.ParseInt(v, 10, bits)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", envPrefix, key, err)
+		}
+		set(n)
+		return nil
+	}
+
+	boolean := func(key string, dst *bool) error {
+		v, ok := os.LookupEnv(envPrefix + key)
+		if !ok {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", envPrefix, key, err)
+		}
+		*dst = b
+		return nil
+	}
+
+	str("LISTEN", &c.Listen)
+	str("STORAGE_ROOT", &c.Storage.Root)
+	str("TLS_CERT", &c.TLS.CertFile)
+	str("TLS_KEY", &c.TLS.KeyFile)
+	str("TLS_CLIENT_CA", &c.TLS.ClientCAFile)
+	str("LOG_LEVEL", &c.Log.Level)
+	str("LOG_FORMAT", &c.Log.Format)
+	str("METRICS_LISTEN", &c.Metrics.Listen)
+	str("HTTP_LISTEN", &c.HTTP.Listen)
+	str("GRPC_WEB_LISTEN", &c.GRPCWeb.Listen)
+	if v, ok := os.LookupEnv(envPrefix + "GRPC_WEB_ALLOWED_ORIGINS"); ok {
+		c.GRPCWeb.AllowedOrigins = splitList(v)
+	}
+	str("TRACE_EXPORTER", &c.Tracing.Exporter)
+	str("TRACE_ENDPOINT", &c.Tracing.Endpoint)
+	str("WEBHOOKS_DEAD_LETTER_FILE", &c.Webhooks.DeadLetterFile)
+	str("SHARE_SECRET", &c.Share.Secret)
+	str("SHARE_BASE_URL", &c.Share.BaseURL)
+	if v, ok := os.LookupEnv(envPrefix + "AUTH_TOKENS"); ok {
+		c.Auth.Tokens = splitList(v)
+	}
+	if v, ok := os.LookupEnv(envPrefix + "AUTH_ADMIN_TOKENS"); ok {
+		c.Auth.AdminTokens = splitList(v)
+	}
+	str("BACKUP_DIR", &c.Backup.Dir)
+	str("ENCRYPTION_KEY_FILE", &c.Encryption.KeyFile)
+
+	dur := func(key string, dst *time.Duration) error {
+		v, ok := os.LookupEnv(envPrefix + key)
+		if !ok {
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", envPrefix, key, err)
+		}
+		*dst = d
+		return nil
+	}
+
+	for _, err := range []error{
+		num("CHUNK_SIZE", 32, func(n int64) { c.ChunkSize = int(n) }),
+		num("MAX_FILE_SIZE", 64, func(n int64) { c.Limits.MaxFileSize = n }),
+		num("MAX_ARCHIVE_SIZE", 64, func(n int64) { c.Limits.MaxArchiveSize = n }),
+		num("MAX_CONCURRENT_STREAMS", 32, func(n int64) { c.Limits.MaxConcurrentStreams = uint32(n) }),
+		num("MAX_RECV_MSG_SIZE", 32, func(n int64) { c.Limits.MaxRecvMsgSize = int(n) }),
+		dur("STALL_TIMEOUT", &c.Limits.StallTimeout),
+		num("EVENTS_LOG_SIZE", 32, func(n int64) { c.Events.LogSize = int(n) }),
+		num("WEBHOOKS_MAX_ATTEMPTS", 32, func(n int64) { c.Webhooks.MaxAttempts = int(n) }),
+		dur("WEBHOOKS_TIMEOUT", &c.Webhooks.Timeout),
+		dur("SHARE_DEFAULT_TTL", &c.Share.DefaultTTL),
+		dur("SHARE_MAX_TTL", &c.Share.MaxTTL),
+		dur("SHUTDOWN_GRACE_PERIOD", &c.ShutdownGracePeriod),
+		boolean("HEALTH", &c.Health.Enabled),
+		dur("HEALTH_INTERVAL", &c.Health.Interval),
+		num("HEALTH_MIN_FREE_BYTES", 64, func(n int64) { c.Health.MinFreeBytes = uint64(n) }),
+		boolean("REFLECTION", &c.Reflection),
+		boolean("GRPC_WEB_WEBSOCKETS", &c.GRPCWeb.Websockets),
+		boolean("TRACE_INSECURE", &c.Tracing.Insecure),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	if c.Storage.Root == "" {
+		return errors.New("storage.root must not be empty")
+	}
+	if c.ChunkSize <= 0 {
+		return errors.New("chunk_size must be positive")
+	}
+	if c.Limits.MaxFileSize < 0 {
+		return errors.New("limits.max_file_size must not be negative")
+	}
+	if c.Limits.MaxArchiveSize < 0 {
+		return errors.New("limits.max_archive_size must not be negative")
+	}
+	if c.Limits.MaxRecvMsgSize <= 0 {
+		return errors.New("limits.max_recv_msg_size must be positive")
+	}
+	if c.Limits.StallTimeout < 0 {
+		return errors.New("limits.stall_timeout must not be negative")
+	}
+	// gRPC clients reject messages above 4MiB by default; leave room for framing
+	if c.ChunkSize > 4<<20-1024 {
+		return errors.New("chunk_size must be below 4MiB")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+		return errors.New("tls.client_ca_file requires tls.cert_file and tls.key_file")
+	}
+	if c.ShutdownGracePeriod < 0 {
+		return errors.New("shutdown_grace_period must not be negative")
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return fmt.Errorf("metrics.listen: %w", err)
+		}
+	}
+	if c.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Listen); err != nil {
+			return fmt.Errorf("http.listen: %w", err)
+		}
+	}
+	if c.GRPCWeb.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.GRPCWeb.Listen); err != nil {
+			return fmt.Errorf("grpc_web.listen: %w", err)
+		}
+	}
+	for _, o := range c.GRPCWeb.AllowedOrigins {
+		if u, err := url.Parse(o); o != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			return fmt.Errorf("grpc_web.allowed_origins: %q is not an origin like https://example.com", o)
+		}
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint == "" {
+			return errors.New("tracing.endpoint is required for the otlp exporter")
+		}
+	default:
+		return fmt.Errorf("tracing.exporter: unknown exporter %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return errors.New("tracing.sample_ratio must be between 0 and 1")
+	}
+	for _, t := range c.Auth.Tokens {
+		if len(t) < 16 {
+			return errors.New("auth.tokens must be at least 16 characters long")
+		}
+	}
+	for _, t := range c.Auth.AdminTokens {
+		if len(t) < 16 {
+			return errors.New("auth.admin_tokens must be at least 16 characters long")
+		}
+	}
+	if c.Events.LogSize <= 0 {
+		return errors.New("events.log_size must be positive")
+	}
+	if err := c.Webhooks.validate(); err != nil {
+		return err
+	}
+	if c.Backup.Dir != "" {
+		root, _ := filepath.Abs(c.Storage.Root)
+		dir, _ := filepath.Abs(c.Backup.Dir)
+		if rel, err := filepath.Rel(root, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			return errors.New("backup.dir must be outside storage.root")
+		}
+	}
+	if err := c.Share.validate(); err != nil {
+		return err
+	}
+	if c.Health.Enabled && c.Health.Interval <= 0 {
+		return errors.New("health.interval must be positive")
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log.level: unknown level %q", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log.format: unknown format %q", c.Log.Format)
+	}
+	return nil
+}
+
+func (w WebhooksConfig) validate() error {
+	if w.MaxAttempts < 1 {
+		return errors.New("webhooks.max_attempts must be at least 1")
+	}
+	if w.InitialBackoff <= 0 || w.MaxBackoff < w.InitialBackoff {
+		return errors.New("webhooks.initial_backoff must be positive and not above webhooks.max_backoff")
+	}
+	if w.Timeout <= 0 {
+		return errors.New("webhooks.timeout must be positive")
+	}
+	if w.QueueSize < 1 {
+		return errors.New("webhooks.queue_size must be at least 1")
+	}
+	for i, e := range w.Endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks.endpoints[%d].url: must be an http or https URL", i)
+		}
+		if len(e.Secret) < 16 {
+			return fmt.Errorf("webhooks.endpoints[%d].secret must be at least 16 characters long", i)
+		}
+		for _, ev := range e.Events {
+			if ev != "created" && ev != "updated" && ev != "deleted" {
+				return fmt.Errorf("webhooks.endpoints[%d].events: unknown event %q", i, ev)
+			}
+		}
+	}
+	return nil
+}
+
+func (s ShareConfig) validate() error {
+	if s.Secret != "" && len(s.Secret) < 16 {
+		return errors.New("share.secret must be at least 16 characters long")
+	}
+	if s.BaseURL != "" {
+		if u, err := url.Parse(s.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("share.base_url: must be an http or https URL")
+		}
+	}
+	if s.DefaultTTL <= 0 || s.MaxTTL < s.DefaultTTL {
+		return errors.New("share.default_ttl must be positive and not above share.max_ttl")
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("listen: \":1001\"\nchunk_size: 2001\nlog:\n  level: warn\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		file  bool
+		env   map[string]string
+		flags []string
+		// listen, chunk size and log level
+		want string
+	}{
+		{"defaults", false, nil, nil, ":50051 1024 info"},
+		{"file", true, nil, nil, ":1001 2001 warn"},
+		{"env over file", true, map[string]string{"LISTEN": ":1002", "CHUNK_SIZE": "2002"}, nil, ":1002 2002 warn"},
+		{"flags over env", true, map[string]string{"LISTEN": ":1002", "CHUNK_SIZE": "2002"}, []string{"-listen", ":1003"}, ":1003 2002 warn"},
+		{"flags over file", true, nil, []string{"-log-level", "error"}, ":1001 2001 error"},
+		{"env and flags", false, map[string]string{"LOG_LEVEL": "debug"}, []string{"-chunk-size", "2003"}, ":50051 2003 debug"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.file {
+				t.Setenv(envPrefix+"CONFIG", file)
+			}
+			for k, v := range tc.env {
+				t.Setenv(envPrefix+k, v)
+			}
+			cfg, err := loadConfig(tc.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%s %d %s", cfg.Listen, cfg.ChunkSize, cfg.Log.Level); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.yaml")
+	if err := ioutil.WriteFile(unknown, []byte("listn: \":1\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		env   map[string]string
+		flags []string
+		want  string
+	}{
+		{"missing file", nil, []string{"-config", filepath.Join(dir, "missing.yaml")}, "cannot read config file"},
+		{"unknown key", nil, []string{"-config", unknown}, "field listn not found"},
+		{"bad number", map[string]string{"CHUNK_SIZE": "big"}, nil, "TAGES_CHUNK_SIZE"},
+		{"unknown flag", nil, []string{"-listn", ":1"}, "flag provided but not defined"},
+		{"invalid value", nil, []string{"-chunk-size", "-1"}, "invalid configuration: chunk_size must be positive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(envPrefix+k, v)
+			}
+			_, err := loadConfig(tc.flags)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := defaultConfig().validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	for _, tc := range []struct {
+		set  func(*Config)
+		want string
+	}{
+		{func(c *Config) { c.Listen = "50051" }, "listen:"},
+		{func(c *Config) { c.Storage.Root = "" }, "storage.root must not be empty"},
+		{func(c *Config) { c.ChunkSize = 0 }, "chunk_size must be positive"},
+		{func(c *Config) { c.ChunkSize = 4 << 20 }, "chunk_size must be below 4MiB"},
+		{func(c *Config) { c.Limits.MaxFileSize = -1 }, "limits.max_file_size must not be negative"},
+		{func(c *Config) { c.Limits.MaxArchiveSize = -1 }, "limits.max_archive_size must not be negative"},
+		{func(c *Config) { c.Limits.MaxRecvMsgSize = 0 }, "limits.max_recv_msg_size must be positive"},
+		{func(c *Config) { c.TLS.CertFile = "cert.pem" }, "must be set together"},
+		{func(c *Config) { c.TLS.ClientCAFile = "ca.pem" }, "tls.client_ca_file requires"},
+		{func(c *Config) { c.ShutdownGracePeriod = -1 }, "shutdown_grace_period must not be negative"},
+		{func(c *Config) { c.Health.Interval = 0 }, "health.interval must be positive"},
+		{func(c *Config) { c.Metrics.Listen = "9090" }, "metrics.listen:"},
+		{func(c *Config) { c.Tracing.Exporter, c.Tracing.Endpoint = "otlp", "" }, "tracing.endpoint is required"},
+		{func(c *Config) { c.Tracing.Exporter = "jaeger" }, "tracing.exporter: unknown exporter"},
+		{func(c *Config) { c.Tracing.SampleRatio = 1.5 }, "tracing.sample_ratio must be between 0 and 1"},
+		{func(c *Config) { c.Log.Format = "xml" }, "log.format: unknown format"},
+		{func(c *Config) { c.Auth.Tokens = []string{"short"} }, "auth.tokens must be at least 16 characters"},
+		{func(c *Config) { c.Auth.AdminTokens = []string{"short"} }, "auth.admin_tokens must be at least 16 characters"},
+		{func(c *Config) { c.Backup.Dir = filepath.Join(c.Storage.Root, "b") }, "backup.dir must be outside storage.root"},
+		{func(c *Config) { c.Limits.StallTimeout = -1 }, "limits.stall_timeout must not be negative"},
+		{func(c *Config) { c.Events.LogSize = 0 }, "events.log_size must be positive"},
+		{func(c *Config) { c.Webhooks.MaxAttempts = 0 }, "webhooks.max_attempts must be at least 1"},
+		{func(c *Config) { c.Webhooks.InitialBackoff = time.Hour }, "webhooks.initial_backoff must be positive"},
+		{func(c *Config) { c.Webhooks.Timeout = 0 }, "webhooks.timeout must be positive"},
+		{func(c *Config) { c.Webhooks.QueueSize = 0 }, "webhooks.queue_size must be at least 1"},
+		{func(c *Config) { c.Webhooks.Endpoints = webhookEndpoints("ftp://host", "0123456789abcdef") }, "webhooks.endpoints[0].url"},
+		{func(c *Config) { c.Webhooks.Endpoints = webhookEndpoints("http://host", "short") }, "webhooks.endpoints[0].secret must be at least 16"},
+		{func(c *Config) { c.Webhooks.Endpoints = webhookEndpoints("http://host", "0123456789abcdef", "moved") }, "unknown event \"moved\""},
+		{func(c *Config) { c.HTTP.Listen = "8080" }, "http.listen:"},
+		{func(c *Config) { c.GRPCWeb.Listen = "8081" }, "grpc_web.listen:"},
+		{func(c *Config) { c.GRPCWeb.AllowedOrigins = []string{"example.com"} }, "grpc_web.allowed_origins:"},
+		{func(c *Config) { c.Share.Secret = "short" }, "share.secret must be at least 16"},
+		{func(c *Config) { c.Share.BaseURL = "img.example.com" }, "share.base_url: must be an http or https URL"},
+		{func(c *Config) { c.Share.DefaultTTL = 10000 * time.Hour }, "share.default_ttl must be positive"},
+		{func(c *Config) { c.Log.Level = "verbose" }, "log.level: unknown level"},
+	} {
+		cfg := defaultConfig()
+		tc.set(cfg)
+		if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("got %v, want %q", err, tc.want)
+		}
+	}
+}
+
+func webhookEndpoints(url, secret string, events ...string) []WebhookEndpoint {
+	return []WebhookEndpoint{{URL: url, Secret: secret, Events: events}}
+}
+
+func TestConfigDefaultListeners(t *testing.T) {
+	// only gRPC listens unless more is asked for
+	cfg := defaultConfig()
+	for what, addr := range map[string]string{"metrics": cfg.Metrics.Listen, "http": cfg.HTTP.Listen, "grpc_web": cfg.GRPCWeb.Listen} {
+		if addr != "" {
+			t.Errorf("%s listens on %s by default", what, addr)
+		}
+	}
+}
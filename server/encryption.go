@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	pb "tages/service/proto"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Encrypted images start with a header carrying the data key of the image,
+// wrapped with AES-GCM by a master key:
+//
+//	"TAGESENC" | version | master key id (16 bytes, zero padded) | nonce + wrapped data key + tag
+//
+// followed by the content sealed with the data key in segments of
+// segmentSize bytes, each with its own tag. The nonce of a segment is its
+// index plus a flag marking the last one, so segments cannot be reordered,
+// dropped or truncated unnoticed, and any segment can be read on its own,
+// which keeps seeking cheap for resumed downloads and Range requests. Data
+// keys are never reused, which makes these nonces safe.
+//
+// Whether an image is encrypted is recorded by a marker in the metadata
+// directory, never taken from its content, which is whatever was uploaded.
+const (
+	encMagic        = "TAGESENC"
+	encVersion      = 1
+	keyIDLen        = 16
+	wrappedKeyLen   = 12 + 32 + 16
+	encHeaderLen    = len(encMagic) + 1 + keyIDLen + wrappedKeyLen
+	segmentSize     = 64 << 10
+	segmentOverhead = 16
+)
+
+var (
+	errNoKeys       = errors.New("image is encrypted but no encryption key file is configured")
+	errCorruptImage = errors.New("encrypted image is corrupt or was tampered with")
+	validKeyID      = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+)
+
+// missingKeyError is returned for images encrypted with a master key that is
+// no longer in the key file.
+type missingKeyError struct {
+	id string
+}
+
+func (e *missingKeyError) Error() string {
+	return fmt.Sprintf("image is encrypted with master key %q, which is not in the key file", e.id)
+}
+
+// keyUnavailable reports whether err is due to the key file rather than the
+// image.
+func keyUnavailable(err error) bool {
+	var mk *missingKeyError
+	return err == errNoKeys || errors.As(err, &mk)
+}
+
+// keyring holds the master keys of a key file, one "<id> <base64 key>" per
+// line. The first key wraps new data keys; the others are only used to
+// unwrap the keys of images written before a rotation.
+type keyring struct {
+	file string
+
+	mu      sync.RWMutex
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+func loadKeyring(file string) (*keyring, error) {
+	k := &keyring{file: file}
+	return k, k.reload()
+}
+
+// reload reads the key file again, e.g. after a new primary key was added.
+func (k *keyring) reload() error {
+	info, err := os.Stat(k.file)
+	if err != nil {
+		return fmt.Errorf("cannot read key file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("key file %s must not be accessible to group or others (mode %v)", k.file, info.Mode().Perm())
+	}
+	f, err := os.Open(k.file)
+	if err != nil {
+		return fmt.Errorf("cannot read key file: %w", err)
+	}
+	defer f.Close()
+
+	var primary string
+	keys := make(map[string]cipher.AEAD)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !validKeyID.MatchString(fields[0]) {
+			return fmt.Errorf("key file %s:%d: want \"<id> <base64 key>\" with an id of up to 16 letters, digits, - or _", k.file, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("key file %s:%d: the key must be 32 bytes in base64", k.file, n)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return fmt.Errorf("key file %s:%d: duplicate key id %q", k.file, n, fields[0])
+		}
+		if keys[fields[0]], err = newAEAD(key); err != nil {
+			return err
+		}
+		if primary == "" {
+			primary = fields[0]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("cannot read key file: %w", err)
+	}
+	if primary == "" {
+		return fmt.Errorf("key file %s has no key", k.file)
+	}
+	k.mu.Lock()
+	k.primary, k.keys = primary, keys
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *keyring) primaryID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// header wraps dataKey with the primary key and returns the image header.
+func (k *keyring) header(dataKey []byte) ([]byte, error) {
+	k.mu.RLock()
+	id, master := k.primary, k.keys[k.primary]
+	k.mu.RUnlock()
+
+	h := make([]byte, 0, encHeaderLen)
+	h = append(h, encMagic...)
+	h = append(h, encVersion)
+	h = append(h, padKeyID(id)...)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// the key id is authenticated, so a header cannot claim another key
+	return master.Seal(append(h, nonce...), nonce, dataKey, h), nil
+}
+
+// unwrap returns the data key of a header and the id of its master key.
+func (k *keyring) unwrap(h []byte) (dataKey []byte, id string, err error) {
+	id = headerKeyID(h)
+	k.mu.RLock()
+	master := k.keys[id]
+	k.mu.RUnlock()
+	if master == nil {
+		return nil, id, &missingKeyError{id}
+	}
+	wrapped := h[len(encMagic)+1+keyIDLen:]
+	dataKey, err = master.Open(nil, wrapped[:12], wrapped[12:], h[:len(encMagic)+1+keyIDLen])
+	if err != nil {
+		return nil, id, errCorruptImage
+	}
+	return dataKey, id, nil
+}
+
+func headerKeyID(h []byte) string {
+	return string(bytes.TrimRight(h[len(encMagic)+1:len(encMagic)+1+keyIDLen], "\x00"))
+}
+
+func padKeyID(id string) []byte {
+	b := make([]byte, keyIDLen)
+	copy(b, id)
+	return b
+}
+
+// readHeader returns the encryption header of f, an encrypted image.
+func readHeader(f io.ReaderAt) ([]byte, error) {
+	h := make([]byte, encHeaderLen)
+	if _, err := f.ReadAt(h, 0); err == io.EOF {
+		return nil, errCorruptImage
+	} else if err != nil {
+		return nil, err
+	}
+	if string(h[:len(encMagic)]) != encMagic {
+		return nil, errCorruptImage
+	}
+	if h[len(encMagic)] != encVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", h[len(encMagic)])
+	}
+	return h, nil
+}
+
+func segmentNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	if last {
+		nonce[8] = 1
+	}
+	return nonce
+}
+
+// plainSize returns the size of the content of an encrypted file of the
+// given size.
+func plainSize(fileSize int64) int64 {
+	body := fileSize - int64(encHeaderLen)
+	if body < segmentOverhead {
+		return 0
+	}
+	segments := (body + segmentSize + segmentOverhead - 1) / (segmentSize + segmentOverhead)
+	return body - segments*segmentOverhead
+}
+
+// encryptWriter seals what is written to it in segments. A full segment is
+// only sealed once more data arrives, since the last one is marked as such;
+// Close seals the rest, possibly an empty segment for empty content.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	next    int64
+	dataKey []byte
+	keyID   string
+}
+
+// newEncryptWriter writes the header of a new data key to w.
+func newEncryptWriter(w io.Writer, keys *keyring) (*encryptWriter, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	h, err := keys.header(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(h); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, segmentSize+segmentOverhead), dataKey: dataKey, keyID: headerKeyID(h)}, nil
+}
+
+// rewrap writes the header at the start of f again if the primary key
+// changed since the upload started, so that a rotation running meanwhile
+// leaves no image under an older key.
+func (e *encryptWriter) rewrap(f io.WriterAt, keys *keyring) error {
+	if e.keyID == keys.primaryID() {
+		return nil
+	}
+	h, err := keys.header(e.dataKey)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(h, 0); err != nil {
+		return err
+	}
+	e.keyID = headerKeyID(h)
+	return nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(e.buf) == segmentSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		k := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	out := e.aead.Seal(e.buf[:0], segmentNonce(e.next, last), e.buf, nil)
+	e.next++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptReader reads the content of an encrypted file, one segment at a
+// time.
+type decryptReader struct {
+	f        *os.File
+	aead     cipher.AEAD
+	fileSize int64
+	size     int64
+	off      int64
+	segment  int64 // index of the segment in plain, -1 if none
+	plain    []byte
+	lastRead bool // the last segment was authenticated
+}
+
+func newDecryptReader(f *os.File, h []byte, fileSize int64, keys *keyring) (*decryptReader, error) {
+	if keys == nil {
+		return nil, errNoKeys
+	}
+	// even empty content has a segment, and only empty content has an
+	// empty one
+	body := fileSize - int64(encHeaderLen)
+	if r := body % (segmentSize + segmentOverhead); body < segmentOverhead || r > 0 && r <= segmentOverhead && body != segmentOverhead {
+		return nil, errCorruptImage
+	}
+	dataKey, _, err := keys.unwrap(h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{f: f, aead: aead, fileSize: fileSize, size: plainSize(fileSize), segment: -1}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.off >= d.size {
+		// the end is only reported once the last segment was opened, which
+		// detects a file cut at a segment boundary
+		if !d.lastRead {
+			if err := d.load((d.fileSize - int64(encHeaderLen) - 1) / (segmentSize + segmentOverhead)); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	i := d.off / segmentSize
+	if i != d.segment {
+		if err := d.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.off-i*segmentSize:])
+	d.off += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) load(i int64) error {
+	start := int64(encHeaderLen) + i*(segmentSize+segmentOverhead)
+	end := start + segmentSize + segmentOverhead
+	last := end >= d.fileSize
+	if last {
+		end = d.fileSize
+	}
+	sealed := make([]byte, end-start)
+	if _, err := d.f.ReadAt(sealed, start); err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], segmentNonce(i, last), sealed, nil)
+	if err != nil {
+		d.segment = -1
+		return errCorruptImage
+	}
+	d.segment, d.plain = i, plain
+	d.lastRead = d.lastRead || last
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.off
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.off = offset
+	return offset, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.f.Close()
+}
+
+// RotateKeys reloads the key file and moves every image to its primary key:
+// images under another key get their data key wrapped again, which leaves
+// their content as it is, and images stored in plain are encrypted. Once it
+// succeeded, older keys can be removed from the key file.
+func (s *server) RotateKeys(ctx context.Context, _ *empty.Empty) (*pb.RotateKeysResult, error) {
+	if s.store.keys == nil {
+		return nil, status.Error(codes.FailedPrecondition, "encryption is disabled: encryption.key_file is not set")
+	}
+	if err := s.store.reloadKeys(); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot load encryption keys: %v", err)
+	}
+	files, err := s.store.list(ctx, "")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list images: %v", err)
+	}
+	res := &pb.RotateKeysResult{}
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, status.FromContextError(err).Err()
+		}
+		r, err := s.store.rotate(f.Name())
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, storageError(err, f.Name(), "cannot rotate key of "+f.Name())
+		case r == rotateRewrapped:
+			res.Rewrapped++
+		case r == rotateEncrypted:
+			res.Encrypted++
+		default:
+			res.Unchanged++
+		}
+	}
+	loggerFrom(ctx).Info("encryption keys rotated", "primary", s.store.keys.primaryID(),
+		"rewrapped", res.Rewrapped, "encrypted", res.Encrypted, "unchanged", res.Unchanged)
+	return res, nil
+}
+
+type rotation int
+
+const (
+	rotateUnchanged rotation = iota
+	rotateRewrapped
+	rotateEncrypted
+)
+
+// reloadKeys reloads the key file while no upload is committed: uploads
+// committed later see the new primary key and wrap their data key with it.
+func (st *storage) reloadKeys() error {
+	st.changes.Lock()
+	defer st.changes.Unlock()
+	return st.keys.reload()
+}
+
+// rotate rewrites the image with a header of the primary key. The new file
+// keeps the modification time, so the saved digest stays valid.
+func (st *storage) rotate(name string) (rotation, error) {
+	st.changes.Lock()
+	defer st.changes.Unlock()
+
+	f, err := os.Open(st.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	enc, err := st.encrypted(name)
+	if err != nil {
+		return 0, err
+	}
+	var h []byte
+	if enc {
+		if h, err = readHeader(f); err != nil {
+			return 0, err
+		}
+	}
+
+	out, err := ioutil.TempFile(filepath.Join(st.root, uploadsDir), "*.partial")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	r := rotateEncrypted
+	if h == nil {
+		var ew *encryptWriter
+		if ew, err = newEncryptWriter(out, st.keys); err == nil {
+			if _, err = io.Copy(ew, f); err == nil {
+				err = ew.Close()
+			}
+		}
+	} else {
+		var dataKey []byte
+		var id string
+		if dataKey, id, err = st.keys.unwrap(h); err != nil {
+			return 0, err
+		}
+		if id == st.keys.primaryID() {
+			return rotateUnchanged, nil
+		}
+		r = rotateRewrapped
+		var nh []byte
+		if nh, err = st.keys.header(dataKey); err == nil {
+			_, err = out.Write(nh)
+		}
+		if err == nil {
+			_, err = io.Copy(out, io.NewSectionReader(f, int64(encHeaderLen), info.Size()-int64(encHeaderLen)))
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(out.Name(), time.Now(), info.ModTime())
+	}
+	if err == nil && r == rotateEncrypted {
+		err = st.markEncrypted(name, true)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), st.path(name))
+		if err != nil && r == rotateEncrypted {
+			// the image left in place is still in plain
+			st.markEncrypted(name, false)
+		}
+	}
+	return r, err
+}
+
+// encPath is the marker of an encrypted image in the metadata directory.
+func (st *storage) encPath(name string) string {
+	return filepath.Join(st.root, metaDir, url.PathEscape(name)+".enc")
+}
+
+// encrypted reports whether the image name is stored encrypted.
+func (st *storage) encrypted(name string) (bool, error) {
+	_, err := os.Stat(st.encPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// markEncrypted records whether the image name is encrypted. It is called
+// before the image is renamed into place, so that an encrypted image is
+// never left unmarked.
+func (st *storage) markEncrypted(name string, encrypted bool) error {
+	if encrypted {
+		return ioutil.WriteFile(st.encPath(name), nil, 0600)
+	}
+	if err := os.Remove(st.encPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	pb "tages/service/proto"
+)
+
+// writeKeys writes a key file with a new random key for each id, the first
+// one being the primary key, and returns its path.
+func writeKeys(t *testing.T, file string, ids ...string) string {
+	t.Helper()
+	var lines []string
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		lines = append(lines, id+" "+base64.StdEncoding.EncodeToString(key))
+	}
+	if file == "" {
+		file = filepath.Join(t.TempDir(), "keys")
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// keepKeys rewrites the key file keeping only the lines of the given ids,
+// in their order.
+func keepKeys(t *testing.T, file string, ids ...string) {
+	t.Helper()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		byID[strings.Fields(line)[0]] = line
+	}
+	var lines []string
+	for _, id := range ids {
+		lines = append(lines, byID[id])
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sample returns n bytes spanning several encryption segments for large n.
+func sample(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/segmentSize)
+	}
+	return b
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	keys := writeKeys(t, "", "k1")
+	srv, c := newTestServer(t, func(cfg *Config) { cfg.Encryption.KeyFile = keys })
+	ctx := context.Background()
+	for _, n := range []int{0, 1, segmentSize, 3*segmentSize + 5} {
+		data := sample(n)
+		mustUpload(t, ctx, c, "a.img", data)
+		got, err := downloadImage(ctx, c, "a.img")
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: got %d bytes, %v", n, len(got), err)
+		}
+		info, err := c.StatImage(ctx, &wrappers.StringValue{Value: "a.img"})
+		if err != nil || info.Size != int64(n) {
+			t.Fatalf("%d bytes: got %v, %v", n, info, err)
+		}
+		raw, err := ioutil.ReadFile(srv.store.path("a.img"))
+		if err != nil || !bytes.HasPrefix(raw, []byte(encMagic)) || (n > 16 && bytes.Contains(raw, data[:16])) {
+			t.Fatalf("%d bytes: the stored file is not encrypted", n)
+		}
+	}
+
+	// resumed in the middle of a segment
+	data := sample(3*segmentSize + 5)
+	mustUpload(t, ctx, c, "a.img", data)
+	off := segmentSize + 100
+	got, err := downloadImage(metadata.AppendToOutgoingContext(ctx, resumeOffsetKey, strconv.Itoa(off)), c, "a.img")
+	if err != nil || !bytes.Equal(got, data[off:]) {
+		t.Fatalf("resumed download: got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestPlainImageLookingEncrypted(t *testing.T) {
+	root := t.TempDir()
+	data := append([]byte(encMagic), sample(200)...)
+	data[len(encMagic)] = encVersion
+
+	// without a key file
+	_, c := newTestServer(t, func(cfg *Config) { cfg.Storage.Root = root })
+	ctx := context.Background()
+	mustUpload(t, ctx, c, "fake.img", data)
+	got, err := downloadImage(ctx, c, "fake.img")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+
+	// stored before encryption was enabled
+	keys := writeKeys(t, "", "k1")
+	_, c = newTestServer(t, func(cfg *Config) {
+		cfg.Storage.Root = root
+		cfg.Encryption.KeyFile = keys
+		cfg.Auth.AdminTokens = []string{testAdminToken}
+	})
+	ctx = withToken(ctx, testAdminToken)
+	info, err := c.StatImage(ctx, &wrappers.StringValue{Value: "fake.img"})
+	if err != nil || info.Size != int64(len(data)) {
+		t.Fatalf("got %v, %v", info, err)
+	}
+	if got, err = downloadImage(ctx, c, "fake.img"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	res, err := c.RotateKeys(ctx, &empty.Empty{})
+	if err != nil || res.Encrypted != 1 {
+		t.Fatalf("got %v, %v", res, err)
+	}
+	if got, err = downloadImage(ctx, c, "fake.img"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("after rotation: got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	root := t.TempDir()
+	keys := writeKeys(t, "", "k1")
+	start := func() (pb.ImageUploadServiceClient, context.Context) {
+		_, c := newTestServer(t, func(cfg *Config) {
+			cfg.Storage.Root = root
+			cfg.Encryption.KeyFile = keys
+			cfg.Auth.Tokens = []string{testToken}
+			cfg.Auth.AdminTokens = []string{testAdminToken}
+		})
+		return c, withToken(context.Background(), testAdminToken)
+	}
+	c, ctx := start()
+	a, b := sample(2*segmentSize), []byte("small")
+	mustUpload(t, ctx, c, "a.img", a)
+	mustUpload(t, ctx, c, "dir/b.img", b)
+
+	_, err := c.RotateKeys(withToken(context.Background(), testToken), &empty.Empty{})
+	wantCode(t, err, codes.PermissionDenied, "admin token")
+	res, err := c.RotateKeys(ctx, &empty.Empty{})
+	if err != nil || res.Unchanged != 2 {
+		t.Fatalf("got %v, %v", res, err)
+	}
+
+	// a new primary key, then the old one removed
+	writeKeys(t, keys+".new", "k2")
+	b2, _ := ioutil.ReadFile(keys + ".new")
+	b1, _ := ioutil.ReadFile(keys)
+	ioutil.WriteFile(keys, append(b2, b1...), 0600)
+	if res, err = c.RotateKeys(ctx, &empty.Empty{}); err != nil || res.Rewrapped != 2 {
+		t.Fatalf("got %v, %v", res, err)
+	}
+	keepKeys(t, keys, "k2")
+	c, ctx = start()
+	for name, data := range map[string][]byte{"a.img": a, "dir/b.img": b} {
+		if got, err := downloadImage(ctx, c, name); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %d bytes, %v", name, len(got), err)
+		}
+	}
+
+	// without the key of an image
+	writeKeys(t, keys, "k3")
+	c, ctx = start()
+	_, err = downloadImage(ctx, c, "a.img")
+	wantCode(t, err, codes.FailedPrecondition, `master key "k2"`)
+	_, err = c.RotateKeys(ctx, &empty.Empty{})
+	wantCode(t, err, codes.FailedPrecondition, `master key "k2"`)
+}
+
+func TestRotateKeysDuringUpload(t *testing.T) {
+	keys := writeKeys(t, "", "k1")
+	srv, c := newTestServer(t, func(cfg *Config) { cfg.Encryption.KeyFile = keys })
+	ctx := context.Background()
+	up, err := srv.store.create(ctx, "a.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.abort()
+	data := sample(segmentSize + 10)
+	up.Write(data)
+
+	// the upload started under k1 commits after a rotation dropped it
+	writeKeys(t, keys, "k2")
+	if _, err := c.RotateKeys(ctx, &empty.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := downloadImage(ctx, c, "a.img"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestEncryptedImageWithoutKeyFile(t *testing.T) {
+	root := t.TempDir()
+	keys := writeKeys(t, "", "k1")
+	_, c := newTestServer(t, func(cfg *Config) {
+		cfg.Storage.Root = root
+		cfg.Encryption.KeyFile = keys
+	})
+	mustUpload(t, context.Background(), c, "a.img", []byte("secret"))
+
+	_, c = newTestServer(t, func(cfg *Config) { cfg.Storage.Root = root })
+	_, err := downloadImage(context.Background(), c, "a.img")
+	wantCode(t, err, codes.FailedPrecondition, "no encryption key file")
+	_, err = c.RotateKeys(context.Background(), &empty.Empty{})
+	wantCode(t, err, codes.FailedPrecondition, "encryption is disabled")
+}
+
+func TestTamperedEncryptedImage(t *testing.T) {
+	keys := writeKeys(t, "", "k1")
+	srv, c := newTestServer(t, func(cfg *Config) { cfg.Encryption.KeyFile = keys })
+	ctx := context.Background()
+	for _, at := range []int{len(encMagic) + 1 + keyIDLen + 20, encHeaderLen + 10, encHeaderLen + segmentSize + segmentOverhead + 1} {
+		mustUpload(t, ctx, c, "a.img", sample(2*segmentSize))
+		raw, err := ioutil.ReadFile(srv.store.path("a.img"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[at] ^= 1
+		if err := ioutil.WriteFile(srv.store.path("a.img"), raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = downloadImage(ctx, c, "a.img")
+		wantCode(t, err, codes.DataLoss, "corrupt")
+	}
+
+	// cut off after a segment, to an empty segment or within the last tag
+	for _, cut := range []struct{ size, at int }{
+		{2 * segmentSize, encHeaderLen + segmentSize + segmentOverhead},
+		{3 * segmentSize, encHeaderLen + segmentOverhead},
+		{2 * segmentSize, encHeaderLen + segmentSize + segmentOverhead + 10},
+	} {
+		mustUpload(t, ctx, c, "a.img", sample(cut.size))
+		raw, _ := ioutil.ReadFile(srv.store.path("a.img"))
+		ioutil.WriteFile(srv.store.path("a.img"), raw[:cut.at], 0600)
+		_, err := downloadImage(ctx, c, "a.img")
+		wantCode(t, err, codes.DataLoss, "corrupt")
+	}
+}
+
+func TestBackupMixedEncryption(t *testing.T) {
+	root, dir := t.TempDir(), t.TempDir()
+	keys := writeKeys(t, "", "k1")
+	start := func(root string, keys string) (pb.ImageUploadServiceClient, context.Context) {
+		_, c := newTestServer(t, func(cfg *Config) {
+			cfg.Storage.Root = root
+			cfg.Encryption.KeyFile = keys
+			cfg.Backup.Dir = dir
+			cfg.Auth.AdminTokens = []string{testAdminToken}
+		})
+		return c, withToken(context.Background(), testAdminToken)
+	}
+	// the same content stored in plain and encrypted
+	c, ctx := start(root, "")
+	mustUpload(t, ctx, c, "plain.img", []byte("same"))
+	c, ctx = start(root, keys)
+	mustUpload(t, ctx, c, "encrypted.img", []byte("same"))
+	if _, err := c.Backup(ctx, &pb.BackupRequest{Name: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, _ := ioutil.ReadDir(filepath.Join(dir, "b1", backupBlobs)); len(blobs) != 2 {
+		t.Fatalf("backup holds %d blobs", len(blobs))
+	}
+
+	c, ctx = start(t.TempDir(), keys)
+	if _, err := c.RestoreBackup(ctx, &pb.BackupRequest{Name: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"plain.img", "encrypted.img"} {
+		if got, err := downloadImage(ctx, c, name); err != nil || string(got) != "same" {
+			t.Fatalf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	// encrypted blobs cannot be read without the key file
+	c, ctx = start(t.TempDir(), "")
+	_, err := c.RestoreBackup(ctx, &pb.BackupRequest{Name: "b1"})
+	wantCode(t, err, codes.FailedPrecondition, "no encryption key file")
+}
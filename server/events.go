@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	pb "tages/service/proto"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// resumeTokenKey is the header carrying the position of a watch when it
+// starts, so that a client can resume even if no event arrived yet.
+const resumeTokenKey = "x-resume-token"
+
+// eventLog keeps the last changes to the store in memory for WatchImages.
+// Every event has a sequence number; resume tokens are "<epoch>-<seq>", the
+// epoch telling tokens of an earlier server run apart.
+type eventLog struct {
+	epoch string
+	size  int
+
+	mu     sync.Mutex
+	events []*pb.ImageEvent
+	seq    uint64 // of the last event
+	// changed is closed and replaced on every event, waking the watchers
+	changed chan struct{}
+	closed  bool
+	hooks   *webhooks
+}
+
+func newEventLog(size int, hooks *webhooks) *eventLog {
+	return &eventLog{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:    size,
+		changed: make(chan struct{}),
+		hooks:   hooks,
+	}
+}
+
+func (l *eventLog) token(seq uint64) string {
+	return l.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// publish records a change. info only needs the name for deletions.
+func (l *eventLog) publish(typ pb.ImageEvent_Type, info *pb.ImageInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.events = append(l.events, &pb.ImageEvent{
+		Type:        typ,
+		Info:        info,
+		ResumeToken: l.token(l.seq),
+		Time:        time.Now().UnixNano(),
+	})
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+	// under the lock, so that webhooks see the events in order
+	l.hooks.notify(l.events[len(l.events)-1])
+	if !l.closed {
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+}
+
+// close ends all watches; it is called on shutdown so that they do not hold
+// up the graceful stop. Uploads still finishing are recorded and sent to
+// webhooks.
+func (l *eventLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.changed)
+	}
+}
+
+// resume returns the sequence number a watch resumes after.
+func (l *eventLog) resume(token string) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if token == "" {
+		return l.seq, nil
+	}
+	i := strings.LastIndex(token, "-")
+	seq, err := strconv.ParseUint(token[i+1:], 10, 64)
+	if i < 0 || err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid resume token %q", token)
+	}
+	if token[:i] != l.epoch || seq > l.seq {
+		return 0, status.Error(codes.OutOfRange, "resume token is from an earlier server run; list the images and watch again")
+	}
+	if oldest := l.seq - uint64(len(l.events)); seq < oldest {
+		return 0, status.Errorf(codes.OutOfRange, "resume token expired: %d events since were dropped; list the images and watch again", oldest-seq)
+	}
+	return seq, nil
+}
+
+// since returns the events after seq and a channel closed on the next one.
+func (l *eventLog) since(seq uint64) ([]*pb.ImageEvent, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	oldest := l.seq - uint64(len(l.events))
+	if seq < oldest {
+		return nil, nil, status.Error(codes.OutOfRange, "watch fell behind the event log; list the images and watch again")
+	}
+	return l.events[len(l.events)-int(l.seq-seq):], l.changed, nil
+}
+
+func (s *server) WatchImages(req *pb.WatchImagesRequest, stream pb.ImageUploadService_WatchImagesServer) error {
+	seq, err := s.events.resume(req.GetResumeToken())
+	if err != nil {
+		return err
+	}
+	if err := stream.SendHeader(metadata.Pairs(resumeTokenKey, s.events.token(seq))); err != nil {
+		return err
+	}
+	prefix := req.GetPrefix()
+	for {
+		events, changed, err := s.events.since(seq)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			seq++
+			if !strings.HasPrefix(ev.GetInfo().GetName(), prefix) {
+				continue
+			}
+			if err := stream.Send(ev); err != nil {
+				return status.Errorf(codes.Unknown, "cannot send event: %v", err)
+			}
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-changed:
+		}
+	}
+}
+
+// publishStored reports an image created or replaced by an upload and
+// returns its info, or nil if it is gone already.
+func (s *server) publishStored(ctx context.Context, name string, replaced bool) *pb.ImageInfo {
+	fi, err := s.store.stat(ctx, name)
+	if err != nil {
+		loggerFrom(ctx).Warn("cannot stat stored image", "name", name, "error", err)
+		return nil
+	}
+	typ := pb.ImageEvent_CREATED
+	if replaced {
+		typ = pb.ImageEvent_UPDATED
+	}
+	info := s.imageInfo(ctx, fi)
+	s.events.publish(typ, info)
+	return info
+}
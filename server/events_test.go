@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "tages/service/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func publishNames(l *eventLog, names ...string) {
+	for _, name := range names {
+		l.publish(pb.ImageEvent_CREATED, &pb.ImageInfo{Name: name})
+	}
+}
+
+func TestEventLogResume(t *testing.T) {
+	l := newEventLog(3, nil)
+	publishNames(l, "a", "b", "c", "d", "e")
+
+	// the oldest retained event is 3, so a watch may resume after 2
+	seq, err := l.resume(l.token(2))
+	if err != nil || seq != 2 {
+		t.Fatalf("got %d, %v", seq, err)
+	}
+	events, _, err := l.since(seq)
+	if err != nil || len(events) != 3 || events[0].GetInfo().GetName() != "c" {
+		t.Fatalf("got %v, %v", events, err)
+	}
+
+	for token, want := range map[string]codes.Code{
+		l.token(1):    codes.OutOfRange,
+		l.token(6):    codes.OutOfRange,
+		"other-3":     codes.OutOfRange,
+		"garbage":     codes.InvalidArgument,
+		l.epoch + "-": codes.InvalidArgument,
+	} {
+		if _, err := l.resume(token); status.Code(err) != want {
+			t.Errorf("%s: got %v, want %s", token, err, want)
+		}
+	}
+	if _, err := l.resume(l.token(1)); !strings.Contains(err.Error(), "expired") {
+		t.Errorf("got %v", err)
+	}
+	if _, _, err := l.since(1); status.Code(err) != codes.OutOfRange {
+		t.Errorf("fell behind: got %v", err)
+	}
+}
+
+// eventStream is a WatchImages stream collecting the events sent.
+type eventStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	header metadata.MD
+	sent   chan *pb.ImageEvent
+}
+
+func (s *eventStream) Context() context.Context { return s.ctx }
+
+func (s *eventStream) SendHeader(md metadata.MD) error {
+	s.header = md
+	return nil
+}
+
+func (s *eventStream) Send(ev *pb.ImageEvent) error {
+	s.sent <- ev
+	return nil
+}
+
+func TestWatchImagesFiltersByPrefix(t *testing.T) {
+	s := &server{events: newEventLog(10, nil)}
+	publishNames(s.events, "photos/old")
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &eventStream{ctx: ctx, sent: make(chan *pb.ImageEvent, 10)}
+	done := make(chan error)
+	go func() {
+		done <- s.WatchImages(&pb.WatchImagesRequest{Prefix: "photos/", ResumeToken: s.events.token(0)}, stream)
+	}()
+	publishNames(s.events, "other/a", "photos/b")
+
+	for _, want := range []string{"photos/old", "photos/b"} {
+		select {
+		case ev := <-stream.sent:
+			if ev.GetInfo().GetName() != want {
+				t.Fatalf("got %s, want %s", ev.GetInfo().GetName(), want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not sent", want)
+		}
+	}
+	cancel()
+	if err := <-done; status.Code(err) != codes.Canceled {
+		t.Fatalf("got %v", err)
+	}
+	if len(stream.sent) > 0 {
+		t.Fatalf("sent %v", <-stream.sent)
+	}
+	if got := stream.header.Get(resumeTokenKey); len(got) != 1 || got[0] != s.events.token(0) {
+		t.Fatalf("header token %v", got)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newGRPCWebHandler lets browsers call the gRPC services of s through the
+// gRPC-Web protocol. Calls go through the same interceptors, so auth tokens
+// are sent as an "authorization" header. Server streaming such as
+// DownloadImage works over plain HTTP; client streaming (UploadImage) needs
+// the websocket transport of the improbable-eng client, enabled by
+// cfg.Websockets.
+func newGRPCWebHandler(s *grpc.Server, cfg GRPCWebConfig, maxMsgSize int) http.Handler {
+	allowed := originMatcher(cfg.AllowedOrigins)
+	wrapped := grpcweb.WrapServer(s,
+		grpcweb.WithOriginFunc(allowed),
+		grpcweb.WithWebsockets(cfg.Websockets),
+		grpcweb.WithWebsocketOriginFunc(func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+				return true
+			}
+			return allowed(origin)
+		}),
+		grpcweb.WithWebsocketsMessageReadLimit(int64(maxMsgSize)),
+		// keeps long downloads alive behind proxies dropping idle connections
+		grpcweb.WithWebsocketPingInterval(30*time.Second),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wrapped.IsGrpcWebRequest(r) || wrapped.IsAcceptableGrpcCorsRequest(r) || wrapped.IsGrpcWebSocketRequest(r) {
+			wrapped.ServeHTTP(w, r)
+			return
+		}
+		writeError(w, status.Error(codes.NotFound, "only gRPC-Web requests are served here"))
+	})
+}
+
+// originMatcher accepts the listed origins, e.g. "https://dash.example.com",
+// or any origin if the list contains "*".
+func originMatcher(origins []string) func(string) bool {
+	set := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		set[o] = true
+	}
+	return func(origin string) bool {
+		return set["*"] || set[origin]
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// imageServiceName is the fully qualified name health clients ask about.
+const imageServiceName = "proto.ImageUploadService"
+
+// checkStorage reports why the storage cannot accept uploads, or nil if it
+// can: the directory must be writable and, where the system tells, have at
+// least minFree bytes left.
+func (st *storage) checkStorage(minFree uint64) error {
+	f, err := ioutil.TempFile(filepath.Join(st.root, uploadsDir), "*.health")
+	if err != nil {
+		return fmt.Errorf("storage is not writable: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	free, ok, err := freeSpace(st.root)
+	if err != nil {
+		return fmt.Errorf("cannot stat storage filesystem: %w", err)
+	}
+	if ok && free < minFree {
+		return fmt.Errorf("storage is almost full: %d bytes free, need %d", free, minFree)
+	}
+	return nil
+}
+
+// watchHealth updates hs with the storage status every interval until ctx is
+// done. Both the overall server ("") and the image service are reported.
+func watchHealth(ctx context.Context, hs *health.Server, st *storage, cfg HealthConfig) {
+	last := healthpb.HealthCheckResponse_SERVING
+	check := func() {
+		servingStatus := healthpb.HealthCheckResponse_SERVING
+		err := st.checkStorage(cfg.MinFreeBytes)
+		if err != nil {
+			servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		// log transitions only, not every probe
+		if servingStatus != last {
+			if err != nil {
+				slog.Warn("storage unhealthy", "error", err)
+			} else {
+				slog.Info("storage healthy again")
+			}
+			last = servingStatus
+		}
+		hs.SetServingStatus("", servingStatus)
+		hs.SetServingStatus(imageServiceName, servingStatus)
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for check(); ; {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// freeSpace reports that the free space is unknown: Statfs_t differs
+// between the other Unix systems and is missing on Windows, so only
+// writability is checked there.
+func freeSpace(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	pb "tages/service/proto"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ImportArchive stores the regular files of a tar, tar.gz or zip archive as
+// images, named after their path in the archive behind an optional prefix.
+// The format is recognised from the first bytes. Tar archives are extracted
+// while they arrive; zip archives keep their index at the end, so they are
+// received into a temporary file first. Every entry goes through the same
+// checks as UploadImage and gets its own result; an unreadable archive ends
+// the import with a last failed entry, keeping the images stored so far.
+func (s *server) ImportArchive(stream pb.ImageUploadService_ImportArchiveServer) (err error) {
+	done := s.stats.begin()
+	tl := newTransferLog(stream.Context())
+	defer func() {
+		done(err)
+		tl.finish(err)
+	}()
+
+	// extracting a received zip archive moves no data over the stream
+	var written int64
+	progress := func() int64 { return tl.progress() + atomic.LoadInt64(&written) }
+	return withStallTimeout(stream.Context(), s.cfg.Limits.StallTimeout, progress, func(ctx context.Context) error {
+		return s.receiveArchive(ctx, stream, tl, &written)
+	})
+}
+
+func (s *server) receiveArchive(ctx context.Context, stream pb.ImageUploadService_ImportArchiveServer, tl *transferLog, written *int64) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return status.Errorf(status.Code(err), "cannot receive import options: %v", err)
+	}
+	if req.GetOptions() == nil {
+		return status.Error(codes.InvalidArgument, "the first message must carry the import options")
+	}
+	tl.setName("import of " + req.GetOptions().GetPrefix() + "*")
+
+	sr := &streamReader{stream: stream, tl: tl}
+	im := &importer{s: s, prefix: req.GetOptions().GetPrefix(), written: written}
+	br := bufio.NewReader(sr)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			im.archiveFailed(sr, err)
+			break
+		}
+		im.readTar(ctx, tar.NewReader(gz), sr)
+	case bytes.HasPrefix(magic, []byte("PK")):
+		im.readZip(ctx, br, sr)
+	default:
+		im.readTar(ctx, tar.NewReader(br), sr)
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+
+	failed := 0
+	for _, e := range im.results {
+		if e.Code != 0 {
+			failed++
+		}
+	}
+	loggerFrom(ctx).Info("archive imported", "entries", len(im.results), "failed", failed)
+	if err := stream.SendAndClose(&pb.ImportArchiveResponse{Entries: im.results}); err != nil {
+		return status.Errorf(codes.Unknown, "cannot send response: %v", err)
+	}
+	return nil
+}
+
+// streamReader reads the archive data of an ImportArchive stream. err keeps
+// the first receive error, which ends the import, unlike a bad archive.
+type streamReader struct {
+	stream pb.ImageUploadService_ImportArchiveServer
+	tl     *transferLog
+	buf    []byte
+	err    error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		req, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			r.err = status.Errorf(status.Code(err), "cannot receive archive data: %v", err)
+			return 0, r.err
+		}
+		r.buf = req.GetChunkdata()
+		r.tl.add(len(r.buf))
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+type importer struct {
+	s       *server
+	prefix  string
+	written *int64
+	results []*pb.ImportEntryResult
+}
+
+// archiveFailed reports an unreadable archive, unless the stream failed.
+func (im *importer) archiveFailed(sr *streamReader, err error) {
+	if sr.err != nil {
+		return
+	}
+	im.results = append(im.results, &pb.ImportEntryResult{
+		Code:  int32(codes.InvalidArgument),
+		Error: "cannot read archive: " + err.Error(),
+	})
+}
+
+func (im *importer) readTar(ctx context.Context, tr *tar.Reader, sr *streamReader) {
+	for ctx.Err() == nil {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			im.archiveFailed(sr, err)
+			return
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+		case tar.TypeReg:
+			im.store(ctx, hdr.Name, tr, hdr.Size, hdr.ModTime)
+			if sr.err != nil {
+				return
+			}
+		default:
+			im.skip(hdr.Name)
+		}
+	}
+}
+
+// readZip receives the archive into the uploads directory, where it is
+// removed on shutdown if the import does not finish. An archive larger than
+// limits.max_archive_size ends the import.
+func (im *importer) readZip(ctx context.Context, r io.Reader, sr *streamReader) {
+	max := im.s.cfg.Limits.MaxArchiveSize
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	f, err := ioutil.TempFile(filepath.Join(im.s.store.root, uploadsDir), "import-*.partial")
+	if err != nil {
+		sr.err = status.Errorf(codes.Internal, "cannot create temporary archive: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if sr.err != nil {
+		return
+	}
+	if err != nil {
+		sr.err = status.Errorf(codes.Internal, "cannot write temporary archive: %v", err)
+		return
+	}
+	if max > 0 && size > max {
+		sr.err = status.Errorf(codes.ResourceExhausted, "zip archive is too large: limit is %d bytes", max)
+		return
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		im.archiveFailed(sr, err)
+		return
+	}
+	for _, e := range zr.File {
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case e.Mode().IsDir():
+		case e.Mode().IsRegular():
+			rc, err := e.Open()
+			if err != nil {
+				im.failed(e.Name, im.name(e.Name), uploadFailed(failReceive, status.Errorf(codes.InvalidArgument, "cannot read entry: %v", err)))
+				continue
+			}
+			im.store(ctx, e.Name, rc, int64(e.UncompressedSize64), e.Modified)
+			rc.Close()
+		default:
+			im.skip(e.Name)
+		}
+	}
+}
+
+func (im *importer) skip(entry string) {
+	im.failed(entry, im.name(entry), status.Error(codes.InvalidArgument, "not a regular file"))
+}
+
+func (im *importer) name(entry string) string {
+	return im.prefix + strings.TrimPrefix(entry, "./")
+}
+
+func (im *importer) failed(entry, name string, err error) {
+	st := status.Convert(err)
+	im.results = append(im.results, &pb.ImportEntryResult{Entry: entry, Name: name, Code: int32(st.Code()), Error: st.Message()})
+}
+
+// fallbackEntrySize caps entries without limits.max_file_size when the free
+// disk space is unknown.
+const fallbackEntrySize = 4 << 30
+
+// maxEntrySize is limits.max_file_size or, without it, the free disk space
+// above health.min_free_bytes: the size in an entry header is chosen by the
+// sender.
+func (im *importer) maxEntrySize() int64 {
+	if max := im.s.cfg.Limits.MaxFileSize; max > 0 {
+		return max
+	}
+	free, ok, err := freeSpace(im.s.store.root)
+	if err != nil || !ok {
+		return fallbackEntrySize
+	}
+	min := im.s.cfg.Health.MinFreeBytes
+	switch {
+	case free <= min:
+		return 0
+	case free-min > math.MaxInt64:
+		return math.MaxInt64
+	}
+	return int64(free - min)
+}
+
+// store saves one entry of size bytes as an image.
+func (im *importer) store(ctx context.Context, entry string, r io.Reader, size int64, modTime time.Time) {
+	name := im.name(entry)
+	if max := im.maxEntrySize(); size > max {
+		im.failed(entry, name, uploadFailed(failTooLarge, status.Errorf(codes.ResourceExhausted, "image is too large: limit is %d bytes", max)))
+		return
+	}
+	up, err := im.s.store.create(ctx, name)
+	if err == errInvalidName {
+		im.failed(entry, name, uploadFailed(failInvalidName, status.Errorf(codes.InvalidArgument, "invalid image name %q", name)))
+		return
+	}
+	if err != nil {
+		im.failed(entry, name, uploadFailed(failWrite, status.Errorf(codes.Internal, "cannot create image: %v", err)))
+		return
+	}
+	defer up.abort()
+	if !modTime.IsZero() {
+		up.modTime = modTime
+	}
+
+	// the size in the header is not trusted: zip entries could inflate to
+	// anything
+	n, err := io.Copy(&countingWriter{w: up, n: im.written}, io.LimitReader(r, size+1))
+	switch {
+	case err != nil:
+		im.failed(entry, name, uploadFailed(failReceive, status.Errorf(codes.InvalidArgument, "cannot read entry: %v", err)))
+		return
+	case n != size:
+		im.failed(entry, name, uploadFailed(failReceive, status.Errorf(codes.InvalidArgument, "entry has %d bytes instead of %d", n, size)))
+		return
+	}
+
+	// a stalled import keeps the images stored before, but stores no more
+	err = unlessStalled(ctx, false, func() error { return up.commit(ctx) })
+	if err == errStalled {
+		return
+	}
+	if err == errNameConflict {
+		im.failed(entry, name, uploadFailed(failInvalidName, status.Errorf(codes.FailedPrecondition, "cannot save %q: %v", name, err)))
+		return
+	}
+	if err != nil {
+		im.failed(entry, name, uploadFailed(failCommit, status.Errorf(codes.Internal, "cannot save image to the store: %v", err)))
+		return
+	}
+	info := im.s.publishStored(ctx, name, up.replaced)
+	im.results = append(im.results, &pb.ImportEntryResult{Entry: entry, Name: name, Size: info.GetSize()})
+}
+
+// countingWriter adds the bytes written to n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+
+	pb "tages/service/proto"
+)
+
+func importArchive(ctx context.Context, c pb.ImageUploadServiceClient, prefix string, data []byte) (*pb.ImportArchiveResponse, error) {
+	stream, err := c.ImportArchive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&pb.ImportArchiveRequest{Data: &pb.ImportArchiveRequest_Options{Options: &pb.ImportArchiveOptions{Prefix: prefix}}}); err != nil {
+		return nil, err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > 32<<10 {
+			n = 32 << 10
+		}
+		// a failed import closes the stream; its status comes with the response
+		if stream.Send(&pb.ImportArchiveRequest{Data: &pb.ImportArchiveRequest_Chunkdata{Chunkdata: data[:n]}}) != nil {
+			break
+		}
+		data = data[n:]
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestImportTar(t *testing.T) {
+	_, c := newTestServer(t, func(cfg *Config) { cfg.Limits.MaxFileSize = 8 })
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mtime := time.Unix(1700000000, 0)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "dir/a.img", Size: 3, Mode: 0644, ModTime: mtime},
+		{Typeflag: tar.TypeReg, Name: "big.img", Size: 9, Mode: 0644},
+		{Typeflag: tar.TypeSymlink, Name: "link.img", Linkname: "dir/a.img"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+	}
+	tw.Close()
+
+	res, err := importArchive(context.Background(), c, "old/", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name string
+		code codes.Code
+	}{{"old/dir/a.img", codes.OK}, {"old/big.img", codes.ResourceExhausted}, {"old/link.img", codes.InvalidArgument}}
+	if len(res.Entries) != len(want) {
+		t.Fatalf("got %v", res.Entries)
+	}
+	for i, w := range want {
+		if e := res.Entries[i]; e.Name != w.name || codes.Code(e.Code) != w.code {
+			t.Errorf("entry %d: got %v, want %s %s", i, e, w.name, w.code)
+		}
+	}
+	info, err := c.StatImage(context.Background(), &wrappers.StringValue{Value: "old/dir/a.img"})
+	if err != nil || info.Size != 3 || info.Mtime != mtime.UnixNano() {
+		t.Fatalf("got %v, %v", info, err)
+	}
+}
+
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportZip(t *testing.T) {
+	_, c := newTestServer(t, nil)
+	res, err := importArchive(context.Background(), c, "", zipArchive(t, map[string]string{"a.img": "aaa", "b/c.img": "cc"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 2 {
+		t.Fatalf("got %v", res.Entries)
+	}
+	for _, e := range res.Entries {
+		if e.Code != 0 {
+			t.Errorf("entry %s failed: %s", e.Entry, e.Error)
+		}
+	}
+	got, err := downloadImage(context.Background(), c, "b/c.img")
+	if err != nil || string(got) != "cc" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestImportEntryOverFreeSpace(t *testing.T) {
+	_, c := newTestServer(t, func(cfg *Config) { cfg.Health.MinFreeBytes = 1 << 62 })
+	res, err := importArchive(context.Background(), c, "", zipArchive(t, map[string]string{"a.img": "aaa"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || codes.Code(res.Entries[0].Code) != codes.ResourceExhausted {
+		t.Fatalf("got %v", res.Entries)
+	}
+}
+
+func TestImportZipTooLarge(t *testing.T) {
+	srv, c := newTestServer(t, func(cfg *Config) { cfg.Limits.MaxArchiveSize = 1 << 10 })
+	// stored uncompressed to exceed the limit
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "a.img", Method: zip.Store})
+	w.Write(bytes.Repeat([]byte{0}, 2<<10))
+	zw.Close()
+	_, err := importArchive(context.Background(), c, "", buf.Bytes())
+	wantCode(t, err, codes.ResourceExhausted, "too large")
+
+	// nothing is stored and the spooled archive is gone
+	if _, err := c.StatImage(context.Background(), &wrappers.StringValue{Value: "a.img"}); err == nil {
+		t.Fatal("an image was stored")
+	}
+	left, err := ioutil.ReadDir(filepath.Join(srv.store.root, uploadsDir))
+	if err != nil || len(left) != 0 {
+		t.Fatalf("uploads directory holds %d files, %v", len(left), err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDKey is the metadata key carrying the request ID. Clients may set
+// it; otherwise the server generates one. It is echoed in the response
+// header either way.
+const requestIDKey = "x-request-id"
+
+type loggerKey struct{}
+
+func newLogger(cfg LogConfig, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLevel(cfg.Level)}
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// loggerFrom returns the per-RPC logger stored by the logging interceptors,
+// or the default logger outside of an RPC.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// rpcContext attaches a logger carrying the request ID, method and peer to
+// ctx, and returns the request ID to echo back to the client.
+func rpcContext(ctx context.Context, fullMethod string) (context.Context, string) {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDKey); len(v) > 0 && len(v[0]) <= 64 {
+			id = v[0]
+		}
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	peerAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		peerAddr = p.Addr.String()
+	}
+	l := slog.Default().With("request_id", id, "method", path.Base(fullMethod), "peer", peerAddr)
+	return context.WithValue(ctx, loggerKey{}, l), id
+}
+
+func loggingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, id := rpcContext(ctx, info.FullMethod)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	l := loggerFrom(ctx)
+	if err != nil {
+		l.Warn("request failed", "code", status.Code(err).String(), "error", status.Convert(err).Message(),
+			"duration_ms", time.Since(start).Milliseconds())
+	} else {
+		l.Debug("request handled", "duration_ms", time.Since(start).Milliseconds())
+	}
+	return resp, err
+}
+
+// loggingStream overrides the stream context with one carrying the logger.
+type loggingStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggingStream) Context() context.Context {
+	return s.ctx
+}
+
+func loggingStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, id := rpcContext(ss.Context(), info.FullMethod)
+	ss.SetHeader(metadata.Pairs(requestIDKey, id))
+	return handler(srv, &loggingStream{ServerStream: ss, ctx: ctx})
+}
+
+// transferLog collects what is needed for the single summary line logged at
+// the end of every upload or download. The transfer itself may run on
+// another goroutine (see withStallTimeout), hence the lock.
+type transferLog struct {
+	ctx    context.Context
+	start  time.Time
+	mu     sync.Mutex
+	name   string
+	bytes  int64
+	offset int64 // where a resumed download started
+}
+
+func newTransferLog(ctx context.Context) *transferLog {
+	return &transferLog{ctx: ctx, start: time.Now()}
+}
+
+func (t *transferLog) setName(name string) {
+	t.mu.Lock()
+	t.name = name
+	t.mu.Unlock()
+}
+
+func (t *transferLog) setOffset(offset int64) {
+	t.mu.Lock()
+	t.offset = offset
+	t.mu.Unlock()
+}
+
+func (t *transferLog) add(n int) {
+	t.mu.Lock()
+	t.bytes += int64(n)
+	t.mu.Unlock()
+}
+
+// progress returns the number of bytes transferred so far.
+func (t *transferLog) progress() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bytes
+}
+
+func (t *transferLog) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := time.Since(t.start)
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = float64(t.bytes) / elapsed.Seconds()
+	}
+	attrs := []any{
+		"name", t.name,
+		"bytes", t.bytes,
+		"duration_ms", elapsed.Milliseconds(),
+		"bytes_per_sec", int64(throughput),
+	}
+	if t.offset > 0 {
+		attrs = append(attrs, "resumed_at", t.offset)
+	}
+	l := loggerFrom(t.ctx)
+	if err != nil {
+		attrs = append(attrs, "outcome", status.Code(err).String(), "error", status.Convert(err).Message())
+		l.Warn("transfer failed", attrs...)
+		return
+	}
+	attrs = append(attrs, "outcome", "OK")
+	l.Info("transfer finished", attrs...)
+}
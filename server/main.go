@@ -1,37 +1,256 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
 	pb "tages/service/proto"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
-)
-
-const (
-	port = ":50051"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 func main() {
-	lis, err := net.Listen("tcp", port)
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("cannot load configuration", err)
+	}
+	slog.SetDefault(newLogger(cfg.Log, os.Stderr))
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("cannot set up tracing", err)
+	}
+
+	lis, err := net.Listen("tcp", cfg.Listen)
 
 	if err != nil {
-		log.Fatal("failed to listen: %v", err)
+		fatal("failed to listen", err)
 	}
 
+	var keys *keyring
+	if cfg.Encryption.KeyFile != "" {
+		if keys, err = loadKeyring(cfg.Encryption.KeyFile); err != nil {
+			fatal("cannot load encryption keys", err)
+		}
+	}
 	//create files directory
-	err = os.Mkdir("files", 0777)
+	store, err := newStorage(cfg.Storage.Root, keys)
+	if err != nil {
+		fatal("cannot open storage", err)
+	}
+	if n, err := store.cleanPartial(); err != nil {
+		slog.Warn("cannot clean up partial uploads", "error", err)
+	} else if n > 0 {
+		slog.Info("removed partial uploads left by a previous run", "count", n)
+	}
+
+	auth := newAuthenticator(cfg.Auth.Tokens, cfg.Auth.AdminTokens)
+	opts := []grpc.ServerOption{
+		grpc.MaxConcurrentStreams(cfg.Limits.MaxConcurrentStreams),
+		grpc.MaxRecvMsgSize(cfg.Limits.MaxRecvMsgSize),
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), loggingUnaryInterceptor, metricsUnaryInterceptor, auth.unary),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), loggingStreamInterceptor, metricsStreamInterceptor, auth.stream),
+	}
+	if len(cfg.Auth.Tokens)+len(cfg.Auth.AdminTokens) > 0 && !cfg.TLS.Enabled() {
+		slog.Warn("auth tokens are sent in clear text because TLS is disabled")
+	}
+	var tlsCfg *tls.Config
+	if cfg.TLS.Enabled() {
+		tlsCfg, err = serverTLSConfig(cfg.TLS)
+		if err != nil {
+			fatal("cannot set up TLS", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+
+	s := grpc.NewServer(opts...)
+	deadLetter := cfg.Webhooks.DeadLetterFile
+	if deadLetter == "" {
+		deadLetter = filepath.Join(cfg.Storage.Root, metaDir, "webhooks-dead-letter.jsonl")
+	}
+	hooks := newWebhooks(cfg.Webhooks, deadLetter)
+	shares, err := openShares(cfg.Share.Secret, filepath.Join(cfg.Storage.Root, metaDir))
+	if err != nil {
+		fatal("cannot open share links", err)
+	}
+	srv := &server{cfg: cfg, store: store, events: newEventLog(cfg.Events.LogSize, hooks), shares: shares}
+	pb.RegisterImageUploadServiceServer(s, srv)
+
+	var hs *health.Server
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	defer stopHealth()
+	if cfg.Health.Enabled {
+		hs = health.NewServer()
+		healthpb.RegisterHealthServer(s, hs)
+		go watchHealth(healthCtx, hs, store, cfg.Health)
+	}
+	if cfg.Reflection {
+		reflection.Register(s)
+	}
+
+	var metricsServer *http.Server
+	if cfg.Metrics.Listen != "" {
+		metricsServer = serveMetrics(cfg.Metrics.Listen, store)
+	}
+
+	var httpServers []*http.Server
+	if cfg.HTTP.Listen != "" {
+		httpServers = append(httpServers, serveHTTP("REST gateway", cfg.HTTP.Listen, tlsCfg, newRESTHandler(srv, auth)))
+	}
+	if cfg.GRPCWeb.Listen != "" {
+		h := newGRPCWebHandler(s, cfg.GRPCWeb, cfg.Limits.MaxRecvMsgSize)
+		httpServers = append(httpServers, serveHTTP("gRPC-Web", cfg.GRPCWeb.Listen, tlsCfg, h))
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting gRPC listener", "addr", cfg.Listen, "tls", cfg.TLS.Enabled())
+		serveErr <- s.Serve(lis)
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal("failed to serve", err)
+	case sig := <-sigs:
+		slog.Info("shutting down", "signal", sig.String(),
+			"in_flight", atomic.LoadInt64(&srv.stats.inFlight), "grace_period", cfg.ShutdownGracePeriod)
+	}
+
+	if hs != nil {
+		// tell load balancers to stop routing here before draining
+		stopHealth()
+		hs.Shutdown()
+	}
+	// watches never end on their own
+	srv.events.close()
+	for _, hs := range httpServers {
+		go hs.Shutdown(context.Background())
+	}
+	shutdown(s, cfg.ShutdownGracePeriod, sigs)
+	for _, hs := range httpServers {
+		// requests still running once the gRPC transfers are done or
+		// cancelled are cut off too
+		hs.Close()
+	}
+	// Stop closes the connections but handlers may still be unwinding
+	if !srv.stats.wait(5 * time.Second) {
+		slog.Warn("some transfers did not stop in time")
+	}
+
+	hooks.stop(5 * time.Second)
+
+	removed, err := store.cleanPartial()
 	if err != nil {
-		fmt.Println("Directry already exists")
+		slog.Warn("cannot clean up partial uploads", "error", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("cannot flush traces", "error", err)
 	}
+	slog.Info("server stopped",
+		"completed", atomic.LoadInt64(&srv.stats.completed),
+		"failed", atomic.LoadInt64(&srv.stats.failed),
+		"partial_uploads_removed", removed)
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// shutdown stops accepting new RPCs and waits for running ones to finish.
+// Transfers still running after grace, or when a second signal arrives, are
+// cancelled.
+func shutdown(s *grpc.Server, grace time.Duration, sigs <-chan os.Signal) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
 
-	s := grpc.NewServer()
-	pb.RegisterImageUploadServiceServer(s, &server{})
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-stopped:
+		return
+	case <-timer.C:
+		slog.Warn("grace period expired, cancelling remaining transfers")
+	case sig := <-sigs:
+		slog.Warn("received second signal, cancelling remaining transfers", "signal", sig.String())
+	}
+	s.Stop()
+	<-stopped
+}
+
+func serverTLSConfig(c TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS key pair: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
 
-	log.Printf("Starting gRPC listener on port " + port)
-	if err := s.Serve(lis); err != nil {
-		log.Fatal("Failed to serve: %v", err)
+// serveHTTP starts serving h on addr, over TLS if tlsCfg is set. The
+// returned server is shut down by the caller.
+func serveHTTP(what, addr string, tlsCfg *tls.Config, h http.Handler) *http.Server {
+	hs := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		TLSConfig:         tlsCfg,
+		ReadHeaderTimeout: 30 * time.Second,
 	}
+	go func() {
+		slog.Info("starting "+what, "addr", addr, "tls", tlsCfg != nil)
+		var err error
+		if tlsCfg != nil {
+			err = hs.ListenAndServeTLS("", "")
+		} else {
+			err = hs.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("failed to serve "+what, err)
+		}
+	}()
+	return hs
 }
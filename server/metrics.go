@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "image_service"
+
+var (
+	rpcsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpcs_total",
+		Help:      "RPCs handled, by method and status code.",
+	}, []string{"method", "code"})
+
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Time spent handling RPCs, by method and status code.",
+		Buckets:   []float64{.005, .025, .1, .5, 1, 5, 15, 60, 300},
+	}, []string{"method", "code"})
+
+	transfersInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "transfers_in_flight",
+		Help:      "Streaming RPCs currently running, by method.",
+	}, []string{"method"})
+
+	bytesUploaded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes written to storage by uploads.",
+	})
+
+	bytesDownloaded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes read from storage and sent to clients.",
+	})
+
+	uploadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_failures_total",
+		Help:      "Failed uploads, by reason.",
+	}, []string{"reason"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Requests handled by the REST gateway, by HTTP method and status.",
+	}, []string{"method", "status"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts, by outcome: delivered, retried or dead_lettered.",
+	}, []string{"outcome"})
+)
+
+// reasons used for upload_failures_total
+const (
+	failInvalidName = "invalid_name"
+	failTooLarge    = "too_large"
+	failReceive     = "receive"
+	failWrite       = "write"
+	failCommit      = "commit"
+	failStalled     = "stalled"
+)
+
+// storageCollector reports the number and total size of stored images,
+// computed when the metrics are scraped.
+type storageCollector struct {
+	st    *storage
+	files *prometheus.Desc
+	bytes *prometheus.Desc
+}
+
+func newStorageCollector(st *storage) *storageCollector {
+	return &storageCollector{
+		st: st,
+		files: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "storage", "files"),
+			"Number of stored images.", nil, nil),
+		bytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "storage", "bytes"),
+			"Total size of stored images in bytes.", nil, nil),
+	}
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.files
+	ch <- c.bytes
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	files, err := c.st.list(context.Background(), "")
+	if err != nil {
+		slog.Warn("metrics: cannot list storage", "error", err)
+		return
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	ch <- prometheus.MustNewConstMetric(c.files, prometheus.GaugeValue, float64(len(files)))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(total))
+}
+
+func observeRPC(fullMethod string, start time.Time, err error) {
+	method := path.Base(fullMethod)
+	code := status.Code(err).String()
+	rpcsTotal.WithLabelValues(method, code).Inc()
+	rpcDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
+
+func metricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+func metricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	inFlight := transfersInFlight.WithLabelValues(path.Base(info.FullMethod))
+	inFlight.Inc()
+	err := handler(srv, ss)
+	inFlight.Dec()
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+// serveMetrics exposes /metrics on addr. The returned server is shut down
+// by the caller.
+func serveMetrics(addr string, st *storage) *http.Server {
+	prometheus.MustRegister(newStorageCollector(st))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	hs := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		slog.Info("serving metrics", "addr", addr, "path", "/metrics")
+		if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("failed to serve metrics", err)
+		}
+	}()
+	return hs
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	pb "tages/service/proto"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The REST gateway serves the image service over plain HTTP:
+//
+//	GET    /images?prefix=P  list images as JSON
+//	GET    /images/{name}    download, with Range, ETag and conditional requests
+//	HEAD   /images/{name}    headers only
+//	PUT    /images/{name}    upload the request body
+//	DELETE /images/{name}    delete
+//	GET    /share/{token}    download through a share link, without auth
+//
+// It works on the storage directly rather than through gRPC, and shares the
+// auth tokens, limits, events and webhooks of the gRPC service. Errors are
+// returned as {"error": "..."} with the HTTP status matching the gRPC code.
+type restGateway struct {
+	s    *server
+	auth *authenticator
+}
+
+const imagesPath = "/images"
+
+func newRESTHandler(s *server, auth *authenticator) http.Handler {
+	g := &restGateway{s: s, auth: auth}
+	mux := http.NewServeMux()
+	mux.HandleFunc(imagesPath, g.list)
+	mux.HandleFunc(imagesPath+"/", g.image)
+	mux.HandleFunc(sharePath, g.share)
+	return g.middleware(mux)
+}
+
+// restImage is the JSON form of an image.
+type restImage struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// statusWriter records the status and size of a response for the access log,
+// and pushes the write deadline forward on every write so that a client that
+// stops reading is cut off after the stall timeout.
+type statusWriter struct {
+	http.ResponseWriter
+	stall  time.Duration
+	status int
+	bytes  int64
+	err    error // of the first failed write
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.stall > 0 {
+		http.NewResponseController(w.ResponseWriter).SetWriteDeadline(time.Now().Add(w.stall))
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// middleware logs and counts every request and checks the bearer token.
+func (g *restGateway) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		l := slog.Default().With("request_id", id, "method", "HTTP "+r.Method, "path", r.URL.Path, "peer", r.RemoteAddr)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, l))
+		w.Header().Set("X-Request-Id", id)
+
+		sw := &statusWriter{ResponseWriter: w, stall: g.s.cfg.Limits.StallTimeout}
+		if strings.HasPrefix(r.URL.Path, sharePath) || g.auth.validBearer(r.Header.Get("Authorization")) {
+			next.ServeHTTP(sw, r)
+		} else {
+			l.Warn("rejected unauthenticated call")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(sw, status.Error(codes.Unauthenticated, "missing or invalid auth token"))
+		}
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, strconv.Itoa(sw.status)).Inc()
+		l.Debug("request handled", "status", sw.status, "bytes", sw.bytes, "duration_ms", time.Since(start).Milliseconds())
+	})
+}
+
+// httpStatus maps the gRPC codes used by the service to HTTP statuses.
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusRequestEntityTooLarge
+	case codes.DeadlineExceeded:
+		return http.StatusRequestTimeout
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.Canceled:
+		return 499 // client closed request, as in nginx
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	writeJSON(w, httpStatus(st.Code()), map[string]string{"error": st.Message()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+}
+
+func (g *restGateway) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+	files, err := g.s.store.list(r.Context(), r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, status.Errorf(codes.Internal, "cannot list images: %v", err))
+		return
+	}
+	images := make([]restImage, 0, len(files))
+	for _, f := range files {
+		info := g.s.imageInfo(r.Context(), f)
+		images = append(images, restImage{Name: info.Name, Size: info.Size, ModTime: f.ModTime().UTC(), SHA256: info.Sha256})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"images": images})
+}
+
+func (g *restGateway) image(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, imagesPath+"/")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		g.download(w, r, name, nil)
+	case http.MethodPut:
+		g.upload(w, r, name)
+	case http.MethodDelete:
+		if err := g.s.deleteImage(r.Context(), name); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+	}
+}
+
+// share serves the image of a share link as an attachment. A download is
+// counted once the image was opened; HEAD and Range requests are not counted.
+func (g *restGateway) share(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+	id, name, err := g.s.shares.redeem(strings.TrimPrefix(r.URL.Path, sharePath))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	g.download(w, r, name, func() error {
+		return g.s.shares.use(id, r.Header.Get("Range") != "", r.Method == http.MethodGet)
+	})
+}
+
+// download serves the image with http.ServeContent, which handles Range,
+// If-Range, If-None-Match and If-Modified-Since. The ETag is the SHA-256 of
+// the content and the Content-Type comes from the name's extension, or from
+// the content if the extension is unknown.
+func (g *restGateway) download(w http.ResponseWriter, r *http.Request, name string, opened func() error) {
+	ctx := r.Context()
+	f, info, err := g.s.store.open(ctx, name)
+	if err != nil {
+		writeError(w, storageError(err, name, "cannot open image file"))
+		return
+	}
+	defer f.Close()
+	if opened != nil {
+		if err := opened(); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	sum, err := g.s.store.digest(name, info)
+	if err != nil {
+		loggerFrom(ctx).Warn("cannot compute image digest", "name", name, "error", err)
+	} else {
+		w.Header().Set("ETag", `"`+sum+`"`)
+	}
+	done := g.s.stats.begin()
+	tl := newTransferLog(ctx)
+	tl.setName(name)
+	cw := &countingSeeker{ReadSeeker: f, tl: tl}
+	http.ServeContent(w, r, name, info.ModTime(), cw)
+	// ServeContent answers errors itself, but does not report the client
+	// going away or no longer reading
+	switch {
+	case ctx.Err() != nil:
+		err = status.FromContextError(ctx.Err()).Err()
+	case writeErr(w) != nil:
+		err = status.Errorf(codes.Unavailable, "cannot send image: %v", writeErr(w))
+	default:
+		err = nil
+	}
+	done(err)
+	if r.Method == http.MethodGet {
+		tl.finish(err)
+	}
+}
+
+func writeErr(w http.ResponseWriter) error {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw.err
+	}
+	return nil
+}
+
+// countingSeeker counts the bytes served for the transfer log and metrics.
+type countingSeeker struct {
+	io.ReadSeeker
+	tl *transferLog
+}
+
+func (c *countingSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.tl.add(n)
+	bytesDownloaded.Add(float64(n))
+	return n, err
+}
+
+// upload stores the request body under name, answering 201 Created for a
+// new image and 200 OK when it replaced one.
+func (g *restGateway) upload(w http.ResponseWriter, r *http.Request, name string) {
+	done := g.s.stats.begin()
+	tl := newTransferLog(r.Context())
+	tl.setName(name)
+	info, replaced, err := g.s.storeBody(w, r, name, tl)
+	done(err)
+	tl.finish(err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	code := http.StatusCreated
+	if replaced {
+		code = http.StatusOK
+	} else {
+		w.Header().Set("Location", imagesPath+"/"+name)
+	}
+	w.Header().Set("ETag", `"`+info.GetSha256()+`"`)
+	writeJSON(w, code, restImage{Name: name, Size: info.GetSize(), ModTime: time.Unix(0, info.GetMtime()).UTC(), SHA256: info.GetSha256()})
+}
+
+// storeBody receives the request body into a new upload. The read deadline
+// is pushed forward before every read, so that a client that stops sending
+// is cut off after the stall timeout.
+func (s *server) storeBody(w http.ResponseWriter, r *http.Request, name string, tl *transferLog) (*pb.ImageInfo, bool, error) {
+	ctx := r.Context()
+	up, err := s.store.create(ctx, name)
+	if err == errInvalidName {
+		return nil, false, uploadFailed(failInvalidName, status.Errorf(codes.InvalidArgument, "invalid image name %q", name))
+	}
+	if err != nil {
+		return nil, false, uploadFailed(failWrite, status.Errorf(codes.Internal, "cannot create image: %v", err))
+	}
+	defer up.abort()
+
+	max, stall := s.cfg.Limits.MaxFileSize, s.cfg.Limits.StallTimeout
+	tooLarge := func() error {
+		return uploadFailed(failTooLarge, status.Errorf(codes.ResourceExhausted, "image is too large: limit is %d bytes", max))
+	}
+	if max > 0 && r.ContentLength > max {
+		return nil, false, tooLarge()
+	}
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		if stall > 0 {
+			rc.SetReadDeadline(time.Now().Add(stall))
+		}
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			if max > 0 && up.size+int64(n) > max {
+				return nil, false, tooLarge()
+			}
+			if _, err := up.Write(buf[:n]); err != nil {
+				return nil, false, uploadFailed(failWrite, status.Errorf(codes.Internal, "cannot write image data: %v", err))
+			}
+			tl.add(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil, false, uploadFailed(failStalled, status.Errorf(codes.DeadlineExceeded, "transfer stalled: no data for %s", stall))
+		}
+		if err != nil {
+			return nil, false, uploadFailed(failReceive, status.Errorf(codes.Unknown, "cannot receive image data: %v", err))
+		}
+	}
+
+	err = up.commit(ctx)
+	if err == errNameConflict {
+		return nil, false, uploadFailed(failInvalidName, status.Errorf(codes.FailedPrecondition, "cannot save %q: %v", name, err))
+	}
+	if err != nil {
+		return nil, false, uploadFailed(failCommit, status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+	}
+	return s.publishStored(ctx, name, up.replaced), up.replaced, nil
+}
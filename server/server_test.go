@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "tages/service/proto"
+)
+
+// Tokens of the test servers started with authentication.
+const (
+	testToken      = "test-token-0123456789"
+	testAdminToken = "test-admin-token-0123456789"
+)
+
+// newTestServer starts the image service over an in-memory connection on a
+// store in a temporary directory. configure, if set, adjusts the default
+// configuration first.
+func newTestServer(t *testing.T, configure func(*Config)) (*server, pb.ImageUploadServiceClient) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Storage.Root = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+	var keys *keyring
+	if cfg.Encryption.KeyFile != "" {
+		var err error
+		if keys, err = loadKeyring(cfg.Encryption.KeyFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := newStorage(cfg.Storage.Root, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := openShares(cfg.Share.Secret, filepath.Join(cfg.Storage.Root, metaDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{cfg: cfg, store: store, events: newEventLog(cfg.Events.LogSize, nil), shares: shares}
+
+	auth := newAuthenticator(cfg.Auth.Tokens, cfg.Auth.AdminTokens)
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(auth.unary), grpc.ChainStreamInterceptor(auth.stream))
+	pb.RegisterImageUploadServiceServer(s, srv)
+	lis := bufconn.Listen(1 << 20)
+	go s.Serve(lis)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+		srv.events.close()
+	})
+	return srv, pb.NewImageUploadServiceClient(conn)
+}
+
+// withToken returns ctx sending token as the bearer token.
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func uploadImage(ctx context.Context, c pb.ImageUploadServiceClient, name string, data []byte) error {
+	stream, err := c.UploadImage(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_Info{Info: &pb.ImageInfo{Name: name}}}); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > 32<<10 {
+			n = 32 << 10
+		}
+		if err := stream.Send(&pb.UploadImageRequest{Data: &pb.UploadImageRequest_Chunkdata{Chunkdata: data[:n]}}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func mustUpload(t *testing.T, ctx context.Context, c pb.ImageUploadServiceClient, name string, data []byte) {
+	t.Helper()
+	if err := uploadImage(ctx, c, name, data); err != nil {
+		t.Fatalf("cannot upload %s: %v", name, err)
+	}
+}
+
+func downloadImage(ctx context.Context, c pb.ImageUploadServiceClient, name string) ([]byte, error) {
+	stream, err := c.DownloadImage(ctx, &wrappers.StringValue{Value: name})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(res.GetChunkdata())
+	}
+}
+
+func wantCode(t *testing.T, err error, code codes.Code, msg string) {
+	t.Helper()
+	if status.Code(err) != code || !strings.Contains(status.Convert(err).Message(), msg) {
+		t.Fatalf("got %v, want %s with %q", err, code, msg)
+	}
+}
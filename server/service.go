@@ -2,94 +2,164 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"os"
-	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	pb "tages/service/proto"
+	"time"
 
+	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 type server struct {
+	cfg    *Config
+	store  *storage
+	stats  transferStats
+	events *eventLog
+	shares *shares
 }
 
-func logError(err error) error {
-	if err != nil {
-		log.Print(err)
+// transferStats counts transfers over the lifetime of the server; it is
+// reported when the server shuts down.
+type transferStats struct {
+	inFlight  int64
+	completed int64
+	failed    int64
+	running   sync.WaitGroup
+}
+
+// begin marks a transfer as started; the returned func records its outcome.
+func (t *transferStats) begin() func(err error) {
+	atomic.AddInt64(&t.inFlight, 1)
+	t.running.Add(1)
+	return func(err error) {
+		atomic.AddInt64(&t.inFlight, -1)
+		if err != nil {
+			atomic.AddInt64(&t.failed, 1)
+		} else {
+			atomic.AddInt64(&t.completed, 1)
+		}
+		t.running.Done()
 	}
-	return err
 }
 
-func (s *server) Save(imageName string, imageData bytes.Buffer) (string, error) {
+// wait blocks until no transfer is running or timeout elapses.
+func (t *transferStats) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
 
-	filename := path.Join("files", imageName)
-	//data := bufio.NewWriter(&imageData)
-	err := ioutil.WriteFile(filename, imageData.Bytes(), 0777)
-	if err != nil {
-		return "", fmt.Errorf("cannot write image to file: %w", err)
+// uploadFailed records why an upload failed.
+func uploadFailed(reason string, err error) error {
+	uploadFailures.WithLabelValues(reason).Inc()
+	return err
+}
+
+func (s *server) UploadImage(stream pb.ImageUploadService_UploadImageServer) (err error) {
+	done := s.stats.begin()
+	tl := newTransferLog(stream.Context())
+	defer func() {
+		done(err)
+		tl.finish(err)
+	}()
+
+	err = withStallTimeout(stream.Context(), s.cfg.Limits.StallTimeout, tl.progress, func(ctx context.Context) error {
+		return s.receiveImage(ctx, stream, tl)
+	})
+	if status.Code(err) == codes.DeadlineExceeded {
+		uploadFailures.WithLabelValues(failStalled).Inc()
 	}
-	return imageName, nil
+	return err
 }
 
-func (s *server) UploadImage(stream pb.ImageUploadService_UploadImageServer) error {
-	//req, err:=stream.Recv()
+func (s *server) receiveImage(ctx context.Context, stream pb.ImageUploadService_UploadImageServer, tl *transferLog) error {
 	req, err := stream.Recv()
 	if err != nil {
-		return logError(status.Errorf(codes.Unknown, "cannot receive image info"))
+		return uploadFailed(failReceive, status.Errorf(codes.Unknown, "cannot receive image info"))
 	}
 	imageName := req.GetInfo().GetName()
+	tl.setName(imageName)
 
-	fmt.Println(imageName)
+	up, err := s.store.create(ctx, imageName)
+	if err == errInvalidName {
+		return uploadFailed(failInvalidName, status.Errorf(codes.InvalidArgument, "invalid image name %q", imageName))
+	}
+	if err != nil {
+		return uploadFailed(failWrite, status.Errorf(codes.Internal, "cannot create image: %v", err))
+	}
+	defer up.abort()
+	if mtime := req.GetInfo().GetMtime(); mtime > 0 {
+		up.modTime = time.Unix(0, mtime)
+	}
 
-	imageData := bytes.Buffer{}
-	imageSize := 0
+	spans := newChunkSpans(ctx, "UploadImage.chunks")
+	defer spans.end()
 
 	for {
 		req, err := stream.Recv()
-		chunk := req.GetChunkdata()
-		size := len(chunk)
-
-		log.Printf("Chunck of %d received", size)
-		imageSize += size
-
 		if err == io.EOF {
-			//return stream.SendAndClose()
-			log.Print("No more data")
 			break
 		}
+		if err != nil {
+			return uploadFailed(failReceive, status.Errorf(status.Code(err), "cannot receive chunk data: %v", err))
+		}
+		chunk := req.GetChunkdata()
+		spans.add(len(chunk))
+
+		if max := s.cfg.Limits.MaxFileSize; max > 0 && up.size+int64(len(chunk)) > max {
+			return uploadFailed(failTooLarge, status.Errorf(codes.ResourceExhausted, "image is too large: limit is %d bytes", max))
+		}
 
-		_, err = imageData.Write(chunk)
+		_, err = up.Write(chunk)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot write chunk data: %v", err))
+			return uploadFailed(failWrite, status.Errorf(codes.Internal, "cannot write chunk data: %v", err))
 
 		}
+		tl.add(len(chunk))
 	}
 
-	//create and save the image here
-	imageName, err = s.Save(imageName, imageData)
+	spans.end()
+
+	//save the image under its final name
+	err = unlessStalled(ctx, true, func() error { return up.commit(ctx) })
+	if err == errStalled {
+		return err
+	}
+	if err == errNameConflict {
+		return uploadFailed(failInvalidName, status.Errorf(codes.FailedPrecondition, "cannot save %q: %v", imageName, err))
+	}
 	if err != nil {
-		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+		return uploadFailed(failCommit, status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
 	}
+	s.publishStored(stream.Context(), imageName, up.replaced)
 
 	res := &pb.UploadImageResponse{
 		Name: imageName,
-		Size: uint32(imageSize),
+		Size: uint32(up.size),
 	}
 
 	err = stream.SendAndClose(res)
 
 	if err != nil {
-		return logError(status.Errorf(codes.Unknown, "cannot send response: %v", err))
+		return status.Errorf(codes.Unknown, "cannot send response: %v", err)
 	}
 
-	log.Printf("saved image with id: %s, size: %d", imageName, imageSize)
 	return nil
 }
 
@@ -97,23 +167,14 @@ func (s *server) ListImages(ctx context.Context, message *wrappers.StringValue)
 
 	liste := []*pb.ImageInfo{}
 
-	files, err := ioutil.ReadDir("./files")
+	// the message is an optional name prefix, e.g. "2021/" for a directory
+	files, err := s.store.list(ctx, message.GetValue())
 	if err != nil {
-		log.Fatal(err)
+		return nil, status.Errorf(codes.Internal, "cannot list images: %v", err)
 	}
 
 	for _, f := range files {
-
-		//stats, err := os.Stat(f)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		file := &pb.ImageInfo{Name: f.Name(), Created: f.ModTime().String(), Modified: f.ModTime().String()} //f.ModTime()
-		//log.Println("filename : ", stats.Name())
-		//log.Println("file size : ", stats.Size())
-		//log.Println("file date : ", stats.ModTime())
-		liste = append(liste, file)
+		liste = append(liste, s.imageInfo(ctx, f))
 	}
 
 	images := &pb.ImageList{Images: liste}
@@ -121,38 +182,150 @@ func (s *server) ListImages(ctx context.Context, message *wrappers.StringValue)
 	return images, status.New(codes.OK, "").Err()
 }
 
-func (s *server) DownloadImage(filename *wrappers.StringValue, stream pb.ImageUploadService_DownloadImageServer) error {
+func (s *server) imageInfo(ctx context.Context, f os.FileInfo) *pb.ImageInfo {
+	sum, err := s.store.digest(f.Name(), f)
+	if err != nil {
+		loggerFrom(ctx).Warn("cannot compute image digest", "name", f.Name(), "error", err)
+	}
+	return &pb.ImageInfo{
+		Name:     f.Name(),
+		Created:  f.ModTime().String(),
+		Modified: f.ModTime().String(),
+		Size:     f.Size(),
+		Mtime:    f.ModTime().UnixNano(),
+		Sha256:   sum,
+	}
+}
 
-	//find file in the repository
-	imagePath := "files/" + filename.Value
-	file, err := os.Open(imagePath)
+// storageError converts an error from the storage layer to a gRPC status.
+func storageError(err error, name, msg string) error {
+	switch {
+	case err == errInvalidName:
+		return status.Errorf(codes.InvalidArgument, "invalid image name %q", name)
+	case os.IsNotExist(err):
+		return status.Errorf(codes.NotFound, "image %q not found", name)
+	case err == errCorruptImage:
+		return status.Errorf(codes.DataLoss, "%s: %v", msg, err)
+	case keyUnavailable(err):
+		return status.Errorf(codes.FailedPrecondition, "%s: %v", msg, err)
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+func (s *server) StatImage(ctx context.Context, name *wrappers.StringValue) (*pb.ImageInfo, error) {
+	fi, err := s.store.stat(ctx, name.Value)
 	if err != nil {
-		log.Fatal("cannot open image file: ", err)
+		return nil, storageError(err, name.Value, "cannot stat image")
+	}
+	return s.imageInfo(ctx, fi), nil
+}
+
+func (s *server) DeleteImage(ctx context.Context, name *wrappers.StringValue) (*empty.Empty, error) {
+	if err := s.deleteImage(ctx, name.Value); err != nil {
+		return nil, err
 	}
-	stats, err := file.Stat()
+	return &empty.Empty{}, nil
+}
+
+func (s *server) deleteImage(ctx context.Context, name string) error {
+	if err := s.store.remove(ctx, name); err != nil {
+		return storageError(err, name, "cannot delete image")
+	}
+	loggerFrom(ctx).Info("image deleted", "name", name)
+	s.events.publish(pb.ImageEvent_DELETED, &pb.ImageInfo{Name: name})
+	return nil
+}
+
+// resumeOffsetKey is the metadata key a client sets to resume an interrupted
+// download from the given byte offset.
+const resumeOffsetKey = "x-resume-offset"
+
+func resumeOffset(ctx context.Context, size int64) (int64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(resumeOffsetKey)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(v[0], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid resume offset %q", v[0])
+	}
+	if offset > size {
+		return 0, status.Errorf(codes.OutOfRange, "resume offset %d is beyond the image size %d", offset, size)
+	}
+	return offset, nil
+}
+
+func (s *server) DownloadImage(filename *wrappers.StringValue, stream pb.ImageUploadService_DownloadImageServer) (err error) {
+	// a share link counts a download only once the image was opened
+	var count func(resumed bool) error
+	if token := shareTokenFrom(stream.Context()); token != "" {
+		id, name, err := s.shares.redeem(token)
+		if err != nil {
+			return err
+		}
+		if filename.GetValue() != "" && filename.GetValue() != name {
+			return status.Error(codes.PermissionDenied, "share link is for another image")
+		}
+		filename = &wrappers.StringValue{Value: name}
+		count = func(resumed bool) error { return s.shares.use(id, resumed, true) }
+	}
+	done := s.stats.begin()
+	tl := newTransferLog(stream.Context())
+	tl.setName(filename.Value)
+	defer func() {
+		done(err)
+		tl.finish(err)
+	}()
+
+	return withStallTimeout(stream.Context(), s.cfg.Limits.StallTimeout, tl.progress, func(ctx context.Context) error {
+		return s.sendImage(ctx, filename, stream, tl, count)
+	})
+}
+
+func (s *server) sendImage(ctx context.Context, filename *wrappers.StringValue, stream pb.ImageUploadService_DownloadImageServer, tl *transferLog, count func(resumed bool) error) error {
+	//find file in the repository
+	file, stats, err := s.store.open(ctx, filename.Value)
 	if err != nil {
-		log.Fatal("cannot open image file: ", err)
+		return storageError(err, filename.Value, "cannot open image file")
 	}
 	defer file.Close()
 
+	offset, err := resumeOffset(ctx, stats.Size())
+	if err != nil {
+		return err
+	}
+	if count != nil {
+		if err := count(offset > 0); err != nil {
+			return err
+		}
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return status.Errorf(codes.Internal, "cannot seek image file: %v", err)
+		}
+		// the header tells the client the offset was honoured
+		stream.SetHeader(metadata.Pairs(resumeOffsetKey, strconv.FormatInt(offset, 10)))
+		tl.setOffset(offset)
+	}
+
 	res := &pb.DownloadImageResponse{
 		Data: &pb.DownloadImageResponse_Info{
-			Info: &pb.ImageInfo{
-				Name:     filename.Value,
-				Created:  stats.ModTime().String(),
-				Modified: stats.ModTime().String(),
-			},
+			Info: s.imageInfo(stream.Context(), stats),
 		},
 	}
 
 	err = stream.Send(res)
 
 	if err != nil {
-		log.Fatal("cannot send file to the client: ", err, stream)
+		return status.Errorf(codes.Unknown, "cannot send file to the client: %v", err)
 	}
 
 	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, s.cfg.ChunkSize)
+
+	spans := newChunkSpans(ctx, "DownloadImage.chunks")
+	defer spans.end()
 
 	for {
 		n, err := reader.Read(buffer)
@@ -160,7 +333,7 @@ func (s *server) DownloadImage(filename *wrappers.StringValue, stream pb.ImageUp
 			break
 		}
 		if err != nil {
-			log.Fatal("cannot read chunck to buffer: ", err)
+			return storageError(err, filename.Value, "cannot read chunck to buffer")
 		}
 
 		res := &pb.DownloadImageResponse{
@@ -171,17 +344,13 @@ func (s *server) DownloadImage(filename *wrappers.StringValue, stream pb.ImageUp
 
 		err = stream.Send(res)
 		if err != nil {
-			log.Fatal("cannot send chunk to the client: ", err)
+			return status.Errorf(codes.Unknown, "cannot send chunk to the client: %v", err)
 		}
+		bytesDownloaded.Add(float64(n))
+		tl.add(n)
+		spans.add(n)
 	}
 
-	//res1, err := stream.CloseAndRecv()
-	if err != nil {
-		log.Fatal("cannot receive response: ", err)
-	}
-
-	log.Printf("image served with name: %s ", filename.Value)
-
 	return nil
 
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	pb "tages/service/proto"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// shareTokenKey is the metadata key carrying a share token on DownloadImage
+// calls, which then need no auth token.
+const shareTokenKey = "x-share-token"
+
+// Files of the share links in the storage metadata directory.
+const (
+	shareKeyFile   = "share.key"
+	shareStateFile = "shares.json"
+)
+
+// shares issues and redeems share links. A token is
+// base64url("<id>\n<expiry unix>\n<name>") "." base64url(HMAC-SHA256), so it
+// cannot be forged or pointed at another image. The download counts and
+// revocations are kept by id in a state file, which also makes links
+// survive restarts.
+type shares struct {
+	key       []byte
+	stateFile string
+
+	mu    sync.Mutex
+	links map[string]*shareState
+}
+
+type shareState struct {
+	Name         string    `json:"name"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Revoked      bool      `json:"revoked,omitempty"`
+}
+
+// openShares loads the share links kept in metaDir. Without a configured
+// secret, a random key is created there on first use.
+func openShares(secret, metaDir string) (*shares, error) {
+	sh := &shares{key: []byte(secret), stateFile: filepath.Join(metaDir, shareStateFile), links: make(map[string]*shareState)}
+	if secret == "" {
+		keyFile := filepath.Join(metaDir, shareKeyFile)
+		key, err := ioutil.ReadFile(keyFile)
+		if os.IsNotExist(err) {
+			key = make([]byte, 32)
+			rand.Read(key)
+			err = ioutil.WriteFile(keyFile, key, 0600)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot load share key: %w", err)
+		}
+		sh.key = key
+	}
+	data, err := ioutil.ReadFile(sh.stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot load share links: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &sh.links); err != nil {
+			return nil, fmt.Errorf("cannot load share links from %s: %w", sh.stateFile, err)
+		}
+	}
+	return sh, nil
+}
+
+func (sh *shares) sign(payload string) string {
+	mac := hmac.New(sha256.New, sh.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// create issues a link to name valid until expires.
+func (sh *shares) create(name string, expires time.Time, maxDownloads int) (id, token string, err error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id = hex.EncodeToString(b)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(id + "\n" + strconv.FormatInt(expires.Unix(), 10) + "\n" + name))
+	token = payload + "." + sh.sign(payload)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.links[id] = &shareState{Name: name, Expires: expires.UTC(), MaxDownloads: maxDownloads}
+	return id, token, sh.saveLocked()
+}
+
+var errShareInvalid = status.Error(codes.PermissionDenied, "invalid share link")
+
+// redeem checks token and returns the id of its link and the image it gives
+// access to. Downloads are counted by use, once the image was opened.
+func (sh *shares) redeem(token string) (id, name string, err error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(sh.sign(token[:i]))) {
+		return "", "", errShareInvalid
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token[:i])
+	parts := strings.SplitN(string(raw), "\n", 3)
+	if err != nil || len(parts) != 3 {
+		return "", "", errShareInvalid
+	}
+	id = parts[0]
+	// the signed expiry is checked first, since expired links are dropped
+	// from the state
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", "", errShareInvalid
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return "", "", status.Error(codes.PermissionDenied, "share link expired")
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	link, err := sh.linkLocked(id)
+	if err != nil {
+		return "", "", err
+	}
+	return id, link.Name, nil
+}
+
+func (sh *shares) linkLocked(id string) (*shareState, error) {
+	link, ok := sh.links[id]
+	switch {
+	case !ok || link.Revoked:
+		return nil, status.Error(codes.PermissionDenied, "share link was revoked")
+	case time.Now().After(link.Expires):
+		return nil, status.Error(codes.PermissionDenied, "share link expired")
+	}
+	return link, nil
+}
+
+// use checks that the link id may serve another download and, if record is
+// set, counts it. A resumed download or a Range request continues one that
+// was already counted, so it is neither counted nor refused once the link is
+// used up.
+func (sh *shares) use(id string, resumed, record bool) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	link, err := sh.linkLocked(id)
+	if err != nil {
+		return err
+	}
+	if resumed && link.Downloads > 0 {
+		return nil
+	}
+	if link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads {
+		return status.Error(codes.PermissionDenied, "share link was used up")
+	}
+	if !record {
+		return nil
+	}
+	link.Downloads++
+	if err := sh.saveLocked(); err != nil {
+		link.Downloads--
+		return status.Errorf(codes.Internal, "cannot record share link download: %v", err)
+	}
+	return nil
+}
+
+func (sh *shares) revoke(id string) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	link, ok := sh.links[id]
+	if !ok {
+		return status.Errorf(codes.NotFound, "share link %q not found", id)
+	}
+	link.Revoked = true
+	return sh.saveLocked()
+}
+
+// saveLocked writes the state file, dropping expired links, through a
+// temporary file so that a crash never leaves it half written.
+func (sh *shares) saveLocked() error {
+	now := time.Now()
+	for id, link := range sh.links {
+		if now.After(link.Expires) {
+			delete(sh.links, id)
+		}
+	}
+	data, err := json.MarshalIndent(sh.links, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := sh.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sh.stateFile)
+}
+
+// shareTokenFrom returns the share token sent with a call, if any.
+func shareTokenFrom(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(shareTokenKey); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// sharePath is where the REST gateway redeems share links.
+const sharePath = "/share/"
+
+func (s *server) CreateShareLink(ctx context.Context, req *pb.CreateShareLinkRequest) (*pb.ShareLink, error) {
+	name := req.GetName()
+	if _, err := s.store.stat(ctx, name); err != nil {
+		return nil, storageError(err, name, "cannot stat image")
+	}
+	ttl := time.Duration(req.GetTtlSeconds()) * time.Second
+	switch {
+	case ttl < 0 || req.GetMaxDownloads() < 0:
+		return nil, status.Error(codes.InvalidArgument, "ttl and max downloads must not be negative")
+	case ttl == 0:
+		ttl = s.cfg.Share.DefaultTTL
+	case ttl > s.cfg.Share.MaxTTL:
+		return nil, status.Errorf(codes.InvalidArgument, "ttl must not exceed %s", s.cfg.Share.MaxTTL)
+	}
+	expires := time.Now().Add(ttl)
+	id, token, err := s.shares.create(name, expires, int(req.GetMaxDownloads()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save share link: %v", err)
+	}
+	loggerFrom(ctx).Info("share link created", "name", name, "id", id, "expires", expires, "max_downloads", req.GetMaxDownloads())
+	link := &pb.ShareLink{Id: id, Token: token, Name: name, Expires: expires.UnixNano(), MaxDownloads: req.GetMaxDownloads()}
+	if base := s.cfg.Share.BaseURL; base != "" {
+		link.Url = strings.TrimSuffix(base, "/") + sharePath + token
+	}
+	return link, nil
+}
+
+func (s *server) RevokeShareLink(ctx context.Context, id *wrappers.StringValue) (*empty.Empty, error) {
+	if err := s.shares.revoke(id.GetValue()); err != nil {
+		return nil, err
+	}
+	loggerFrom(ctx).Info("share link revoked", "id", id.GetValue())
+	return &empty.Empty{}, nil
+}
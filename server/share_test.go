@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	pb "tages/service/proto"
+)
+
+func withShareToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), shareTokenKey, token)
+}
+
+func TestShareLinkDownloadWithoutAuthToken(t *testing.T) {
+	_, c := newTestServer(t, func(cfg *Config) { cfg.Auth.Tokens = []string{testToken} })
+	ctx := withToken(context.Background(), testToken)
+	data := []byte("shared image")
+	mustUpload(t, ctx, c, "a.img", data)
+	mustUpload(t, ctx, c, "b.img", []byte("private image"))
+
+	link, err := c.CreateShareLink(ctx, &pb.CreateShareLinkRequest{Name: "a.img"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := downloadImage(withShareToken(link.Token), c, "")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	_, err = downloadImage(withShareToken(link.Token), c, "b.img")
+	wantCode(t, err, codes.PermissionDenied, "another image")
+	_, err = downloadImage(context.Background(), c, "a.img")
+	wantCode(t, err, codes.Unauthenticated, "auth token")
+	// a share token opens nothing but downloads
+	_, err = c.ListImages(withShareToken(link.Token), &wrappers.StringValue{})
+	wantCode(t, err, codes.Unauthenticated, "auth token")
+}
+
+func TestShareLinkTampered(t *testing.T) {
+	_, c := newTestServer(t, nil)
+	ctx := context.Background()
+	mustUpload(t, ctx, c, "a.img", []byte("a"))
+	mustUpload(t, ctx, c, "b.img", []byte("b"))
+	link, err := c.CreateShareLink(ctx, &pb.CreateShareLinkRequest{Name: "a.img"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := strings.LastIndex(link.Token, ".")
+	payload, sig := link.Token[:i], link.Token[i+1:]
+	flip := func(s string, at int) string {
+		b := []byte(s)
+		if b[at] == 'A' {
+			b[at] = 'B'
+		} else {
+			b[at] = 'A'
+		}
+		return string(b)
+	}
+	for name, token := range map[string]string{
+		"payload":   flip(payload, len(payload)/2),
+		"signature": payload + "." + flip(sig, 0),
+		"no dot":    payload + sig,
+		"empty":     ".",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := downloadImage(withShareToken(token), c, "")
+			wantCode(t, err, codes.PermissionDenied, "invalid share link")
+		})
+	}
+}
+
+func TestShareLinkForged(t *testing.T) {
+	_, c := newTestServer(t, func(cfg *Config) { cfg.Share.Secret = "the real secret" })
+	ctx := context.Background()
+	mustUpload(t, ctx, c, "a.img", []byte("a"))
+	mustUpload(t, ctx, c, "b.img", []byte("b"))
+	if _, err := c.CreateShareLink(ctx, &pb.CreateShareLinkRequest{Name: "a.img"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a token signed with another secret
+	forger, err := openShares("another secret", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, forged, err := forger.create("b.img", time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = downloadImage(withShareToken(forged), c, "")
+	wantCode(t, err, codes.PermissionDenied, "invalid share link")
+}
+
+func TestShareLinkExpired(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	mustUpload(t, context.Background(), c, "a.img", []byte("a"))
+	_, token, err := srv.shares.create("a.img", time.Now().Add(-time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = downloadImage(withShareToken(token), c, "")
+	wantCode(t, err, codes.PermissionDenied, "expired")
+
+	_, err = c.CreateShareLink(context.Background(), &pb.CreateShareLinkRequest{Name: "a.img", TtlSeconds: int64(srv.cfg.Share.MaxTTL/time.Second) + 1})
+	wantCode(t, err, codes.InvalidArgument, "ttl must not exceed")
+}
+
+func TestShareLinkDownloadLimit(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	mustUpload(t, context.Background(), c, "a.img", []byte("a"))
+	link, err := c.CreateShareLink(context.Background(), &pb.CreateShareLinkRequest{Name: "a.img", MaxDownloads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checking a link does not use it up
+	if err := srv.shares.use(link.Id, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := downloadImage(withShareToken(link.Token), c, ""); err != nil {
+			t.Fatalf("download %d: %v", i+1, err)
+		}
+	}
+	_, err = downloadImage(withShareToken(link.Token), c, "")
+	wantCode(t, err, codes.PermissionDenied, "used up")
+
+	// the count survives a restart
+	reopened, err := openShares("", filepath.Join(srv.store.root, metaDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reopened.use(link.Id, false, false)
+	wantCode(t, err, codes.PermissionDenied, "used up")
+}
+
+func TestShareLinkCountsStartedDownloads(t *testing.T) {
+	srv, c := newTestServer(t, nil)
+	ctx := context.Background()
+	data := []byte("shared image")
+	mustUpload(t, ctx, c, "a.img", data)
+	link, err := c.CreateShareLink(ctx, &pb.CreateShareLinkRequest{Name: "a.img", MaxDownloads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither a request for another image nor a missing image is counted
+	_, err = downloadImage(withShareToken(link.Token), c, "b.img")
+	wantCode(t, err, codes.PermissionDenied, "another image")
+	if _, err := c.DeleteImage(ctx, &wrappers.StringValue{Value: "a.img"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = downloadImage(withShareToken(link.Token), c, "")
+	wantCode(t, err, codes.NotFound, "not found")
+	mustUpload(t, ctx, c, "a.img", data)
+	h := newRESTHandler(srv, newAuthenticator(nil, nil))
+	wantStatus(t, serve(h, http.MethodHead, sharePath+link.Token, nil), http.StatusOK)
+
+	if got, err := downloadImage(withShareToken(link.Token), c, ""); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	// resuming the counted download still works once the link is used up
+	resumed := metadata.AppendToOutgoingContext(withShareToken(link.Token), resumeOffsetKey, "6")
+	if got, err := downloadImage(resumed, c, ""); err != nil || !bytes.Equal(got, data[6:]) {
+		t.Fatalf("resumed: got %q, %v", got, err)
+	}
+	w := serve(h, http.MethodGet, sharePath+link.Token, nil, "Range", "bytes=6-")
+	wantStatus(t, w, http.StatusPartialContent)
+	_, err = downloadImage(withShareToken(link.Token), c, "")
+	wantCode(t, err, codes.PermissionDenied, "used up")
+	wantStatus(t, serve(h, http.MethodGet, sharePath+link.Token, nil), http.StatusForbidden)
+}
+
+func TestShareLinkRevoked(t *testing.T) {
+	_, c := newTestServer(t, nil)
+	ctx := context.Background()
+	mustUpload(t, ctx, c, "a.img", []byte("a"))
+	link, err := c.CreateShareLink(ctx, &pb.CreateShareLinkRequest{Name: "a.img"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RevokeShareLink(ctx, &wrappers.StringValue{Value: link.Id}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = downloadImage(withShareToken(link.Token), c, "")
+	wantCode(t, err, codes.PermissionDenied, "revoked")
+
+	_, err = c.RevokeShareLink(ctx, &wrappers.StringValue{Value: "unknown"})
+	wantCode(t, err, codes.NotFound, "not found")
+}
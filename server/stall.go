@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withStallTimeout runs transfer and fails with codes.DeadlineExceeded as
+// soon as the value reported by progress has not changed for timeout, e.g.
+// because the client stopped sending or reading. A zero timeout disables
+// the check.
+//
+// A blocked Recv or Send only returns once the handler has returned, so
+// transfer runs on its own goroutine and may outlive the call by a moment
+// after a stall. It must therefore own everything it uses, such as open
+// files, apart from state safe for concurrent use. The context it is given
+// is cancelled on a stall, and steps that must not happen once the call
+// failed, such as committing an upload, go through unlessStalled.
+func withStallTimeout(ctx context.Context, timeout time.Duration, progress func() int64, transfer func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return transfer(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	g := &stallGuard{}
+	ctx = context.WithValue(ctx, stallGuardKey{}, g)
+	result := make(chan error, 1)
+	go func() {
+		result <- transfer(ctx)
+	}()
+
+	tick := time.NewTicker(timeout / 4)
+	defer tick.Stop()
+	last, lastChange := progress(), time.Now()
+	for {
+		select {
+		case err := <-result:
+			return err
+		case now := <-tick.C:
+			if p := progress(); p != last {
+				last, lastChange = p, now
+			} else if now.Sub(lastChange) >= timeout {
+				if !g.stall() {
+					// only the answer is left to send
+					return <-result
+				}
+				return status.Errorf(codes.DeadlineExceeded, "transfer stalled: no data for %s", timeout)
+			}
+		}
+	}
+}
+
+// errStalled is returned by unlessStalled once the call has failed.
+var errStalled = status.Error(codes.DeadlineExceeded, "transfer stalled")
+
+type stallGuardKey struct{}
+
+// stallGuard keeps the stall from being reported while the transfer takes
+// a step that cannot be undone.
+type stallGuard struct {
+	mu      sync.Mutex
+	stalled bool
+	// final is set once the transfer did its last such step
+	final bool
+}
+
+// stall marks the transfer as stalled, unless it already did its final step
+// and only has to answer.
+func (g *stallGuard) stall() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.final {
+		g.stalled = true
+	}
+	return g.stalled
+}
+
+// unlessStalled runs fn unless the transfer of ctx was already reported as
+// stalled, in which case it returns errStalled. final marks fn as the last
+// step of the transfer: once it succeeded, the call waits for the transfer
+// to answer instead of failing.
+func unlessStalled(ctx context.Context, final bool, fn func() error) error {
+	g, _ := ctx.Value(stallGuardKey{}).(*stallGuard)
+	if g == nil {
+		return fn()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stalled {
+		return errStalled
+	}
+	err := fn()
+	if err == nil && final {
+		g.final = true
+	}
+	return err
+}
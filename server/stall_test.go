@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStallCancelsTransferAndBlocksCommit(t *testing.T) {
+	committed := make(chan error, 1)
+	err := withStallTimeout(context.Background(), 40*time.Millisecond, func() int64 { return 0 }, func(ctx context.Context) error {
+		go func() {
+			// the upload completes only after the call has failed
+			<-ctx.Done()
+			committed <- unlessStalled(ctx, true, func() error {
+				t.Error("commit ran after the stall was reported")
+				return nil
+			})
+		}()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	select {
+	case err := <-committed:
+		if err != errStalled {
+			t.Fatalf("commit after stall returned %v, want errStalled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("transfer context was not cancelled")
+	}
+}
+
+func TestStallAfterFinalCommitWaitsForResult(t *testing.T) {
+	answered := errors.New("answered")
+	err := withStallTimeout(context.Background(), 40*time.Millisecond, func() int64 { return 0 }, func(ctx context.Context) error {
+		if err := unlessStalled(ctx, true, func() error { return nil }); err != nil {
+			return err
+		}
+		// sending the answer takes longer than the stall timeout
+		time.Sleep(150 * time.Millisecond)
+		return answered
+	})
+	if err != answered {
+		t.Fatalf("got %v, want the result of the committed transfer", err)
+	}
+}
+
+func TestStallGuardAllowsRepeatedSteps(t *testing.T) {
+	err := withStallTimeout(context.Background(), time.Second, func() int64 { return 0 }, func(ctx context.Context) error {
+		for i := 0; i < 3; i++ {
+			if err := unlessStalled(ctx, false, func() error { return nil }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnlessStalledWithoutGuard(t *testing.T) {
+	ran := false
+	if err := unlessStalled(context.Background(), true, func() error { ran = true; return nil }); err != nil || !ran {
+		t.Fatalf("got %v, ran %v", err, ran)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// uploadsDir holds files that are still being received. They are renamed into
+// the storage root once the upload completes, so a crash or shutdown never
+// leaves a truncated image behind under its real name.
+const uploadsDir = ".uploads"
+
+// metaDir holds the SHA-256 digest of every image, computed while it is
+// uploaded or, for older images, the first time it is asked for, and marks
+// the images encrypted at rest.
+const metaDir = ".meta"
+
+var (
+	errInvalidName  = errors.New("invalid image name")
+	errNameConflict = errors.New("image name conflicts with an existing directory or image")
+)
+
+type storage struct {
+	root string
+	// changes is held shared by commits and removals, and exclusively while
+	// a backup takes its snapshot or a backup is restored.
+	changes sync.RWMutex
+	// keys encrypts new images if set; images are stored in plain otherwise
+	keys *keyring
+}
+
+// newStorage opens the store at root. Only the server needs to read it, so
+// root is made private to its user, also closing it to others where older
+// versions left it readable.
+func newStorage(root string, keys *keyring) (*storage, error) {
+	st := &storage{root: root, keys: keys}
+	for _, dir := range []string{uploadsDir, metaDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			return nil, fmt.Errorf("cannot create storage directory: %w", err)
+		}
+	}
+	if err := os.Chmod(root, 0700); err != nil {
+		return nil, fmt.Errorf("cannot restrict access to storage directory: %w", err)
+	}
+	return st, nil
+}
+
+// validName rejects names that would escape the storage root or collide with
+// the server's own bookkeeping files. Names may contain slashes to store
+// images in directories, e.g. "2021/holidays/beach.jpg".
+func validName(name string) bool {
+	if name == "" || strings.Contains(name, `\`) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+func (st *storage) path(name string) string {
+	return filepath.Join(st.root, filepath.FromSlash(name))
+}
+
+// image is the FileInfo of a stored image, named by its path relative to
+// the storage root rather than its base name, with the size of its content
+// rather than of the possibly encrypted file.
+type image struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (i image) Name() string {
+	return i.name
+}
+
+func (i image) Size() int64 {
+	return i.size
+}
+
+// image describes the file of name.
+func (st *storage) image(name string, info os.FileInfo) (os.FileInfo, error) {
+	enc, err := st.encrypted(name)
+	if err != nil {
+		return nil, err
+	}
+	if !enc {
+		return image{info, name, info.Size()}, nil
+	}
+	return image{info, name, plainSize(info.Size())}, nil
+}
+
+// reader returns the content of f, decrypting it if it is encrypted, and
+// its size. Closing the reader closes f.
+func (st *storage) reader(f *os.File, info os.FileInfo, encrypted bool) (io.ReadSeekCloser, int64, error) {
+	if !encrypted {
+		return f, info.Size(), nil
+	}
+	h, err := readHeader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	d, err := newDecryptReader(f, h, info.Size(), st.keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d, d.size, nil
+}
+
+// errNotImage is returned for directories, which share the name space with
+// images but cannot be read or removed as such.
+func errNotImage(name string) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// create starts a new upload for name. The caller must finish it with either
+// commit or abort.
+func (st *storage) create(ctx context.Context, name string) (*upload, error) {
+	_, span := tracer.Start(ctx, "storage.create", trace.WithAttributes(attribute.String("image.name", name)))
+	defer span.End()
+
+	if !validName(name) {
+		return nil, errInvalidName
+	}
+	f, err := ioutil.TempFile(filepath.Join(st.root, uploadsDir), "*.partial")
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("cannot create upload file: %w", err)
+	}
+	up := &upload{st: st, name: name, f: f, w: f, hash: sha256.New()}
+	if st.keys != nil {
+		if up.enc, err = newEncryptWriter(f, st.keys); err != nil {
+			up.abort()
+			return nil, fmt.Errorf("cannot create upload file: %w", err)
+		}
+		up.w = up.enc
+	}
+	return up, nil
+}
+
+// open returns the content of the image, decrypted if it is encrypted, and
+// its FileInfo.
+func (st *storage) open(ctx context.Context, name string) (io.ReadSeekCloser, os.FileInfo, error) {
+	_, span := tracer.Start(ctx, "storage.open", trace.WithAttributes(attribute.String("image.name", name)))
+	defer span.End()
+
+	if !validName(name) {
+		return nil, nil, errInvalidName
+	}
+	// a key rotation may encrypt the image meanwhile
+	st.changes.RLock()
+	f, err := os.Open(st.path(name))
+	if err != nil {
+		st.changes.RUnlock()
+		span.RecordError(err)
+		return nil, nil, err
+	}
+	enc, err := st.encrypted(name)
+	st.changes.RUnlock()
+	var info os.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+	}
+	if err == nil && info.IsDir() {
+		err = errNotImage(name)
+	}
+	var r io.ReadSeekCloser
+	var size int64
+	if err == nil {
+		r, size, err = st.reader(f, info, enc)
+	}
+	if err != nil {
+		span.RecordError(err)
+		f.Close()
+		return nil, nil, err
+	}
+	return r, image{info, name, size}, nil
+}
+
+func (st *storage) stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if !validName(name) {
+		return nil, errInvalidName
+	}
+	info, err := os.Stat(st.path(name))
+	if err == nil && info.IsDir() {
+		err = errNotImage(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st.image(name, info)
+}
+
+func (st *storage) remove(ctx context.Context, name string) error {
+	_, span := tracer.Start(ctx, "storage.remove", trace.WithAttributes(attribute.String("image.name", name)))
+	defer span.End()
+
+	if !validName(name) {
+		return errInvalidName
+	}
+	st.changes.RLock()
+	defer st.changes.RUnlock()
+	return st.removeLocked(name)
+}
+
+func (st *storage) removeLocked(name string) error {
+	if info, err := os.Stat(st.path(name)); err == nil && info.IsDir() {
+		return errNotImage(name)
+	}
+	if err := os.Remove(st.path(name)); err != nil {
+		return err
+	}
+	os.Remove(st.digestPath(name))
+	os.Remove(st.encPath(name))
+	st.pruneDirs(name)
+	return nil
+}
+
+func (st *storage) digestPath(name string) string {
+	return filepath.Join(st.root, metaDir, url.PathEscape(name)+".sha256")
+}
+
+// digest returns the hex SHA-256 of the image described by info. The value
+// saved next to the image is only trusted while the size and modification
+// time still match; otherwise it is computed again.
+func (st *storage) digest(name string, info os.FileInfo) (string, error) {
+	stamp := fmt.Sprintf(" %d %d", info.Size(), info.ModTime().UnixNano())
+	if b, err := ioutil.ReadFile(st.digestPath(name)); err == nil {
+		if line := string(b); strings.HasSuffix(line, stamp) {
+			return strings.TrimSuffix(line, stamp), nil
+		}
+	}
+
+	enc, err := st.encrypted(name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(st.path(name))
+	if err != nil {
+		return "", err
+	}
+	raw, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	r, _, err := st.reader(f, raw, enc)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	return sum, st.saveDigest(name, sum, info)
+}
+
+func (st *storage) saveDigest(name, sum string, info os.FileInfo) error {
+	line := fmt.Sprintf("%s %d %d", sum, info.Size(), info.ModTime().UnixNano())
+	return ioutil.WriteFile(st.digestPath(name), []byte(line), 0600)
+}
+
+// pruneDirs removes the directories of name left empty, up to the root.
+func (st *storage) pruneDirs(name string) {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(st.path(dir)) != nil {
+			return
+		}
+	}
+}
+
+// list returns the stored images whose name starts with prefix, in name
+// order, skipping internal entries.
+func (st *storage) list(ctx context.Context, prefix string) ([]os.FileInfo, error) {
+	_, span := tracer.Start(ctx, "storage.list", trace.WithAttributes(attribute.String("prefix", prefix)))
+	defer span.End()
+
+	var files []os.FileInfo
+	err := filepath.Walk(st.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == st.root {
+			return nil
+		}
+		rel, err := filepath.Rel(st.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			// no need to look into directories that cannot match
+			if strings.HasPrefix(info.Name(), ".") ||
+				!strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && validName(name) && strings.HasPrefix(name, prefix) {
+			img, err := st.image(name, info)
+			if os.IsNotExist(err) {
+				// removed while walking
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			files = append(files, img)
+		}
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return files, nil
+}
+
+// cleanPartial removes uploads that were never committed and reports how
+// many were deleted.
+func (st *storage) cleanPartial() (int, error) {
+	dir := filepath.Join(st.root, uploadsDir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// snapshotEntry is an image as it was when the snapshot was taken.
+type snapshotEntry struct {
+	name string
+	// path is a hard link to the image, unaffected by later changes
+	path      string
+	info      os.FileInfo
+	encrypted bool
+}
+
+// snapshot hard-links every image into a new directory below uploadsDir
+// while changes are blocked, which takes a consistent view of the store
+// without copying any data. The caller removes the directory.
+func (st *storage) snapshot(ctx context.Context) (string, []snapshotEntry, error) {
+	_, span := tracer.Start(ctx, "storage.snapshot")
+	defer span.End()
+
+	st.changes.Lock()
+	defer st.changes.Unlock()
+	files, err := st.list(ctx, "")
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := ioutil.TempDir(filepath.Join(st.root, uploadsDir), "snapshot-*.partial")
+	if err != nil {
+		return "", nil, err
+	}
+	entries := make([]snapshotEntry, 0, len(files))
+	for i, f := range files {
+		p := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Link(st.path(f.Name()), p); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("cannot link %s into the snapshot: %w", f.Name(), err)
+		}
+		enc, err := st.encrypted(f.Name())
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		entries = append(entries, snapshotEntry{name: f.Name(), path: p, info: f, encrypted: enc})
+	}
+	return dir, entries, nil
+}
+
+type upload struct {
+	st   *storage
+	name string
+	f    *os.File
+	// w is f, or enc writing to f if the image is encrypted
+	w    io.Writer
+	enc  *encryptWriter
+	size int64
+	hash hash.Hash
+	// modTime is given to the image on commit if set
+	modTime time.Time
+	// replaced is set by commit when an older image had the same name
+	replaced bool
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	n, err := u.w.Write(p)
+	u.hash.Write(p[:n])
+	u.size += int64(n)
+	bytesUploaded.Add(float64(n))
+	return n, err
+}
+
+// commit makes the upload visible under its final name.
+func (u *upload) commit(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "storage.commit", trace.WithAttributes(
+		attribute.String("image.name", u.name), attribute.Int64("image.size", u.size)))
+	defer span.End()
+
+	u.st.changes.RLock()
+	defer u.st.changes.RUnlock()
+	return u.commitLocked()
+}
+
+// commitLocked is commit for callers holding st.changes.
+func (u *upload) commitLocked() error {
+	if u.enc != nil {
+		err := u.enc.Close()
+		if err == nil {
+			err = u.enc.rewrap(u.f, u.st.keys)
+		}
+		if err != nil {
+			u.abort()
+			return fmt.Errorf("cannot write image to file: %w", err)
+		}
+	}
+	if err := u.f.Close(); err != nil {
+		os.Remove(u.f.Name())
+		return fmt.Errorf("cannot write image to file: %w", err)
+	}
+	if !u.modTime.IsZero() {
+		if err := os.Chtimes(u.f.Name(), time.Now(), u.modTime); err != nil {
+			os.Remove(u.f.Name())
+			return fmt.Errorf("cannot set modification time: %w", err)
+		}
+	}
+	target := u.st.path(u.name)
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		os.Remove(u.f.Name())
+		return errNameConflict
+	} else if err == nil {
+		u.replaced = true
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		os.Remove(u.f.Name())
+		if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EEXIST) {
+			return errNameConflict
+		}
+		return fmt.Errorf("cannot create image directory: %w", err)
+	}
+	wasEncrypted, err := u.st.encrypted(u.name)
+	if err == nil {
+		err = u.st.markEncrypted(u.name, u.enc != nil)
+	}
+	if err != nil {
+		os.Remove(u.f.Name())
+		return fmt.Errorf("cannot record encryption of image: %w", err)
+	}
+	if err := os.Rename(u.f.Name(), target); err != nil {
+		os.Remove(u.f.Name())
+		// the image left in place keeps its marker
+		u.st.markEncrypted(u.name, wasEncrypted)
+		return fmt.Errorf("cannot write image to file: %w", err)
+	}
+	// a missing digest is computed again when needed
+	if info, err := os.Stat(target); err == nil {
+		u.st.saveDigest(u.name, hex.EncodeToString(u.hash.Sum(nil)), image{info, u.name, u.size})
+	}
+	return nil
+}
+
+// abort discards the partial upload. It is safe to call after commit.
+func (u *upload) abort() {
+	u.f.Close()
+	os.Remove(u.f.Name())
+}
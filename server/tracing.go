@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("tages/service")
+
+// chunksPerSpan is how many chunks of a transfer are grouped in one span, so
+// a large image produces a handful of spans rather than one per chunk.
+const chunksPerSpan = 256
+
+// setupTracing installs the global tracer provider described by cfg. The
+// returned func flushes pending spans and must be called before exit.
+func setupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case "otlp":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// chunkSpans groups the chunks of a transfer into spans of chunksPerSpan
+// chunks each.
+type chunkSpans struct {
+	ctx    context.Context
+	name   string
+	span   trace.Span
+	chunks int
+	bytes  int
+}
+
+func newChunkSpans(ctx context.Context, name string) *chunkSpans {
+	return &chunkSpans{ctx: ctx, name: name}
+}
+
+// add records one chunk of n bytes.
+func (c *chunkSpans) add(n int) {
+	if c.span == nil {
+		_, c.span = tracer.Start(c.ctx, c.name)
+	}
+	c.chunks++
+	c.bytes += n
+	if c.chunks == chunksPerSpan {
+		c.end()
+	}
+}
+
+// end closes the current span, if any.
+func (c *chunkSpans) end() {
+	if c.span == nil {
+		return
+	}
+	c.span.SetAttributes(attribute.Int("chunks", c.chunks), attribute.Int("bytes", c.bytes))
+	c.span.End()
+	c.span, c.chunks, c.bytes = nil, 0, 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	pb "tages/service/proto"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestTracingPropagates(t *testing.T) {
+	spans := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+
+	store, err := newStorage(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()))
+	pb.RegisterImageUploadServiceServer(s, &server{cfg: defaultConfig(), store: store})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := pb.NewImageUploadServiceClient(conn).ListImages(context.Background(), &wrappers.StringValue{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[trace.SpanKind]trace.TraceID{}
+	for _, span := range spans.GetSpans() {
+		ids[span.SpanKind] = span.SpanContext.TraceID()
+	}
+	client, server := ids[trace.SpanKindClient], ids[trace.SpanKindServer]
+	if !client.IsValid() || !server.IsValid() {
+		t.Fatalf("missing spans: %v", spans.GetSpans())
+	}
+	if client != server {
+		t.Fatalf("client trace %s, server trace %s", client, server)
+	}
+}
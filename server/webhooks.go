@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	pb "tages/service/proto"
+	"time"
+)
+
+// Headers sent with every webhook delivery. The signature is the hex
+// HMAC-SHA256, keyed with the endpoint secret, of the timestamp, a dot and
+// the body, so that receivers can also reject replayed deliveries.
+const (
+	webhookSignatureHeader = "X-Tages-Signature"
+	webhookTimestampHeader = "X-Tages-Timestamp"
+	webhookEventHeader     = "X-Tages-Event"
+	webhookDeliveryHeader  = "X-Tages-Delivery"
+)
+
+// webhookPayload is the JSON body POSTed to webhook endpoints.
+type webhookPayload struct {
+	// ID is unique per event and the same for every retry of it.
+	ID    string       `json:"id"`
+	Event string       `json:"event"`
+	Time  time.Time    `json:"time"`
+	Image webhookImage `json:"image"`
+}
+
+type webhookImage struct {
+	Name    string     `json:"name"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+	SHA256  string     `json:"sha256,omitempty"`
+}
+
+var eventNames = map[pb.ImageEvent_Type]string{
+	pb.ImageEvent_CREATED: "created",
+	pb.ImageEvent_UPDATED: "updated",
+	pb.ImageEvent_DELETED: "deleted",
+}
+
+func newWebhookPayload(ev *pb.ImageEvent) webhookPayload {
+	p := webhookPayload{
+		ID:    ev.GetResumeToken(),
+		Event: eventNames[ev.GetType()],
+		Time:  time.Unix(0, ev.GetTime()).UTC(),
+		Image: webhookImage{Name: ev.GetInfo().GetName()},
+	}
+	if ev.GetType() != pb.ImageEvent_DELETED {
+		mtime := time.Unix(0, ev.GetInfo().GetMtime()).UTC()
+		p.Image.Size, p.Image.ModTime, p.Image.SHA256 = ev.GetInfo().GetSize(), &mtime, ev.GetInfo().GetSha256()
+	}
+	return p
+}
+
+// webhooks delivers store events to the configured endpoints. Each endpoint
+// has its own queue and worker, so a slow or failing endpoint delays only its
+// own deliveries, which arrive in order. Deliveries that fail for good, or
+// cannot be queued, are appended to the dead-letter log.
+type webhooks struct {
+	cfg       WebhooksConfig
+	client    *http.Client
+	endpoints []*webhookEndpoint
+	// ctx is cancelled when the remaining deliveries are given up on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// stopped is set once the queues are closed
+	mu      sync.RWMutex
+	stopped bool
+
+	deadMu   sync.Mutex
+	deadFile string
+}
+
+type webhookEndpoint struct {
+	WebhookEndpoint
+	queue chan webhookPayload
+}
+
+// newWebhooks starts one worker per endpoint; it returns nil when no
+// endpoint is configured, and all methods accept a nil receiver.
+func newWebhooks(cfg WebhooksConfig, deadFile string) *webhooks {
+	if len(cfg.Endpoints) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhooks{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		ctx:      ctx,
+		cancel:   cancel,
+		deadFile: deadFile,
+	}
+	for _, e := range cfg.Endpoints {
+		ep := &webhookEndpoint{WebhookEndpoint: e, queue: make(chan webhookPayload, cfg.QueueSize)}
+		w.endpoints = append(w.endpoints, ep)
+		w.wg.Add(1)
+		go w.run(ep)
+	}
+	return w
+}
+
+// notify queues ev for the endpoints subscribed to it. It never blocks: an
+// endpoint whose queue is full gets the event dead-lettered instead.
+func (w *webhooks) notify(ev *pb.ImageEvent) {
+	if w == nil {
+		return
+	}
+	p := newWebhookPayload(ev)
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, ep := range w.endpoints {
+		if !ep.wants(p) {
+			continue
+		}
+		if w.stopped {
+			w.deadLetter(ep, p, 0, "server shutting down")
+			continue
+		}
+		select {
+		case ep.queue <- p:
+		default:
+			w.deadLetter(ep, p, 0, "queue full")
+		}
+	}
+}
+
+func (e *webhookEndpoint) wants(p webhookPayload) bool {
+	if !strings.HasPrefix(p.Image.Name, e.Prefix) {
+		return false
+	}
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, name := range e.Events {
+		if name == p.Event {
+			return true
+		}
+	}
+	return false
+}
+
+// stop lets the workers empty their queues for up to grace, then gives up
+// on the remaining deliveries, which are dead-lettered.
+func (w *webhooks) stop(grace time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	for _, ep := range w.endpoints {
+		close(ep.queue)
+	}
+	w.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		slog.Warn("webhook deliveries still pending, moving them to the dead-letter log")
+		w.cancel()
+		<-done
+	}
+	w.cancel()
+}
+
+func (w *webhooks) run(ep *webhookEndpoint) {
+	defer w.wg.Done()
+	for p := range ep.queue {
+		w.deliver(ep, p)
+	}
+}
+
+// deliver POSTs p until the endpoint accepts it, retrying with exponential
+// backoff on network errors, 429 and 5xx responses.
+func (w *webhooks) deliver(ep *webhookEndpoint, p webhookPayload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		w.deadLetter(ep, p, 0, err.Error())
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		if w.ctx.Err() != nil {
+			w.deadLetter(ep, p, attempt-1, "server shutting down")
+			return
+		}
+		retry, err := w.post(ep, p, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues("delivered").Inc()
+			return
+		}
+		if !retry || attempt >= w.cfg.MaxAttempts {
+			w.deadLetter(ep, p, attempt, err.Error())
+			return
+		}
+		webhookDeliveries.WithLabelValues("retried").Inc()
+		delay := w.backoff(attempt)
+		slog.Debug("webhook delivery failed, retrying", "url", ep.URL, "id", p.ID,
+			"attempt", attempt, "retry_in", delay.String(), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+		}
+	}
+}
+
+func (w *webhooks) backoff(attempt int) time.Duration {
+	d := float64(w.cfg.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	if max := float64(w.cfg.MaxBackoff); d > max {
+		d = max
+	}
+	// spread retries of deliveries that failed together
+	return time.Duration(d * (0.8 + 0.4*rand.Float64()))
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying.
+func (w *webhooks) post(ep *webhookEndpoint, p webhookPayload, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tages-image-service")
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookEventHeader, p.Event)
+	req.Header.Set(webhookDeliveryHeader, p.ID)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(ep.Secret, ts, body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint answered %s", res.Status)
+	}
+	return false, fmt.Errorf("endpoint answered %s", res.Status)
+}
+
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter appends a delivery given up on to the dead-letter log, one JSON
+// object per line, from which it can be inspected or replayed by hand.
+func (w *webhooks) deadLetter(ep *webhookEndpoint, p webhookPayload, attempts int, reason string) {
+	webhookDeliveries.WithLabelValues("dead_lettered").Inc()
+	slog.Warn("webhook delivery failed", "url", ep.URL, "id", p.ID, "event", p.Event,
+		"name", p.Image.Name, "attempts", attempts, "error", reason)
+
+	line, err := json.Marshal(struct {
+		Time     time.Time      `json:"time"`
+		URL      string         `json:"url"`
+		Attempts int            `json:"attempts"`
+		Error    string         `json:"error"`
+		Payload  webhookPayload `json:"payload"`
+	}{time.Now().UTC(), ep.URL, attempts, reason, p})
+	if err != nil {
+		return
+	}
+	w.deadMu.Lock()
+	defer w.deadMu.Unlock()
+	f, err := os.OpenFile(w.deadFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		slog.Error("cannot write webhook dead-letter log", "file", w.deadFile, "error", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "tages/service/proto"
+)
+
+const hookSecret = "0123456789abcdef"
+
+// newTestWebhooks returns webhooks delivering to url with quick retries.
+func newTestWebhooks(t *testing.T, url string, attempts int) *webhooks {
+	t.Helper()
+	cfg := defaultConfig().Webhooks
+	cfg.Endpoints = []WebhookEndpoint{{URL: url, Secret: hookSecret}}
+	cfg.MaxAttempts = attempts
+	cfg.InitialBackoff, cfg.MaxBackoff = time.Millisecond, 5*time.Millisecond
+	return newWebhooks(cfg, filepath.Join(t.TempDir(), "dead.jsonl"))
+}
+
+func hookEvent(seq int, name string) *pb.ImageEvent {
+	return &pb.ImageEvent{
+		Type:        pb.ImageEvent_CREATED,
+		Info:        &pb.ImageInfo{Name: name, Size: 3, Mtime: time.Now().UnixNano(), Sha256: "abc"},
+		ResumeToken: "test-" + strconv.Itoa(seq),
+		Time:        time.Now().UnixNano(),
+	}
+}
+
+type deadLetter struct {
+	Attempts int            `json:"attempts"`
+	Error    string         `json:"error"`
+	Payload  webhookPayload `json:"payload"`
+}
+
+func readDeadLetters(t *testing.T, w *webhooks) []deadLetter {
+	t.Helper()
+	data, err := ioutil.ReadFile(w.deadFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead []deadLetter
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var d deadLetter
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		dead = append(dead, d)
+	}
+	return dead
+}
+
+func TestWebhookSignature(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- r
+		bodies <- body
+	}))
+	defer ts.Close()
+	w := newTestWebhooks(t, ts.URL, 1)
+	w.notify(hookEvent(1, "a.png"))
+	w.stop(time.Second)
+
+	r, body := <-got, <-bodies
+	want := "sha256=" + signWebhook(hookSecret, r.Header.Get(webhookTimestampHeader), body)
+	if sig := r.Header.Get(webhookSignatureHeader); sig != want {
+		t.Fatalf("signature %q, want %q", sig, want)
+	}
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != "test-1" || p.Event != "created" || p.Image.Name != "a.png" || p.Image.SHA256 != "abc" {
+		t.Fatalf("got %+v", p)
+	}
+	if r.Header.Get(webhookEventHeader) != "created" || r.Header.Get(webhookDeliveryHeader) != "test-1" {
+		t.Fatalf("headers %v", r.Header)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	w := newTestWebhooks(t, ts.URL, 5)
+	w.notify(hookEvent(1, "a.png"))
+	w.stop(5 * time.Second)
+	if calls != 3 {
+		t.Fatalf("delivered after %d attempts, want 3", calls)
+	}
+	if dead := readDeadLetters(t, w); len(dead) > 0 {
+		t.Fatalf("dead-lettered %v", dead)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	var calls int32
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	w := newTestWebhooks(t, ts.URL, 3)
+	w.notify(hookEvent(1, "a.png"))
+	w.stop(5 * time.Second)
+	dead := readDeadLetters(t, w)
+	if calls != 3 || len(dead) != 1 || dead[0].Attempts != 3 || dead[0].Payload.ID != "test-1" || !strings.Contains(dead[0].Error, "500") {
+		t.Fatalf("%d attempts, dead-lettered %+v", calls, dead)
+	}
+
+	// other client errors are not retried
+	status, calls = http.StatusBadRequest, 0
+	w = newTestWebhooks(t, ts.URL, 3)
+	w.notify(hookEvent(2, "b.png"))
+	w.stop(5 * time.Second)
+	if dead := readDeadLetters(t, w); calls != 1 || len(dead) != 1 || dead[0].Attempts != 1 {
+		t.Fatalf("%d attempts, dead-lettered %+v", calls, dead)
+	}
+}
+
+func TestWebhookStopDeliversQueued(t *testing.T) {
+	var delivered int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer ts.Close()
+	w := newTestWebhooks(t, ts.URL, 1)
+	for i := 1; i <= 3; i++ {
+		w.notify(hookEvent(i, "a.png"))
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	w.stop(5 * time.Second)
+	if delivered != 3 {
+		t.Fatalf("delivered %d of 3", delivered)
+	}
+	// events after stop go to the dead-letter log
+	w.notify(hookEvent(4, "a.png"))
+	if dead := readDeadLetters(t, w); len(dead) != 1 || dead[0].Payload.ID != "test-4" {
+		t.Fatalf("dead-lettered %+v", dead)
+	}
+}
+
+func TestWebhookStopDeadLettersQueued(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never answers before the delivery is given up on
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+	w := newTestWebhooks(t, ts.URL, 1)
+	for i := 1; i <= 3; i++ {
+		w.notify(hookEvent(i, "a.png"))
+	}
+	w.stop(50 * time.Millisecond)
+	dead := readDeadLetters(t, w)
+	if len(dead) != 3 {
+		t.Fatalf("dead-lettered %+v", dead)
+	}
+	for i, d := range dead {
+		if d.Payload.ID != "test-"+strconv.Itoa(i+1) {
+			t.Fatalf("dead-lettered out of order: %+v", dead)
+		}
+	}
+}